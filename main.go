@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 	"utk-auth-go/src/pkg/auth"
 	"utk-auth-go/src/pkg/authserver"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvasoauth"
+	"utk-auth-go/src/pkg/policy"
+	"utk-auth-go/src/pkg/roster"
+	"utk-auth-go/src/pkg/store"
 	"utk-auth-go/src/pkg/utils"
 
 	"github.com/bwmarrin/discordgo"
@@ -13,6 +22,9 @@ import (
 )
 
 var session *discordgo.Session
+var dataStore store.Store
+var authService *auth.AuthService
+var emailOutbox *auth.Outbox
 
 func init() {
 	{
@@ -23,14 +35,28 @@ func init() {
 	}
 
 	{
-		// create file server_config.json if it doesn't exist
-		if _, err := os.Stat("/data/server_config.json"); os.IsNotExist(err) {
-			file, err := os.Create("/data/server_config.json")
-			if err != nil {
-				log.Println("Error creating server_config.json")
-			}
-			defer file.Close()
+		// open the course and token store
+		var err error
+		dataStore, err = store.FromEnv()
+		if err != nil {
+			log.Fatal("Error opening store: ", err)
 		}
+		utils.SetStore(dataStore)
+	}
+
+	{
+		// pick where verification emails go
+		mailer, err := auth.MailerFromEnv()
+		if err != nil {
+			log.Fatal("Error configuring mail: ", err)
+		}
+		templates, err := auth.EmailTemplatesFromEnv()
+		if err != nil {
+			log.Fatal("Error loading email templates: ", err)
+		}
+		emailOutbox = auth.OutboxFromEnv(dataStore, mailer)
+		emailOutbox.OnStatus = reportEmailStatus
+		authService = auth.NewAuthService(emailOutbox, auth.SenderFromEnv(), templates)
 	}
 }
 
@@ -53,6 +79,15 @@ var (
 	commands = []*discordgo.ApplicationCommand{
 		&auth.Command,
 		&utils.RegisterCourseCommand,
+		&utils.ResyncCommand,
+		&utils.UpdateCourseCommand,
+		&utils.UnregisterCourseCommand,
+		&utils.WhoisCommand,
+		&utils.SectionRoleCommand,
+		&utils.EnrollmentRoleCommand,
+		&utils.DropPolicyCommand,
+		&utils.StaffRoleCommand,
+		&utils.EmailSettingsCommand,
 	}
 
 	// define command handlers
@@ -75,6 +110,17 @@ var (
 
 			// check if guild exists before initiating authentication
 			if exists, err := utils.GuildIdExists(i.GuildID); err != nil {
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: utils.StrPtr(""),
+					Embeds: utils.NewEmbeds(
+						utils.NewEmbed(
+							"Authentication",
+							"Something went wrong while looking up this server's courses. Please try again in a few minutes.",
+							0xff4400,
+							nil,
+						),
+					),
+				})
 				return
 			} else if !exists {
 				log.Println("No course is registered for this server")
@@ -92,12 +138,59 @@ var (
 				return
 			}
 
-			netid := i.ApplicationCommandData().Options[0].StringValue()
+			netid := optionString(i.ApplicationCommandData().Options, "netid")
+			courseId := optionString(i.ApplicationCommandData().Options, "course")
 
-			// check if student exists in canvas course
-			if exists, err := utils.StudentExists(i.GuildID, netid); err != nil {
+			// check if student exists in the server's canvas courses
+			courses, err := utils.StudentCourses(i.GuildID, netid)
+			if err != nil {
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: utils.StrPtr(""),
+					Embeds: utils.NewEmbeds(
+						utils.NewEmbed(
+							"Authentication",
+							"Something went wrong while looking up your enrollment. Please try again in a few minutes.",
+							0xff4400,
+							nil,
+						),
+					),
+				})
 				return
-			} else if !exists {
+			}
+			if courseId != "" {
+				var selected []canvas.Course
+				for _, course := range courses {
+					if course.CourseId == courseId {
+						selected = append(selected, course)
+					}
+				}
+				courses = selected
+			}
+			// observers and designers get no role unless staff mapped them one
+			var withRoles []canvas.Course
+			for _, course := range courses {
+				if len(course.StudentRoles(netid)) > 0 {
+					withRoles = append(withRoles, course)
+				}
+			}
+			if len(courses) > 0 && len(withRoles) == 0 {
+				log.Println(netid, "has no enrollment that gets a role.")
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: utils.StrPtr(""),
+					Embeds: utils.NewEmbeds(
+						utils.NewEmbed(
+							"Authentication",
+							"Your Canvas enrollment doesn't come with a role in this server. Please contact course staff.",
+							0xff4400,
+							nil,
+						),
+					),
+				})
+				return
+			}
+			courses = withRoles
+
+			if len(courses) == 0 {
 				log.Println(netid, "is not enrolled in the course.")
 				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
 					Content: utils.StrPtr(""),
@@ -113,9 +206,41 @@ var (
 				return
 			}
 
-			// check if student is already authenticated
-			if course, err := utils.GetCourseObject(i.GuildID); err != nil {
-				log.Println("Something went wrong while getting course object for guildId:", i.GuildID)
+			// check if student is already authenticated for every course
+			log.Println(i.Member.User.Username + " role list: ")
+			for _, role := range i.Member.Roles {
+				log.Printf("   Role: %s\n", role)
+			}
+			verified := true
+			for _, course := range courses {
+				hasRole := false
+				for _, role := range i.Member.Roles {
+					if role == course.StudentRoles(netid)[0] {
+						hasRole = true
+					}
+				}
+				verified = verified && hasRole
+			}
+			if verified {
+				log.Println("User is already authenticated")
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: utils.StrPtr(""),
+					Embeds: utils.NewEmbeds(
+						utils.NewEmbed(
+							"Authentication",
+							"You've already been verified.",
+							0xff4400,
+							nil,
+						),
+					),
+				})
+				return
+			}
+
+			// check that the NetID isn't already bound to someone else
+			bindingNote := ""
+			if result, err := policy.CheckBinding(dataStore, policy.ModeFromEnv(), i.GuildID, i.Member.User.ID, netid); err != nil {
+				log.Println("Something went wrong while checking the NetID binding for:", netid, err)
 				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
 					Content: utils.StrPtr(""),
 					Embeds: utils.NewEmbeds(
@@ -129,41 +254,40 @@ var (
 				})
 				return
 			} else {
-				authRoleID := course.AuthRoleId
-				log.Println(i.Member.User.Username + " role list: ")
-				for _, role := range i.Member.Roles {
-					log.Printf("   Role: %s\n", role)
-				}
-				for _, role := range i.Member.Roles {
-					if role == authRoleID {
-						log.Println("User is already authenticated")
-						s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-							Content: utils.StrPtr(""),
-							Embeds: utils.NewEmbeds(
-								utils.NewEmbed(
-									"Authentication",
-									"You've already been verified.",
-									0xff4400,
-									nil,
-								),
+				switch result.Decision {
+				case policy.Reject:
+					log.Println(netid, "is already bound to another Discord account")
+					utils.NotifyStaff(s, i.GuildID, "NetID Conflict",
+						fmt.Sprintf("<@%s> tried to verify as `%s`, which is already linked to <@%s>. The request was refused.",
+							i.Member.User.ID, netid, result.Existing.UserId))
+					s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+						Content: utils.StrPtr(""),
+						Embeds: utils.NewEmbeds(
+							utils.NewEmbed(
+								"Authentication",
+								"This NetID is already linked to another Discord account in this server.\nPlease contact course staff if this is a mistake.",
+								0xff4400,
+								nil,
 							),
-						})
-						return
-					}
+						),
+					})
+					return
+				case policy.Flag:
+					utils.NotifyStaff(s, i.GuildID, "NetID Conflict",
+						fmt.Sprintf("<@%s> is verifying as `%s`, which is already linked to <@%s>.",
+							i.Member.User.ID, netid, result.Existing.UserId))
+				case policy.Transfer:
+					bindingNote = "\nThis NetID is linked to another Discord account, verifying will move it to this one."
 				}
 			}
 
 			// send authentication email
-			preAuthUser := auth.NewPreAuthUser(i.Member.User.ID, i.GuildID, netid)
-			authService := auth.NewAuthService()
+			preAuthUser := auth.NewPreAuthUser(i.Member.User.ID, i.GuildID, netid, courseId)
 
 			log.Println("Generating authentication URL for NetID:", netid)
-			authUrl := auth.RequestAuthUrl(preAuthUser)
-
-			log.Println("Sending authentication email to NetID:", netid)
-			err := authService.SendAuthEmail(netid, preAuthUser, authUrl)
+			authUrl, err := auth.RequestAuthUrl(preAuthUser)
 			if err != nil {
-				log.Println("Something went wrong while sending the aunthentication email to NetID:", netid)
+				log.Println("Something went wrong while generating the authentication URL for NetID:", netid)
 				log.Print(err)
 
 				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
@@ -171,36 +295,45 @@ var (
 					Embeds: utils.NewEmbeds(
 						utils.NewEmbed(
 							"Authentication",
-							"Something went wrong while sending the aunthentication email to NetID: "+netid,
+							"Could not create your verification link: "+err.Error(),
 							0xff4400,
 							nil,
 						),
 					),
 				})
+				return
 			}
 
+			// show the queued state first, so a fast delivery's update can't be overwritten by it
+			log.Println("Queueing authentication email to NetID:", netid)
 			s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
 				Content: utils.StrPtr(""),
 				Embeds: utils.NewEmbeds(
 					utils.NewEmbed(
 						"Authentication",
-						"An email has been sent to your NetID with a link to authenticate.",
+						fmt.Sprintf("Sending a verification link to `%s@vols.utk.edu`, this message will update once it's sent.", netid)+bindingNote,
 						0xff4400,
-						[]*discordgo.MessageEmbedField{
-							{
-								Name:   "Outlook",
-								Value:  "**Note**: If you're using Outlook, the email is likely in your **quarantine** folder",
-								Inline: false,
-							},
-							{
-								Name:   "Gmail",
-								Value:  "**Note**: If you're using Gmail, the email is likely in your **spam** folder",
-								Inline: false,
-							},
-						},
+						nil,
 					),
 				),
 			})
+			_, err = authService.QueueAuthEmail(preAuthUser, authUrl, auth.OverridesFor(courses), i.Interaction, bindingNote)
+			if err != nil {
+				log.Println("Something went wrong while queueing the authentication email to NetID:", netid)
+				log.Print(err)
+
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: utils.StrPtr(""),
+					Embeds: utils.NewEmbeds(
+						utils.NewEmbed(
+							"Authentication",
+							"Something went wrong while sending the authentication email to NetID: "+netid,
+							0xff4400,
+							nil,
+						),
+					),
+				})
+			}
 		},
 
 		// register course command
@@ -209,50 +342,77 @@ var (
 			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
 				Data: &discordgo.InteractionResponseData{
-					Content: "Attempting to register course...",
+					Content: "Checking the course...",
 					Flags:   discordgo.MessageFlagsEphemeral,
 				},
 			})
 
 			// interaction message strings for editing after server response(s)
 			var (
-				successString = "Course registered successfully!"
-				failString    = "Failed to register course, something went wrong."
-				existsString  = "Course already registered for this server."
+				failString   = "Failed to register course, something went wrong."
+				existsString = "Course already registered for this server."
+				roleString   = "The bot can't give out that auth role. Check the role ID, and that the bot's role is above it."
 			)
 
 			var (
-				guildId      = i.GuildID
-				canvasSecret = i.ApplicationCommandData().Options[0].StringValue()
-				courseId     = i.ApplicationCommandData().Options[1].StringValue()
-				authRoleId   = i.ApplicationCommandData().Options[2].StringValue()
+				guildId        = i.GuildID
+				canvasSecret   string
+				courseId       string
+				authRoleId     string
+				staffChannelId string
 			)
+			for _, option := range i.ApplicationCommandData().Options {
+				switch option.Name {
+				case "canvas_secret":
+					canvasSecret = option.StringValue()
+				case "course_id":
+					courseId = os.Getenv("UTK_CANVAS_COURSE_ID_PREFIX") + option.StringValue()
+				case "auth_role_id":
+					authRoleId = option.StringValue()
+				case "staff_channel":
+					staffChannelId = option.ChannelValue(nil).ID
+				}
+			}
 
-			// memberRoles := i.Member.Roles
-			// isAdmin := false
-			// for _, role := range memberRoles {
-			// 	if role == "admin" {
-			// 		isAdmin = true
-			// 	}
-			// }
-
-			// if !isAdmin {
-			// 	log.Println("User does not have permission to register a course for this server")
-			// 	return
-			// }
-
-			if exists, err := utils.GuildIdExists(guildId); err != nil {
+			if exists, err := utils.CourseExists(guildId, courseId); err != nil {
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: &failString,
+				})
 				return
 			} else if exists {
 				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
 					Content: &existsString,
 				})
-				log.Println("Course already registered for this server")
+				log.Println("Course", courseId, "already registered for this server")
+				return
+			}
+
+			if err := utils.ValidateRole(s, guildId, authRoleId); err != nil {
+				log.Println("Invalid auth role while registering course:", err)
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: &roleString,
+				})
 				return
 			}
 
-			{
-				err := utils.RegisterCourse(guildId, canvasSecret, os.Getenv("UTK_CANVAS_COURSE_ID_PREFIX")+courseId, authRoleId)
+			// without a pasted secret, staff connect Canvas through OAuth and the
+			// authserver's callback shows the preview
+			if canvasSecret == "" {
+				oauthConfig := canvasoauth.ConfigFromEnv()
+				if oauthConfig == nil {
+					s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+						Content: utils.StrPtr("Canvas OAuth isn't set up for this bot, give a `canvas_secret` instead."),
+					})
+					return
+				}
+				state, err := utils.HoldConnectRequest(store.ConnectRequest{
+					GuildId:          guildId,
+					CourseId:         courseId,
+					AuthRoleId:       authRoleId,
+					StaffChannelId:   staffChannelId,
+					ApplicationId:    i.AppID,
+					InteractionToken: i.Token,
+				})
 				if err != nil {
 					s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
 						Content: &failString,
@@ -260,28 +420,1030 @@ var (
 					log.Println(err)
 					return
 				}
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: utils.StrPtr(""),
+					Embeds: utils.NewEmbeds(utils.NewEmbed(
+						"Connect Canvas",
+						"Sign in to Canvas as a teacher or TA of the course and approve the bot. The course preview will show up here afterwards.",
+						0xff4400,
+						nil,
+					)),
+					Components: &[]discordgo.MessageComponent{
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.Button{
+									Label: "Connect Canvas",
+									Style: discordgo.LinkButton,
+									URL:   oauthConfig.AuthURL(state),
+								},
+							},
+						},
+					},
+				})
+				return
+			}
+
+			// check the course against Canvas and let staff look before saving it
+			preview, err := utils.PreviewCourse(guildId, canvasSecret, courseId, authRoleId, staffChannelId)
+			if err != nil {
+				log.Println("Error previewing course:", err)
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: utils.StrPtr(utils.DescribePreviewError(err)),
+				})
+				return
+			}
+			previewId, err := utils.HoldPreview(preview)
+			if err != nil {
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: &failString,
+				})
+				log.Println(err)
+				return
+			}
+			s.InteractionResponseEdit(i.Interaction, utils.PreviewEdit(preview, previewId))
+		},
+
+		// change a registered course's settings
+		utils.UpdateCourseName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			// a new Canvas secret or course ID means fetching the roster, which can be slow
+			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Flags: discordgo.MessageFlagsEphemeral,
+				},
+			})
+
+			editEmbed := func(description string, fields []*discordgo.MessageEmbedField) {
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Embeds: utils.NewEmbeds(utils.NewEmbed("Update Course", description, 0xff4400, fields)),
+				})
+			}
+
+			var courseId string
+			var update utils.CourseUpdate
+			for _, option := range i.ApplicationCommandData().Options {
+				switch option.Name {
+				case "course":
+					courseId = option.StringValue()
+				case "canvas_secret":
+					update.CanvasSecret = option.StringValue()
+				case "course_id":
+					update.CourseId = os.Getenv("UTK_CANVAS_COURSE_ID_PREFIX") + option.StringValue()
+				case "auth_role":
+					update.AuthRoleId = option.RoleValue(nil, "").ID
+				case "staff_channel":
+					update.StaffChannelId = option.ChannelValue(nil).ID
+				}
+			}
+			if update == (utils.CourseUpdate{}) {
+				editEmbed("Give at least one field to change.", nil)
+				return
 			}
 
-			s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-				Content: &successString,
+			course, err := utils.UpdateCourse(s, i.GuildID, courseId, update)
+			switch {
+			case errors.Is(err, store.ErrCourseNotFound):
+				editEmbed(fmt.Sprintf("%s is not registered for this server.", courseId), nil)
+				return
+			case errors.Is(err, store.ErrCourseExists):
+				editEmbed(fmt.Sprintf("%s is already registered for this server.", update.CourseId), nil)
+				return
+			case utils.DescribeCanvasError(err) != "":
+				editEmbed(utils.DescribeCanvasError(err)+" Nothing was changed.", nil)
+				return
+			case errors.Is(err, utils.ErrNotCourseStaff):
+				editEmbed("The Canvas account doesn't belong to a teacher or TA of that course, nothing was changed.", nil)
+				return
+			case errors.Is(err, utils.ErrCanvasRejected):
+				editEmbed("Canvas rejected the secret or course ID, nothing was changed.", nil)
+				return
+			case errors.Is(err, utils.ErrEmptyCanvasCourse):
+				editEmbed("Canvas returned no enrollments for that course, nothing was changed.", nil)
+				return
+			case errors.Is(err, utils.ErrRoleNotFound):
+				editEmbed("That role doesn't exist in this server, nothing was changed.", nil)
+				return
+			case errors.Is(err, utils.ErrRoleNotAssignable):
+				editEmbed("The bot can't give out that role. Move the bot's role above it, or pick a role that isn't managed by an integration.", nil)
+				return
+			case err != nil:
+				log.Println("Error updating course:", err)
+				editEmbed("Something went wrong while updating the course, nothing was changed.", nil)
+				return
+			}
+
+			var fields []*discordgo.MessageEmbedField
+			if update.CanvasSecret != "" {
+				fields = append(fields, &discordgo.MessageEmbedField{Name: "Canvas secret", Value: "Updated", Inline: true})
+			}
+			if update.CourseId != "" {
+				fields = append(fields, &discordgo.MessageEmbedField{Name: "Course ID", Value: course.CourseId, Inline: true})
+			}
+			if update.AuthRoleId != "" {
+				fields = append(fields, &discordgo.MessageEmbedField{Name: "Auth role", Value: fmt.Sprintf("<@&%s>", course.AuthRoleId), Inline: true})
+			}
+			if update.StaffChannelId != "" {
+				fields = append(fields, &discordgo.MessageEmbedField{Name: "Staff channel", Value: fmt.Sprintf("<#%s>", course.StaffChannelId), Inline: true})
+			}
+			if update.CanvasSecret != "" || update.CourseId != "" {
+				fields = append(fields, &discordgo.MessageEmbedField{Name: "Roster", Value: fmt.Sprintf("%d enrollments", len(course.Students)), Inline: true})
+			}
+			editEmbed(fmt.Sprintf("Updated %s.", course.CourseId), fields)
+		},
+
+		// remove a course, once staff confirm it
+		utils.UnregisterCourseName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			courseId := optionString(i.ApplicationCommandData().Options, "course")
+			respond := func(description string, components []discordgo.MessageComponent) {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Embeds:     []*discordgo.MessageEmbed{utils.NewEmbed("Unregister Course", description, 0xff4400, nil)},
+						Components: components,
+						Flags:      discordgo.MessageFlagsEphemeral,
+					},
+				})
+			}
+
+			course, err := utils.GetCourseObject(i.GuildID, courseId)
+			if err != nil {
+				respond("Something went wrong while looking up the course.", nil)
+				return
+			}
+			if course == nil {
+				respond(fmt.Sprintf("%s is not registered for this server.", courseId), nil)
+				return
+			}
+
+			respond(
+				fmt.Sprintf("Unregister %s? Its roster of %d enrollments and its verification records will be deleted. "+
+					"Members keep the roles they already have.", courseId, len(course.Students)),
+				[]discordgo.MessageComponent{
+					discordgo.ActionsRow{
+						Components: []discordgo.MessageComponent{
+							discordgo.Button{
+								Label:    "Unregister",
+								Style:    discordgo.DangerButton,
+								CustomID: unregisterConfirmId + ":" + courseId,
+							},
+							discordgo.Button{
+								Label:    "Cancel",
+								Style:    discordgo.SecondaryButton,
+								CustomID: unregisterCancelId,
+							},
+						},
+					},
+				},
+			)
+		},
+
+		// refresh a course's roster from Canvas
+		utils.ResyncName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			// fetching the roster can take longer than discord waits for a response
+			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Flags: discordgo.MessageFlagsEphemeral,
+				},
+			})
+
+			editEmbed := func(description string, fields []*discordgo.MessageEmbedField, files []*discordgo.File) {
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Embeds: utils.NewEmbeds(utils.NewEmbed("Roster Sync", description, 0xff4400, fields)),
+					Files:  files,
+				})
+			}
+
+			courseId := optionString(i.ApplicationCommandData().Options, "course")
+			course, err := utils.GetCourseObject(i.GuildID, courseId)
+			if err != nil {
+				editEmbed("Something went wrong while looking up the course.", nil, nil)
+				return
+			}
+			if course == nil {
+				editEmbed(fmt.Sprintf("%s is not registered for this server.", courseId), nil, nil)
+				return
+			}
+
+			diff, err := roster.SyncCourse(*course)
+			if errors.Is(err, roster.ErrEmptyRoster) {
+				editEmbed("Canvas returned no enrollments, so the stored roster was kept. Try again later.", nil, nil)
+				return
+			} else if description := utils.DescribeCanvasError(err); description != "" {
+				log.Println("Error resyncing roster:", err)
+				editEmbed("Could not fetch the roster from Canvas. "+description, nil, nil)
+				return
+			} else if err != nil {
+				log.Println("Error resyncing roster:", err)
+				editEmbed("Could not fetch the roster from Canvas. Check that the course's Canvas token is still valid.", nil, nil)
+				return
+			}
+
+			fields := []*discordgo.MessageEmbedField{
+				{Name: "Added", Value: fmt.Sprint(len(diff.Added)), Inline: true},
+				{Name: "Removed", Value: fmt.Sprint(len(diff.Removed)), Inline: true},
+				{Name: "Unchanged", Value: fmt.Sprint(diff.Unchanged), Inline: true},
+			}
+			if len(diff.Skipped) > 0 {
+				fields = append(fields, utils.SkippedField(diff.Skipped))
+			}
+			var files []*discordgo.File
+			if len(diff.Added)+len(diff.Removed) > 0 {
+				changes, err := diff.CSV()
+				if err != nil {
+					log.Println("Error writing roster changes CSV:", err)
+				} else {
+					files = append(files, &discordgo.File{
+						Name:        courseId + "-changes.csv",
+						ContentType: "text/csv",
+						Reader:      bytes.NewReader(changes),
+					})
+				}
+			}
+			editEmbed(fmt.Sprintf("Refreshed the roster of %s from Canvas.", courseId), fields, files)
+		},
+
+		// look up verification records
+		utils.WhoisName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			// course staff only see the records of their own courses
+			visible := func(members []store.VerifiedMember) []store.VerifiedMember {
+				if utils.IsManager(i.Member) {
+					return members
+				}
+				staffCourseIds := utils.StaffCourseIds(i.GuildID, i.Member)
+				var found []store.VerifiedMember
+				for _, member := range members {
+					if staffCourseIds[member.CourseId] {
+						found = append(found, member)
+					}
+				}
+				return found
+			}
+
+			var fields []*discordgo.MessageEmbedField
+			for _, option := range i.ApplicationCommandData().Options {
+				switch option.Name {
+				case "netid":
+					netId := option.StringValue()
+					members, err := utils.GetVerifiedMembers(i.GuildID, netId)
+					members = visible(members)
+					if err != nil {
+						fields = append(fields, &discordgo.MessageEmbedField{Name: netId, Value: "Something went wrong while looking up this NetID."})
+					} else if len(members) == 0 {
+						fields = append(fields, &discordgo.MessageEmbedField{Name: netId, Value: "Not verified in this server."})
+					}
+					for _, member := range members {
+						fields = append(fields, &discordgo.MessageEmbedField{
+							Name:  netId,
+							Value: fmt.Sprintf("<@%s> verified for %s <t:%d:R>", member.UserId, member.CourseId, member.VerifiedAt.Unix()),
+						})
+					}
+				case "user":
+					user := option.UserValue(s)
+					members, err := utils.GetVerifiedMembersForUser(i.GuildID, user.ID)
+					members = visible(members)
+					if err != nil {
+						fields = append(fields, &discordgo.MessageEmbedField{Name: user.Username, Value: "Something went wrong while looking up this user."})
+					} else if len(members) == 0 {
+						fields = append(fields, &discordgo.MessageEmbedField{Name: user.Username, Value: "Not verified in this server."})
+					}
+					for _, member := range members {
+						fields = append(fields, &discordgo.MessageEmbedField{
+							Name:  user.Username,
+							Value: fmt.Sprintf("`%s` verified for %s <t:%d:R>", member.NetId, member.CourseId, member.VerifiedAt.Unix()),
+						})
+					}
+				}
+			}
+
+			description := ""
+			if len(fields) == 0 {
+				description = "Give a `netid` or a `user` to look up."
+			}
+			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Embeds: []*discordgo.MessageEmbed{utils.NewEmbed("Who Is", description, 0xff4400, fields)},
+					Flags:  discordgo.MessageFlagsEphemeral,
+				},
+			})
+		},
+
+		// map Canvas sections to roles
+		utils.SectionRoleName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			subcommand := i.ApplicationCommandData().Options[0]
+			var courseId, sectionId, roleId string
+			for _, option := range subcommand.Options {
+				switch option.Name {
+				case "course":
+					courseId = option.StringValue()
+				case "section":
+					sectionId = option.StringValue()
+				case "role":
+					roleId = option.RoleValue(nil, "").ID
+				}
+			}
+
+			respond := func(title string, description string, fields []*discordgo.MessageEmbedField) {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Embeds: []*discordgo.MessageEmbed{utils.NewEmbed(title, description, 0xff4400, fields)},
+						Flags:  discordgo.MessageFlagsEphemeral,
+					},
+				})
+			}
+
+			course, err := utils.GetCourseObject(i.GuildID, courseId)
+			if err != nil {
+				respond("Section Roles", "Something went wrong while looking up the course.", nil)
+				return
+			}
+			if course == nil {
+				respond("Section Roles", fmt.Sprintf("%s is not registered for this server.", courseId), nil)
+				return
+			}
+
+			switch subcommand.Name {
+			case "set", "clear":
+				err := utils.SetSectionRole(i.GuildID, courseId, sectionId, roleId)
+				if err != nil {
+					respond("Section Roles", "Something went wrong while saving the section role.", nil)
+					return
+				}
+				if roleId == "" {
+					respond("Section Roles", fmt.Sprintf("Section `%s` of %s no longer gives a role.", sectionId, courseId), nil)
+				} else {
+					respond("Section Roles", fmt.Sprintf("Students in section `%s` of %s now get <@&%s> when they verify.", sectionId, courseId, roleId), nil)
+				}
+			case "list":
+				var fields []*discordgo.MessageEmbedField
+				for _, section := range course.Sections() {
+					value := "No role"
+					if roleId, ok := course.SectionRoles[section.Id]; ok {
+						value = fmt.Sprintf("<@&%s>", roleId)
+					}
+					fields = append(fields, &discordgo.MessageEmbedField{
+						Name:  fmt.Sprintf("%s (%s)", section.Name, section.Id),
+						Value: value,
+					})
+				}
+				description := ""
+				if len(fields) == 0 {
+					description = "The course roster has no sections."
+				}
+				// discord allows at most 25 fields per embed
+				if len(fields) > 25 {
+					fields = fields[:25]
+				}
+				respond("Section Roles for "+courseId, description, fields)
+			}
+		},
+
+		// let roles use the admin commands
+		utils.StaffRoleName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			subcommand := i.ApplicationCommandData().Options[0]
+			var courseId, roleId string
+			for _, option := range subcommand.Options {
+				switch option.Name {
+				case "course":
+					courseId = option.StringValue()
+				case "role":
+					roleId = option.RoleValue(nil, "").ID
+				}
+			}
+
+			respond := func(description string) {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Embeds: []*discordgo.MessageEmbed{utils.NewEmbed("Staff Roles", description, 0xff4400, nil)},
+						Flags:  discordgo.MessageFlagsEphemeral,
+					},
+				})
+			}
+
+			var err error
+			switch subcommand.Name {
+			case "add":
+				err = utils.SetStaffRole(i.GuildID, courseId, roleId, true)
+			case "remove":
+				err = utils.SetStaffRole(i.GuildID, courseId, roleId, false)
+			}
+			if errors.Is(err, store.ErrCourseNotFound) {
+				respond(fmt.Sprintf("%s is not registered for this server.", courseId))
+				return
+			} else if err != nil {
+				respond("Something went wrong while saving the staff roles.")
+				return
+			}
+
+			course, err := utils.GetCourseObject(i.GuildID, courseId)
+			if err != nil || course == nil {
+				respond(fmt.Sprintf("%s is not registered for this server.", courseId))
+				return
+			}
+			var mentions []string
+			for _, staffRoleId := range course.StaffRoleIds {
+				mentions = append(mentions, fmt.Sprintf("<@&%s>", staffRoleId))
+			}
+			if len(mentions) == 0 {
+				respond(fmt.Sprintf("%s has no staff roles, only members with Manage Server can use its admin commands.", courseId))
+				return
+			}
+			respond(fmt.Sprintf("Members with %s can use the admin commands for %s. "+
+				"Discord still hides the commands from them until they are allowed under Server Settings > Integrations.",
+				strings.Join(mentions, ", "), courseId))
+		},
+
+		// change or show a course's verification email overrides
+		utils.EmailSettingsName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			var courseId string
+			var settings utils.EmailSettings
+			reset := false
+			for _, option := range i.ApplicationCommandData().Options {
+				switch option.Name {
+				case "course":
+					courseId = option.StringValue()
+				case "subject":
+					settings.Subject = utils.StrPtr(option.StringValue())
+				case "course_name":
+					settings.CourseName = utils.StrPtr(option.StringValue())
+				case "signature":
+					settings.Signature = utils.StrPtr(option.StringValue())
+				case "reset":
+					reset = option.BoolValue()
+				}
+			}
+
+			respond := func(description string, fields []*discordgo.MessageEmbedField) {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Embeds: []*discordgo.MessageEmbed{utils.NewEmbed("Email Settings", description, 0xff4400, fields)},
+						Flags:  discordgo.MessageFlagsEphemeral,
+					},
+				})
+			}
+
+			description := fmt.Sprintf("The verification email for %s uses these settings.", courseId)
+			if reset || settings != (utils.EmailSettings{}) {
+				err := utils.SetEmailSettings(i.GuildID, courseId, settings, reset)
+				if errors.Is(err, store.ErrCourseNotFound) {
+					respond(fmt.Sprintf("%s is not registered for this server.", courseId), nil)
+					return
+				} else if err != nil {
+					respond("Something went wrong while saving the email settings.", nil)
+					return
+				}
+				description = fmt.Sprintf("Saved the verification email settings of %s.", courseId)
+			}
+
+			course, err := utils.GetCourseObject(i.GuildID, courseId)
+			if err != nil {
+				respond("Something went wrong while looking up the course.", nil)
+				return
+			}
+			if course == nil {
+				respond(fmt.Sprintf("%s is not registered for this server.", courseId), nil)
+				return
+			}
+			orDefault := func(value string) string {
+				if value == "" {
+					return "Default"
+				}
+				return value
+			}
+			respond(description, []*discordgo.MessageEmbedField{
+				{Name: "Subject", Value: orDefault(course.EmailSubject)},
+				{Name: "Course name", Value: orDefault(course.EmailCourseName)},
+				{Name: "Signature", Value: orDefault(course.EmailSignature)},
 			})
+		},
+
+		// choose what happens to members who drop the course
+		utils.DropPolicyName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			var courseId, dropPolicy, alumniRoleId string
+			dryRun := false
+			for _, option := range i.ApplicationCommandData().Options {
+				switch option.Name {
+				case "course":
+					courseId = option.StringValue()
+				case "policy":
+					dropPolicy = option.StringValue()
+				case "alumni_role":
+					alumniRoleId = option.RoleValue(nil, "").ID
+				case "dry_run":
+					dryRun = option.BoolValue()
+				}
+			}
+
+			respond := func(description string) {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Embeds: []*discordgo.MessageEmbed{utils.NewEmbed("Drop Policy", description, 0xff4400, nil)},
+						Flags:  discordgo.MessageFlagsEphemeral,
+					},
+				})
+			}
 
+			if dropPolicy == canvas.DropAlumni && alumniRoleId == "" {
+				respond("The alumni policy needs an `alumni_role`.")
+				return
+			}
+
+			err := utils.SetDropPolicy(i.GuildID, courseId, dropPolicy, alumniRoleId, dryRun)
+			if errors.Is(err, store.ErrCourseNotFound) {
+				respond(fmt.Sprintf("%s is not registered for this server.", courseId))
+				return
+			} else if err != nil {
+				respond("Something went wrong while saving the drop policy.")
+				return
+			}
+
+			var description string
+			switch dropPolicy {
+			case canvas.DropRemove:
+				description = fmt.Sprintf("Members who drop %s will lose its roles.", courseId)
+			case canvas.DropAlumni:
+				description = fmt.Sprintf("Members who drop %s will be moved to <@&%s>.", courseId, alumniRoleId)
+			default:
+				description = fmt.Sprintf("Members who drop %s will be reported to staff.", courseId)
+			}
+			if dryRun && dropPolicy != canvas.DropReport {
+				description += " Dry run is on, so the changes will only be posted to the staff channel."
+			}
+			respond(description)
+		},
+
+		// map Canvas enrollment types to roles
+		utils.EnrollmentRoleName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			subcommand := i.ApplicationCommandData().Options[0]
+			var courseId, enrollmentType, roleId string
+			for _, option := range subcommand.Options {
+				switch option.Name {
+				case "course":
+					courseId = option.StringValue()
+				case "type":
+					enrollmentType = option.StringValue()
+				case "role":
+					roleId = option.RoleValue(nil, "").ID
+				}
+			}
+
+			respond := func(title string, description string, fields []*discordgo.MessageEmbedField) {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Embeds: []*discordgo.MessageEmbed{utils.NewEmbed(title, description, 0xff4400, fields)},
+						Flags:  discordgo.MessageFlagsEphemeral,
+					},
+				})
+			}
+
+			course, err := utils.GetCourseObject(i.GuildID, courseId)
+			if err != nil {
+				respond("Enrollment Roles", "Something went wrong while looking up the course.", nil)
+				return
+			}
+			if course == nil {
+				respond("Enrollment Roles", fmt.Sprintf("%s is not registered for this server.", courseId), nil)
+				return
+			}
+
+			switch subcommand.Name {
+			case "set", "clear":
+				err := utils.SetEnrollmentRole(i.GuildID, courseId, enrollmentType, roleId)
+				if err != nil {
+					respond("Enrollment Roles", "Something went wrong while saving the enrollment role.", nil)
+					return
+				}
+				if roleId == "" && course.DefaultRoleId(enrollmentType) == "" {
+					respond("Enrollment Roles", fmt.Sprintf("%s members of %s now get no role and can't verify.", enrollmentType, courseId), nil)
+				} else if roleId == "" {
+					respond("Enrollment Roles", fmt.Sprintf("%s members of %s now get the course's auth role <@&%s>.", enrollmentType, courseId, course.AuthRoleId), nil)
+				} else {
+					respond("Enrollment Roles", fmt.Sprintf("%s members of %s now get <@&%s> instead of the auth role when they verify.", enrollmentType, courseId, roleId), nil)
+				}
+			case "list":
+				var fields []*discordgo.MessageEmbedField
+				for _, enrollmentType := range []string{canvas.StudentEnrollment, canvas.TaEnrollment, canvas.TeacherEnrollment, canvas.DesignerEnrollment, canvas.ObserverEnrollment} {
+					value := "No role, can't verify"
+					if roleId := course.EnrollmentRoleId(enrollmentType); roleId != "" {
+						value = fmt.Sprintf("<@&%s>", roleId)
+					}
+					fields = append(fields, &discordgo.MessageEmbedField{
+						Name:  enrollmentType,
+						Value: value,
+					})
+				}
+				respond("Enrollment Roles for "+courseId, "", fields)
+			}
 		},
 	}
 )
 
+// custom IDs of the /unregistercourse buttons, the confirm button carries the course ID after a colon
+const (
+	unregisterConfirmId = "unregistercourse_confirm"
+	unregisterCancelId  = "unregistercourse_cancel"
+)
+
+// define message component handlers, keyed by custom ID up to the first colon
+var componentHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+	utils.RegisterConfirmId: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		_, previewId, _ := strings.Cut(i.MessageComponentData().CustomID, ":")
+		preview := utils.TakePreview(previewId)
+		if preview == nil || preview.Course.GuildId != i.GuildID {
+			updateComponentMessage(s, i, "Register Course", "This preview has expired. Run /registercourse again.")
+			return
+		}
+
+		description := fmt.Sprintf("Registered %s (%s) with %d students.", preview.Info.Name, preview.Course.CourseId, preview.StudentCount)
+		err := utils.RegisterCourse(preview.Course)
+		if errors.Is(err, store.ErrCourseExists) {
+			description = "Course already registered for this server."
+		} else if err != nil {
+			description = "Failed to register course, something went wrong."
+		}
+		updateComponentMessage(s, i, "Register Course", description)
+	},
+
+	utils.RegisterCancelId: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		_, previewId, _ := strings.Cut(i.MessageComponentData().CustomID, ":")
+		utils.TakePreview(previewId)
+		updateComponentMessage(s, i, "Register Course", "Cancelled, nothing was registered.")
+	},
+
+	unregisterConfirmId: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		_, courseId, _ := strings.Cut(i.MessageComponentData().CustomID, ":")
+
+		description := fmt.Sprintf("Unregistered %s.", courseId)
+		err := utils.UnregisterCourse(i.GuildID, courseId)
+		if errors.Is(err, store.ErrCourseNotFound) {
+			description = fmt.Sprintf("%s is not registered for this server.", courseId)
+		} else if err != nil {
+			description = fmt.Sprintf("Something went wrong while unregistering %s.", courseId)
+		}
+		updateComponentMessage(s, i, "Unregister Course", description)
+	},
+
+	unregisterCancelId: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		updateComponentMessage(s, i, "Unregister Course", "Cancelled, the course is still registered.")
+	},
+}
+
+// updateComponentMessage replaces the message a button was on, dropping its buttons
+func updateComponentMessage(s *discordgo.Session, i *discordgo.InteractionCreate, title string, description string) {
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Embeds:     []*discordgo.MessageEmbed{utils.NewEmbed(title, description, 0xff4400, nil)},
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+}
+
+// define autocomplete handlers, keyed by the command whose options they complete
+var autocompleteHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+	// suggest the courses registered for the server
+	auth.Name:                  completeCourseOption,
+	utils.ResyncName:           completeCourseOption,
+	utils.DropPolicyName:       completeCourseOption,
+	utils.UpdateCourseName:     completeCourseOption,
+	utils.UnregisterCourseName: completeCourseOption,
+	utils.StaffRoleName:        completeSubcommandCourseOption,
+	utils.EmailSettingsName:    completeCourseOption,
+
+	utils.EnrollmentRoleName: completeSubcommandCourseOption,
+
+	// suggest registered courses, then the chosen course's sections
+	utils.SectionRoleName: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		var courseId string
+		var focused *discordgo.ApplicationCommandInteractionDataOption
+		for _, option := range i.ApplicationCommandData().Options[0].Options {
+			if option.Name == "course" {
+				courseId = option.StringValue()
+			}
+			if option.Focused {
+				focused = option
+			}
+		}
+		if focused == nil {
+			return
+		}
+		typed := strings.ToLower(focused.StringValue())
+
+		if focused.Name == "course" {
+			respondChoices(s, i, courseChoices(i.GuildID, typed))
+			return
+		}
+
+		choices := []*discordgo.ApplicationCommandOptionChoice{}
+		course, err := utils.GetCourseObject(i.GuildID, courseId)
+		if err == nil && course != nil {
+			for _, section := range course.Sections() {
+				if len(choices) == 25 {
+					break
+				}
+				if strings.Contains(strings.ToLower(section.Name), typed) || strings.Contains(section.Id, typed) {
+					choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+						Name:  section.Name,
+						Value: section.Id,
+					})
+				}
+			}
+		}
+		respondChoices(s, i, choices)
+	},
+}
+
+// completeCourseOption suggests courses for a command with a top level course option
+func completeCourseOption(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "course" && option.Focused {
+			respondChoices(s, i, courseChoices(i.GuildID, strings.ToLower(option.StringValue())))
+		}
+	}
+}
+
+// completeSubcommandCourseOption suggests courses for a command whose subcommands have a course option
+func completeSubcommandCourseOption(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	for _, option := range i.ApplicationCommandData().Options[0].Options {
+		if option.Name == "course" && option.Focused {
+			respondChoices(s, i, courseChoices(i.GuildID, strings.ToLower(option.StringValue())))
+		}
+	}
+}
+
+// courseChoices returns the guild's courses whose ID contains typed
+func courseChoices(guildId string, typed string) []*discordgo.ApplicationCommandOptionChoice {
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	courses, err := utils.GetGuildCourses(guildId)
+	if err != nil {
+		return choices
+	}
+	for _, course := range courses {
+		// discord shows at most 25 choices
+		if len(choices) == 25 {
+			break
+		}
+		if strings.Contains(strings.ToLower(course.CourseId), typed) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+				Name:  course.CourseId,
+				Value: course.CourseId,
+			})
+		}
+	}
+	return choices
+}
+
+func respondChoices(s *discordgo.Session, i *discordgo.InteractionCreate, choices []*discordgo.ApplicationCommandOptionChoice) {
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+}
+
+// adminCommands holds the names of the commands created with DefaultMemberPermissions,
+// discord enforces those by default but server settings can override them
+var adminCommands = make(map[string]bool)
+
+// managerCommands change who runs the server's courses or which Canvas course
+// and secret they use, so a course's staff roles don't unlock them and they
+// need Manage Server
+var managerCommands = map[string]bool{
+	utils.StaffRoleName:        true,
+	utils.RegisterCourseName:   true,
+	utils.UnregisterCourseName: true,
+	utils.UpdateCourseName:     true,
+}
+
+func init() {
+	for _, command := range commands {
+		if command.DefaultMemberPermissions != nil {
+			adminCommands[command.Name] = true
+		}
+	}
+}
+
+// optionString returns the value of the option called name, or "" if it wasn't given
+func optionString(options []*discordgo.ApplicationCommandInteractionDataOption, name string) string {
+	for _, option := range options {
+		if option.Name == name {
+			return option.StringValue()
+		}
+	}
+	return ""
+}
+
+// commandCourseId returns the course option of a command, looking inside its
+// subcommand if it has one
+func commandCourseId(options []*discordgo.ApplicationCommandInteractionDataOption) string {
+	for _, option := range options {
+		switch {
+		case option.Type == discordgo.ApplicationCommandOptionSubCommand:
+			return commandCourseId(option.Options)
+		case option.Name == "course":
+			return option.StringValue()
+		}
+	}
+	return ""
+}
+
+// allowAdminCommand reports whether a member may run an admin command. Staff
+// roles only count for the course the command targets, commands without a
+// course need staff of at least one course.
+func allowAdminCommand(i *discordgo.InteractionCreate) bool {
+	if utils.IsManager(i.Member) {
+		return true
+	}
+	data := i.ApplicationCommandData()
+	if managerCommands[data.Name] {
+		return false
+	}
+	if courseId := commandCourseId(data.Options); courseId != "" {
+		return utils.IsStaff(i.GuildID, courseId, i.Member)
+	}
+	return len(utils.StaffCourseIds(i.GuildID, i.Member)) > 0
+}
+
+// denyInteraction tells a member they aren't allowed to use a command
+func denyInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	log.Println("Denied an admin interaction in guildId:", i.GuildID)
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
+
 // initialize bot handlers
 func init() {
 	session.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
-			h(s, i)
+		switch i.Type {
+		case discordgo.InteractionApplicationCommand:
+			name := i.ApplicationCommandData().Name
+			if adminCommands[name] && !allowAdminCommand(i) {
+				if managerCommands[name] {
+					denyInteraction(s, i, "You need Manage Server to use this command.")
+				} else {
+					denyInteraction(s, i, "You need Manage Server or a staff role of the course to use this command.")
+				}
+				return
+			}
+			if h, ok := commandHandlers[name]; ok {
+				h(s, i)
+			}
+		case discordgo.InteractionApplicationCommandAutocomplete:
+			if h, ok := autocompleteHandlers[i.ApplicationCommandData().Name]; ok {
+				h(s, i)
+			}
+		case discordgo.InteractionMessageComponent:
+			prefix, _, _ := strings.Cut(i.MessageComponentData().CustomID, ":")
+			// every button so far belongs to registering or unregistering a course
+			if !utils.IsManager(i.Member) {
+				denyInteraction(s, i, "You need Manage Server to use this command.")
+				return
+			}
+			if h, ok := componentHandlers[prefix]; ok {
+				h(s, i)
+			}
 		}
 	})
 }
 
+// interactionEditWindow is how long Discord lets a bot edit its response to an interaction
+const interactionEditWindow = 15 * time.Minute
+
+// reportEmailStatus updates a member's /auth response after every attempt at
+// sending their verification email, and tells staff about emails given up on
+func reportEmailStatus(email store.OutboxEmail) {
+	var embed *discordgo.MessageEmbed
+	switch email.Status {
+	case store.EmailSent:
+		embed = utils.NewEmbed(
+			"Authentication",
+			"An email has been sent to your NetID with a link to authenticate."+email.Note,
+			0xff4400,
+			[]*discordgo.MessageEmbedField{
+				{
+					Name:   "Outlook",
+					Value:  "**Note**: If you're using Outlook, the email is likely in your **quarantine** folder",
+					Inline: false,
+				},
+				{
+					Name:   "Gmail",
+					Value:  "**Note**: If you're using Gmail, the email is likely in your **spam** folder",
+					Inline: false,
+				},
+			},
+		)
+	case store.EmailPending:
+		embed = utils.NewEmbed(
+			"Authentication",
+			fmt.Sprintf("Your verification email couldn't be sent yet, still trying. The next attempt is <t:%d:R>.", email.NextAttemptAt.Unix())+email.Note,
+			0xff4400,
+			nil,
+		)
+	case store.EmailDead:
+		utils.NotifyStaff(session, email.GuildId, "Verification Email Failed",
+			fmt.Sprintf("The verification email to `%s` for <@%s> couldn't be sent after %d attempts: %s",
+				email.NetId, email.UserId, email.Attempts, email.LastError))
+		embed = utils.NewEmbed(
+			"Authentication",
+			"Your verification email couldn't be sent.\nPlease contact course staff.",
+			0xff4400,
+			nil,
+		)
+	default:
+		return
+	}
+
+	if email.InteractionToken == "" || time.Since(email.CreatedAt) > interactionEditWindow {
+		log.Println("Too late to report the", email.Status, "state of email", email.Id, "to user", email.UserId)
+		return
+	}
+	interaction := &discordgo.Interaction{AppID: email.ApplicationId, Token: email.InteractionToken}
+	_, err := session.InteractionResponseEdit(interaction, &discordgo.WebhookEdit{
+		Content: utils.StrPtr(""),
+		Embeds:  utils.NewEmbeds(embed),
+	})
+	if err != nil {
+		log.Println("Error reporting the state of email", email.Id, "to user", email.UserId, err)
+	}
+}
+
+// listDeadEmails prints the verification emails that were given up on
+func listDeadEmails() {
+	emails, err := dataStore.Emails(store.EmailDead)
+	if err != nil {
+		log.Fatal("Error reading the email outbox: ", err)
+	}
+	for _, email := range emails {
+		fmt.Printf("%s  %s  NetID %s  guild %s  user %s  %d attempts: %s\n", email.Id, email.CreatedAt.Format(time.RFC3339),
+			email.NetId, email.GuildId, email.UserId, email.Attempts, email.LastError)
+	}
+	fmt.Println(len(emails), "dead emails")
+}
+
+// requeueDeadEmails sends the dead letters with the given IDs again, run as
+// "utk-auth-go dead-emails requeue <id>...". The bot picks them up on its next
+// poll, though a link older than TOKEN_TTL will have expired by then.
+func requeueDeadEmails(ids []string) {
+	for _, id := range ids {
+		email, err := emailOutbox.Requeue(id)
+		if err == store.ErrEmailNotFound {
+			log.Println("No dead email", id)
+		} else if err != nil {
+			log.Fatal("Error requeueing email ", id, ": ", err)
+		} else {
+			fmt.Println("Requeued email", email.Id, "to NetID", email.NetId, "from", email.CreatedAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// rotateSecrets re-encrypts every course's Canvas secret with the newest key.
+// To rotate, put a new key (head -c 32 /dev/urandom | base64) in front of
+// SECRETS_KEYS, run "utk-auth-go rotate-secrets", then drop the old key.
+func rotateSecrets() {
+	encrypted, ok := dataStore.(*store.EncryptedStore)
+	if !ok {
+		log.Fatal("Set SECRETS_KEYS or SECRETS_KEY_FILE to rotate Canvas secrets")
+	}
+	changed, err := encrypted.Reencrypt(true)
+	if err != nil {
+		log.Fatal("Error re-encrypting Canvas secrets: ", err)
+	}
+	fmt.Println("Re-encrypted the Canvas secrets of", changed, "courses")
+}
+
 func main() {
+	// one-off maintenance commands run instead of the bot
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-secrets":
+			rotateSecrets()
+		case "dead-emails":
+			if len(os.Args) > 3 && os.Args[2] == "requeue" {
+				requeueDeadEmails(os.Args[3:])
+			} else {
+				listDeadEmails()
+			}
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		return
+	}
+
 	// Setup HTTP server
 	var err error
+	roster.Setup(session, dataStore)
 	err = session.Open()
 	if err != nil {
 		log.Fatal(err)
@@ -298,8 +1460,10 @@ func main() {
 	defer session.Close()
 
 	go func() {
-		authserver.StartServer(session)
+		authserver.StartServer(session, dataStore)
 	}()
+	roster.StartScheduler(roster.IntervalFromEnv())
+	emailOutbox.Start()
 	fmt.Println("Bot is now running. Press CTRL+C to exit.")
 
 	// Wait here until CTRL+C or other term signal is received.
@@ -2,15 +2,19 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"github.com/joho/godotenv"
 	"io"
 	"log"
 	"net/http"
-	"net/smtp"
+	"net/mail"
+	"net/url"
 	"os"
+	"time"
 	"utk-auth-go/src/pkg/authserver"
+	"utk-auth-go/src/pkg/store"
 )
 
 func init() {
@@ -32,7 +36,7 @@ var (
 		Description: "Authenticate with your NetID as a student",
 
 		Type: discordgo.ChatApplicationCommand,
-		// single argument for the user's NetID
+		// the user's NetID, and optionally which of the server's courses to verify for
 		Options: []*discordgo.ApplicationCommandOption{
 			{
 				Type:        discordgo.ApplicationCommandOptionString,
@@ -40,62 +44,62 @@ var (
 				Description: "Your NetID",
 				Required:    true,
 			},
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "course",
+				Description:  "Course to verify for, leave empty for every course you're enrolled in",
+				Required:     false,
+				Autocomplete: true,
+			},
 		},
 	}
 )
 
-// SMTPConfig holds configuration for SMTP server
-type SMTPConfig struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	Sender   string
-}
-
 // AuthService handles the authentication logic
 type AuthService struct {
-	smtpConfig SMTPConfig
+	outbox *Outbox
+	// sender is the From address of the verification emails
+	sender    string
+	templates *EmailTemplates
 }
 
-// PreAuthUser holds the data for a user before they are authenticated
+// PreAuthUser holds the data for a user before they are authenticated, CourseId
+// is empty when they are verifying for every course they are enrolled in
 type PreAuthUser struct {
 	DiscordUserId  string
 	DiscordGuildId string
 	NetId          string
+	CourseId       string
 }
 
-func NewPreAuthUser(discordUserId string, discordGuildId, netId string) *PreAuthUser {
-	preAuthUser := PreAuthUser{
+func NewPreAuthUser(discordUserId string, discordGuildId, netId string, courseId string) *PreAuthUser {
+	return &PreAuthUser{
 		DiscordUserId:  discordUserId,
 		DiscordGuildId: discordGuildId,
 		NetId:          netId,
+		CourseId:       courseId,
 	}
-	PreAuthUsers[discordUserId] = &preAuthUser
-	return &preAuthUser
 }
 
-func NewAuthService() *AuthService {
+func NewAuthService(outbox *Outbox, sender string, templates *EmailTemplates) *AuthService {
 	return &AuthService{
-		smtpConfig: SMTPConfig{
-			Host:     "smtp.gmail.com",
-			Port:     587,
-			Username: os.Getenv("SMTP_USERNAME"),
-			Password: os.Getenv("SMTP_PASSWORD"),
-			Sender:   os.Getenv("SMTP_USERNAME"),
-		},
+		outbox:    outbox,
+		sender:    sender,
+		templates: templates,
 	}
 }
 
-func RequestAuthUrl(preAuthUser *PreAuthUser) string {
+func RequestAuthUrl(preAuthUser *PreAuthUser) (string, error) {
 	authServerUrl := os.Getenv("AUTH_SERVER_URL")
 
 	// send request to endpoint /generate-user-token
 	log.Println("Generating HTTP request")
-	requestString := fmt.Sprintf("/generate-user-token?user-discord-id=%s&guild-discord-id=%s", preAuthUser.DiscordUserId, preAuthUser.DiscordGuildId)
+	requestString := fmt.Sprintf("/generate-user-token?user-discord-id=%s&guild-discord-id=%s&netid=%s&course-id=%s",
+		preAuthUser.DiscordUserId, preAuthUser.DiscordGuildId, url.QueryEscape(preAuthUser.NetId), url.QueryEscape(preAuthUser.CourseId))
 	req, err := http.NewRequest("POST", authServerUrl+requestString, nil)
 	if err != nil {
 		log.Println(err)
+		return "", err
 	}
 
 	log.Println("Setting request headers")
@@ -107,53 +111,64 @@ func RequestAuthUrl(preAuthUser *PreAuthUser) string {
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Println(err)
-		return "[Something went wrong while sending the request to the authentication server. Try again.]"
+		return "", errors.New("something went wrong while sending the request to the authentication server, try again")
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	var response authserver.ApiResponse
 	err = json.Unmarshal(body, &response)
 	if err != nil {
-		log.Println("Response body causing error:", body)
-		log.Fatal(err)
+		log.Println("Response body causing error:", string(body))
+		return "", err
+	}
+	if !response.Success {
+		return "", errors.New(response.Message)
 	}
 
 	dataMap, ok := response.Data.(map[string]interface{})
 	if !ok {
-		log.Fatal("Data is not the expected type")
+		return "", errors.New("data is not the expected type")
 	}
 
 	// Access the token within the map
 	token, ok := dataMap["token"].(string)
 	if !ok {
-		log.Fatal("Token is not a string or not present")
+		return "", errors.New("token is not a string or not present")
 	}
 
-	return fmt.Sprintf("%s/verify?user-discord-id=%s&token=%s", authServerUrl, preAuthUser.DiscordUserId, token)
+	return fmt.Sprintf("%s/verify?user-discord-id=%s&token=%s", authServerUrl, preAuthUser.DiscordUserId, token), nil
 }
 
-func (service *AuthService) SendAuthEmail(netID string, preAuthUser *PreAuthUser, verificationUrl string) error {
-	recipient := fmt.Sprintf("%s@vols.utk.edu", netID)
-	subject := "UTK COSC Authentication Email"
-	body := fmt.Sprintf("Hello %s,\n\n"+
-		"Please click the link below to verify your Discord account with UTK."+
-		"\n\n%s"+
-		"\n\nThank you,"+
-		"\nUTK COSC Discord Bot", netID, verificationUrl)
-
-	return service.sendEmail(recipient, subject, body)
-}
-
-func (service *AuthService) sendEmail(to, subject, body string) error {
-	addr := fmt.Sprintf("%s:%d", service.smtpConfig.Host, service.smtpConfig.Port)
-	auth := smtp.PlainAuth("", service.smtpConfig.Username, service.smtpConfig.Password, service.smtpConfig.Host)
-
-	message := []byte(fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", to, subject, body))
+// QueueAuthEmail puts the verification email for preAuthUser in the outbox,
+// applying the guild's overrides to the templates. Its delivery is reported
+// by editing the response to interaction, along with note.
+func (service *AuthService) QueueAuthEmail(preAuthUser *PreAuthUser, verificationUrl string, overrides EmailOverrides, interaction *discordgo.Interaction, note string) (store.OutboxEmail, error) {
+	email, err := service.templates.RenderVerification(preAuthUser.NetId, verificationUrl, overrides)
+	if err != nil {
+		return store.OutboxEmail{}, err
+	}
+	email.From.Address = service.sender
+	email.To = mail.Address{Address: fmt.Sprintf("%s@vols.utk.edu", preAuthUser.NetId)}
+	email.Date = time.Now()
+	email.MessageId = NewMessageId(service.sender)
 
-	return smtp.SendMail(addr, auth, service.smtpConfig.Sender, []string{to}, message)
+	message, err := email.Bytes("")
+	if err != nil {
+		return store.OutboxEmail{}, err
+	}
+	return service.outbox.Enqueue(store.OutboxEmail{
+		From:             service.sender,
+		To:               []string{email.To.Address},
+		Message:          message,
+		GuildId:          preAuthUser.DiscordGuildId,
+		UserId:           preAuthUser.DiscordUserId,
+		NetId:            preAuthUser.NetId,
+		ApplicationId:    interaction.AppID,
+		InteractionToken: interaction.Token,
+		Note:             note,
+	})
 }
-
-var PreAuthUsers = make(map[string]*PreAuthUser)
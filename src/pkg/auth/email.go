@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+)
+
+//go:embed templates/*.tmpl
+var embeddedTemplates embed.FS
+
+// template files, EMAIL_TEMPLATE_DIR can replace any of them
+const (
+	subjectTemplate = "verify.subject.tmpl"
+	textTemplate    = "verify.txt.tmpl"
+	htmlTemplate    = "verify.html.tmpl"
+)
+
+// DefaultSignature signs the verification email unless a course overrides it
+const DefaultSignature = "UTK COSC Discord Bot"
+
+// EmailData is what the verification email templates are rendered with
+type EmailData struct {
+	NetId           string
+	VerificationURL string
+	// CourseName is empty when the member is verifying for more than one course
+	// without names
+	CourseName string
+	Signature  string
+	Subject    string
+}
+
+// SignatureLines splits a multi-line signature for the HTML template
+func (data EmailData) SignatureLines() []string {
+	return strings.Split(data.Signature, "\n")
+}
+
+// EmailOverrides are a guild's replacements for the defaults, empty fields
+// keep the default
+type EmailOverrides struct {
+	Subject    string
+	CourseName string
+	Signature  string
+}
+
+// OverridesFor combines the overrides of the courses a member is verifying for
+func OverridesFor(courses []canvas.Course) EmailOverrides {
+	var overrides EmailOverrides
+	var names []string
+	for _, course := range courses {
+		if overrides.Subject == "" {
+			overrides.Subject = course.EmailSubject
+		}
+		if overrides.Signature == "" {
+			overrides.Signature = course.EmailSignature
+		}
+		if course.EmailCourseName != "" {
+			names = append(names, course.EmailCourseName)
+		}
+	}
+	switch len(names) {
+	case 0:
+	case 1:
+		overrides.CourseName = names[0]
+	default:
+		overrides.CourseName = strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	}
+	return overrides
+}
+
+// EmailTemplates renders the verification email
+type EmailTemplates struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// LoadEmailTemplates reads the templates from dir, using the built in one for
+// every file dir doesn't have. An empty dir uses only the built in templates.
+func LoadEmailTemplates(dir string) (*EmailTemplates, error) {
+	defaults, _ := fs.Sub(embeddedTemplates, "templates")
+	read := func(name string) (string, error) {
+		if dir != "" {
+			content, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				return string(content), nil
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+		}
+		content, err := fs.ReadFile(defaults, name)
+		return string(content), err
+	}
+
+	var templates EmailTemplates
+	for _, name := range []string{subjectTemplate, textTemplate, htmlTemplate} {
+		content, err := read(name)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case subjectTemplate:
+			templates.subject, err = texttemplate.New(name).Option("missingkey=error").Parse(content)
+		case textTemplate:
+			templates.text, err = texttemplate.New(name).Option("missingkey=error").Parse(content)
+		case htmlTemplate:
+			templates.html, err = htmltemplate.New(name).Option("missingkey=error").Parse(content)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("email template %s: %w", name, err)
+		}
+	}
+	return &templates, nil
+}
+
+// EmailTemplatesFromEnv loads the templates in EMAIL_TEMPLATE_DIR, if set
+func EmailTemplatesFromEnv() (*EmailTemplates, error) {
+	return LoadEmailTemplates(os.Getenv("EMAIL_TEMPLATE_DIR"))
+}
+
+// Email is a message with both a plain text and an HTML body
+type Email struct {
+	From      mail.Address
+	To        mail.Address
+	Subject   string
+	Date      time.Time
+	MessageId string
+	Text      string
+	HTML      string
+}
+
+// RenderVerification fills in the subject and bodies of a verification email,
+// and the From name with the first line of the signature
+func (templates *EmailTemplates) RenderVerification(netId string, verificationURL string, overrides EmailOverrides) (*Email, error) {
+	data := EmailData{
+		NetId:           netId,
+		VerificationURL: verificationURL,
+		CourseName:      overrides.CourseName,
+		Signature:       overrides.Signature,
+	}
+	if data.Signature == "" {
+		data.Signature = DefaultSignature
+	}
+
+	var buffer bytes.Buffer
+	if overrides.Subject != "" {
+		data.Subject = overrides.Subject
+	} else {
+		if err := templates.subject.Execute(&buffer, data); err != nil {
+			return nil, err
+		}
+		data.Subject = buffer.String()
+	}
+	// a header can't span lines
+	data.Subject = strings.Join(strings.Fields(data.Subject), " ")
+
+	email := &Email{Subject: data.Subject}
+	email.From.Name = strings.TrimSpace(strings.Split(data.Signature, "\n")[0])
+	if email.From.Name == "" {
+		email.From.Name = DefaultSignature
+	}
+	buffer.Reset()
+	if err := templates.text.Execute(&buffer, data); err != nil {
+		return nil, err
+	}
+	email.Text = buffer.String()
+	buffer.Reset()
+	if err := templates.html.Execute(&buffer, data); err != nil {
+		return nil, err
+	}
+	email.HTML = buffer.String()
+	return email, nil
+}
+
+// NewMessageId returns a unique Message-ID in the domain of the from address
+func NewMessageId(from string) string {
+	domain := "utk-auth-go.localhost"
+	if _, host, ok := strings.Cut(from, "@"); ok && host != "" {
+		domain = host
+	}
+	return "<" + randomHex(16) + "@" + domain + ">"
+}
+
+// Bytes formats the email as an RFC 5322 multipart/alternative message, using
+// a random MIME boundary if boundary is empty
+func (email *Email) Bytes(boundary string) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	if boundary != "" {
+		if err := parts.SetBoundary(boundary); err != nil {
+			return nil, err
+		}
+	}
+	// the last part is the one clients prefer
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write([]byte(strings.ReplaceAll(part.content, "\r\n", "\n"))); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	headers := [][2]string{
+		{"Date", email.Date.Format(time.RFC1123Z)},
+		{"From", email.From.String()},
+		{"To", email.To.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", email.Subject)},
+		{"Message-ID", email.MessageId},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": parts.Boundary()})},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&message, "%s: %s\r\n", header[0], header[1])
+	}
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestRenderVerificationGolden renders each case with a fixed date, Message-ID
+// and MIME boundary and compares it with testdata/<name>.eml, then parses the
+// message back to check the parts decode to what was rendered. Run with
+// -update to rewrite the files after an intended change.
+func TestRenderVerificationGolden(t *testing.T) {
+	templates, err := LoadEmailTemplates("")
+	if err != nil {
+		t.Fatal("loading templates:", err)
+	}
+
+	tests := []struct {
+		name      string
+		netId     string
+		url       string
+		overrides EmailOverrides
+	}{
+		{
+			name:  "default",
+			netId: "abc123",
+			url:   "https://auth.example.edu/verify?user-discord-id=123456789012345678&token=t0k3n",
+		},
+		{
+			name:  "overrides",
+			netId: "jdoe42",
+			url:   "https://auth.example.edu/verify?user-discord-id=123456789012345678&token=t0k3n",
+			overrides: EmailOverrides{
+				Subject:    "Vérifiez votre compte – COSC 202 ✓",
+				CourseName: "COSC 202: Data Structures",
+				Signature:  "Dr. Grace Hopper\nCOSC 202 Teaching Staff",
+			},
+		},
+		{
+			name:  "escaping",
+			netId: "xss1",
+			url:   "https://auth.example.edu/verify?user-discord-id=123456789012345678&token=" + strings.Repeat("long", 30) + "&next=<b>",
+			overrides: EmailOverrides{
+				CourseName: `<b>Tom & "Jerry"</b>`,
+				Signature:  "<script>alert(1)</script>",
+			},
+		},
+		{
+			name:  "several_courses",
+			netId: "abc123",
+			url:   "https://auth.example.edu/verify?user-discord-id=123456789012345678&token=t0k3n",
+			overrides: OverridesFor([]canvas.Course{
+				{CourseId: "1001", EmailCourseName: "COSC 202"},
+				{CourseId: "1002"},
+				{CourseId: "1003", EmailCourseName: "COSC 360", EmailSignature: "COSC Staff"},
+				{CourseId: "1004", EmailCourseName: "COSC 461"},
+			}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			email, err := templates.RenderVerification(test.netId, test.url, test.overrides)
+			if err != nil {
+				t.Fatal(err)
+			}
+			email.From.Address = "utk-auth@example.edu"
+			email.To = mail.Address{Address: test.netId + "@vols.utk.edu"}
+			email.Date = time.Date(2026, time.August, 19, 9, 30, 0, 0, time.FixedZone("EDT", -4*60*60))
+			email.MessageId = "<golden-" + test.name + "@example.edu>"
+			message, err := email.Bytes("golden-boundary-" + test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkParses(t, email, message)
+
+			golden := filepath.Join("testdata", test.name+".eml")
+			if *update {
+				if err := os.WriteFile(golden, message, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(message, want) {
+				t.Errorf("differs from %s, rerun with -update if the change is intended:\n%s", golden, message)
+			}
+		})
+	}
+}
+
+// checkParses reads the message back like a mail client would
+func checkParses(t *testing.T, email *Email, message []byte) {
+	t.Helper()
+	parsed, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != email.Subject {
+		t.Errorf("subject decodes to %q, want %q", subject, email.Subject)
+	}
+	for _, header := range []string{"Date", "From", "To", "Message-ID", "MIME-Version"} {
+		if parsed.Header.Get(header) == "" {
+			t.Errorf("missing %s header", header)
+		}
+	}
+	if _, err := parsed.Header.Date(); err != nil {
+		t.Error(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("content type is %s", mediaType)
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, want := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	} {
+		// NextRawPart leaves the quoted-printable encoding for us to check
+		part, err := reader.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != want.contentType {
+			t.Errorf("part is %s, want %s", part.Header.Get("Content-Type"), want.contentType)
+		}
+		decoded, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != strings.ReplaceAll(want.content, "\n", "\r\n") {
+			t.Errorf("%s part decodes to %q", want.contentType, decoded)
+		}
+	}
+	if _, err := reader.NextRawPart(); err != io.EOF {
+		t.Errorf("expected two parts, got more: %v", err)
+	}
+
+	for _, line := range strings.Split(string(message), "\r\n") {
+		if len(line) > 998 {
+			t.Error("line longer than 998 characters")
+		}
+		if strings.Contains(line, "\n") {
+			t.Errorf("bare LF in %q", line)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Mailer delivers a message that is already formatted as RFC 5322
+type Mailer interface {
+	Send(from string, to []string, message []byte) error
+}
+
+// SMTP connection security
+const (
+	SecurityStartTLS = "starttls"
+	SecurityTLS      = "tls"
+	SecurityNone     = "none"
+)
+
+// SMTPMailer sends through an SMTP server. Username is optional, relays that
+// trust the bot's address don't need it.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Security is SecurityStartTLS, SecurityTLS for implicit TLS, or SecurityNone
+	Security string
+	Timeout  time.Duration
+}
+
+func (mailer *SMTPMailer) Send(from string, to []string, message []byte) error {
+	addr := net.JoinHostPort(mailer.Host, strconv.Itoa(mailer.Port))
+	dialer := &net.Dialer{Timeout: mailer.Timeout}
+	tlsConfig := &tls.Config{ServerName: mailer.Host}
+
+	var conn net.Conn
+	var err error
+	if mailer.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if mailer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(mailer.Timeout))
+	}
+
+	client, err := smtp.NewClient(conn, mailer.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if mailer.Security == SecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if mailer.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("%s does not support AUTH", addr)
+		}
+		if err := client.Auth(smtp.PlainAuth("", mailer.Username, mailer.Password, mailer.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// FileMailer writes every message into a maildir for local development, where
+// any mail client can open it
+type FileMailer struct {
+	Dir string
+}
+
+func (mailer *FileMailer) Send(from string, to []string, message []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(mailer.Dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	// maildir delivery: write under tmp, then move into new in one step
+	name := fmt.Sprintf("%d.%s.utk-auth-go", time.Now().UnixNano(), randomHex(8))
+	tmpPath := filepath.Join(mailer.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, message, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(mailer.Dir, "new", name))
+}
+
+// ConsoleMailer prints every message instead of sending it
+type ConsoleMailer struct {
+	Writer io.Writer
+}
+
+func (mailer *ConsoleMailer) Send(from string, to []string, message []byte) error {
+	_, err := fmt.Fprintf(mailer.Writer, "----- mail from %s to %v -----\n%s\n----- end of mail -----\n", from, to, message)
+	return err
+}
+
+// SentMail is a message kept by CapturingMailer
+type SentMail struct {
+	From    string
+	To      []string
+	Message []byte
+}
+
+// CapturingMailer keeps messages instead of sending them, for tests. Set Err
+// to make Send fail.
+type CapturingMailer struct {
+	Err error
+
+	mutex sync.Mutex
+	sent  []SentMail
+}
+
+func (mailer *CapturingMailer) Send(from string, to []string, message []byte) error {
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	if mailer.Err != nil {
+		return mailer.Err
+	}
+	mailer.sent = append(mailer.sent, SentMail{From: from, To: append([]string{}, to...), Message: append([]byte{}, message...)})
+	return nil
+}
+
+// Sent returns the messages captured so far
+func (mailer *CapturingMailer) Sent() []SentMail {
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	return append([]SentMail{}, mailer.sent...)
+}
+
+// MailerFromEnv picks the mail backend named by MAIL_BACKEND:
+//
+//   - smtp (default): SMTP_HOST (default smtp.gmail.com), SMTP_PORT (default
+//     587, or 465 with implicit TLS), SMTP_SECURITY starttls|tls|none (default
+//     starttls) and optionally SMTP_USERNAME and SMTP_PASSWORD
+//   - file: a maildir at MAIL_DIR (default DATA_DIR/mail)
+//   - console: printed to stdout
+func MailerFromEnv() (Mailer, error) {
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "", "smtp":
+		return smtpMailerFromEnv()
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dataDir := os.Getenv("DATA_DIR")
+			if dataDir == "" {
+				dataDir = "/data"
+			}
+			dir = filepath.Join(dataDir, "mail")
+		}
+		return &FileMailer{Dir: dir}, nil
+	case "console":
+		return &ConsoleMailer{Writer: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+	}
+}
+
+func smtpMailerFromEnv() (*SMTPMailer, error) {
+	mailer := &SMTPMailer{
+		Host:     os.Getenv("SMTP_HOST"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		Security: os.Getenv("SMTP_SECURITY"),
+		Timeout:  30 * time.Second,
+	}
+	if mailer.Host == "" {
+		mailer.Host = "smtp.gmail.com"
+	}
+	switch mailer.Security {
+	case "":
+		mailer.Security = SecurityStartTLS
+	case SecurityStartTLS, SecurityTLS, SecurityNone:
+	default:
+		return nil, fmt.Errorf("unknown SMTP_SECURITY %q", mailer.Security)
+	}
+
+	if port := os.Getenv("SMTP_PORT"); port != "" {
+		var err error
+		mailer.Port, err = strconv.Atoi(port)
+		if err != nil || mailer.Port <= 0 || mailer.Port > 65535 {
+			return nil, fmt.Errorf("invalid SMTP_PORT %q", port)
+		}
+	} else if mailer.Security == SecurityTLS {
+		mailer.Port = 465
+	} else {
+		mailer.Port = 587
+	}
+
+	if mailer.Username == "" && mailer.Password != "" {
+		return nil, errors.New("SMTP_PASSWORD is set without SMTP_USERNAME")
+	}
+	return mailer, nil
+}
+
+// SenderFromEnv is the From address, MAIL_FROM or else SMTP_USERNAME
+func SenderFromEnv() string {
+	if sender := os.Getenv("MAIL_FROM"); sender != "" {
+		return sender
+	}
+	return os.Getenv("SMTP_USERNAME")
+}
+
+func randomHex(n int) string {
+	buffer := make([]byte, n)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
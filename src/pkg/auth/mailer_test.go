@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server that accepts one session and records it
+type fakeSMTP struct {
+	// extensions are advertised in the EHLO reply
+	extensions []string
+	// rejectRcpt answers RCPT TO for this address with 550
+	rejectRcpt string
+
+	from string
+	to   []string
+	auth string
+	data string
+	done chan struct{}
+	port int
+}
+
+func startFakeSMTP(t *testing.T, server *fakeSMTP) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.port = listener.Addr().(*net.TCPAddr).Port
+	server.done = make(chan struct{})
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		defer close(server.done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		server.serve(textproto.NewConn(conn))
+	}()
+}
+
+func (server *fakeSMTP) serve(conn *textproto.Conn) {
+	conn.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			lines := append([]string{"fake"}, server.extensions...)
+			for i, extension := range lines {
+				separator := "-"
+				if i == len(lines)-1 {
+					separator = " "
+				}
+				conn.PrintfLine("250%s%s", separator, extension)
+			}
+		case "AUTH":
+			decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			server.auth = string(decoded)
+			conn.PrintfLine("235 ok")
+		case "MAIL":
+			server.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			conn.PrintfLine("250 ok")
+		case "RCPT":
+			recipient := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if recipient == server.rejectRcpt {
+				conn.PrintfLine("550 no such user")
+				continue
+			}
+			server.to = append(server.to, recipient)
+			conn.PrintfLine("250 ok")
+		case "DATA":
+			conn.PrintfLine("354 go ahead")
+			// ReadDotBytes turns the CRLF line endings into LF
+			data, _ := conn.ReadDotBytes()
+			server.data = string(data)
+			conn.PrintfLine("250 queued")
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	message := "Subject: test\r\n\r\nhello\r\n"
+	tests := []struct {
+		name     string
+		server   fakeSMTP
+		username string
+		security string
+		to       []string
+		// fails is part of the error the send should fail with, empty if it should succeed
+		fails string
+		auth  string
+	}{
+		{name: "plain relay", security: SecurityNone, to: []string{"abc123@vols.utk.edu"}},
+		{name: "several recipients", security: SecurityNone, to: []string{"a@vols.utk.edu", "b@vols.utk.edu"}},
+		{
+			name:     "authenticated",
+			server:   fakeSMTP{extensions: []string{"AUTH PLAIN"}},
+			username: "bot",
+			security: SecurityNone,
+			to:       []string{"abc123@vols.utk.edu"},
+			auth:     "\x00bot\x00password",
+		},
+		{name: "no AUTH offered", username: "bot", security: SecurityNone, to: []string{"abc123@vols.utk.edu"}, fails: "AUTH"},
+		{name: "no STARTTLS offered", security: SecurityStartTLS, to: []string{"abc123@vols.utk.edu"}, fails: "STARTTLS"},
+		{
+			name:     "recipient refused",
+			server:   fakeSMTP{rejectRcpt: "gone@vols.utk.edu"},
+			security: SecurityNone,
+			to:       []string{"gone@vols.utk.edu"},
+			fails:    "550",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := test.server
+			startFakeSMTP(t, &server)
+			mailer := &SMTPMailer{
+				Host:     "127.0.0.1",
+				Port:     server.port,
+				Username: test.username,
+				Password: "password",
+				Security: test.security,
+				Timeout:  5 * time.Second,
+			}
+			err := mailer.Send("bot@example.edu", test.to, []byte(message))
+			<-server.done
+
+			if test.fails != "" {
+				if err == nil || !strings.Contains(err.Error(), test.fails) {
+					t.Fatalf("got %v, want an error about %s", err, test.fails)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if server.from != "bot@example.edu" || !reflect.DeepEqual(server.to, test.to) || server.data != strings.ReplaceAll(message, "\r\n", "\n") {
+				t.Errorf("server got from %q to %v:\n%s", server.from, server.to, server.data)
+			}
+			if server.auth != test.auth {
+				t.Errorf("authenticated with %q, want %q", server.auth, test.auth)
+			}
+		})
+	}
+
+	t.Run("refusal is permanent", func(t *testing.T) {
+		server := fakeSMTP{rejectRcpt: "gone@vols.utk.edu"}
+		startFakeSMTP(t, &server)
+		mailer := &SMTPMailer{Host: "127.0.0.1", Port: server.port, Security: SecurityNone, Timeout: 5 * time.Second}
+		err := mailer.Send("bot@example.edu", []string{"gone@vols.utk.edu"}, []byte(message))
+		var reply *textproto.Error
+		if !errors.As(err, &reply) || !permanent(err) {
+			t.Errorf("got %v, want a permanent 5xx reply", err)
+		}
+	})
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := &FileMailer{Dir: dir}
+	messages := []string{"Subject: one\r\n\r\nfirst\r\n", "Subject: two\r\n\r\nsecond\r\n"}
+	for _, message := range messages {
+		if err := mailer.Send("bot@example.edu", []string{"abc123@vols.utk.edu"}, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		sub   string
+		count int
+	}{
+		{"tmp", 0},
+		{"new", len(messages)},
+		{"cur", 0},
+	} {
+		entries, err := os.ReadDir(filepath.Join(dir, test.sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != test.count {
+			t.Errorf("%s has %d messages, want %d", test.sub, len(entries), test.count)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "new"))
+	found := make(map[string]bool)
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, "new", entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found[string(content)] = true
+		if info, _ := entry.Info(); info.Mode().Perm() != 0600 {
+			t.Errorf("%s has mode %v", entry.Name(), info.Mode().Perm())
+		}
+	}
+	for _, message := range messages {
+		if !found[message] {
+			t.Errorf("no file holds %q", message)
+		}
+	}
+}
+
+func TestMailerFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want Mailer
+		// fails reports whether MailerFromEnv should refuse the settings
+		fails bool
+	}{
+		{
+			name: "defaults",
+			want: &SMTPMailer{Host: "smtp.gmail.com", Port: 587, Security: SecurityStartTLS, Timeout: 30 * time.Second},
+		},
+		{
+			name: "implicit TLS defaults to 465",
+			env:  map[string]string{"SMTP_HOST": "mail.utk.edu", "SMTP_SECURITY": "tls", "SMTP_USERNAME": "bot", "SMTP_PASSWORD": "pw"},
+			want: &SMTPMailer{Host: "mail.utk.edu", Port: 465, Username: "bot", Password: "pw", Security: SecurityTLS, Timeout: 30 * time.Second},
+		},
+		{
+			name: "explicit port",
+			env:  map[string]string{"MAIL_BACKEND": "smtp", "SMTP_PORT": "2525", "SMTP_SECURITY": "none"},
+			want: &SMTPMailer{Host: "smtp.gmail.com", Port: 2525, Security: SecurityNone, Timeout: 30 * time.Second},
+		},
+		{name: "bad port", env: map[string]string{"SMTP_PORT": "70000"}, fails: true},
+		{name: "unknown security", env: map[string]string{"SMTP_SECURITY": "ssl"}, fails: true},
+		{name: "password without username", env: map[string]string{"SMTP_PASSWORD": "pw"}, fails: true},
+		{name: "file in the data dir", env: map[string]string{"MAIL_BACKEND": "file", "DATA_DIR": "/srv/data"}, want: &FileMailer{Dir: "/srv/data/mail"}},
+		{name: "file in MAIL_DIR", env: map[string]string{"MAIL_BACKEND": "file", "MAIL_DIR": "/tmp/mail"}, want: &FileMailer{Dir: "/tmp/mail"}},
+		{name: "console", env: map[string]string{"MAIL_BACKEND": "console"}, want: &ConsoleMailer{Writer: os.Stdout}},
+		{name: "unknown backend", env: map[string]string{"MAIL_BACKEND": "carrier-pigeon"}, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"MAIL_BACKEND", "MAIL_DIR", "DATA_DIR", "SMTP_HOST", "SMTP_PORT", "SMTP_SECURITY", "SMTP_USERNAME", "SMTP_PASSWORD"} {
+				t.Setenv(name, test.env[name])
+			}
+			mailer, err := MailerFromEnv()
+			if test.fails {
+				if err == nil {
+					t.Errorf("got %+v, want an error", mailer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mailer, test.want) {
+				t.Errorf("got %+v, want %+v", mailer, test.want)
+			}
+		})
+	}
+}
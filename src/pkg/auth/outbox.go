@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/textproto"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"utk-auth-go/src/pkg/store"
+)
+
+// how long finished emails stay in the outbox
+const (
+	sentRetention = 24 * time.Hour
+	deadRetention = 30 * 24 * time.Hour
+)
+
+// Outbox sends emails in the background. Queued emails are saved in the store
+// first, so a restart picks up whatever was still waiting. A failed send is
+// retried with exponential backoff until MaxAttempts, after which the email is
+// kept as a dead letter.
+type Outbox struct {
+	Workers     int
+	MaxAttempts int
+	// RetryDelay is the wait after the first failure, doubling with every
+	// failure after it up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// PollInterval is how often the store is checked for emails that are due
+	PollInterval time.Duration
+	// OnStatus is called after every attempt with the email's new state
+	OnStatus func(email store.OutboxEmail)
+
+	store  store.Store
+	mailer Mailer
+
+	mutex sync.Mutex
+	// inFlight holds the IDs of the emails handed to a worker
+	inFlight  map[string]bool
+	lastPrune time.Time
+	wake      chan struct{}
+	stop      chan struct{}
+	running   sync.WaitGroup
+}
+
+// NewOutbox returns an outbox that keeps its emails in dataStore and sends them
+// with mailer. The defaults give up within about 8 minutes, well inside the
+// 15 minutes Discord allows for updating the /auth response.
+func NewOutbox(dataStore store.Store, mailer Mailer) *Outbox {
+	return &Outbox{
+		Workers:       2,
+		MaxAttempts:   6,
+		RetryDelay:    15 * time.Second,
+		MaxRetryDelay: 5 * time.Minute,
+		PollInterval:  5 * time.Second,
+		store:         dataStore,
+		mailer:        mailer,
+		inFlight:      make(map[string]bool),
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+}
+
+// OutboxFromEnv is NewOutbox tuned by EMAIL_WORKERS (default 2),
+// EMAIL_MAX_ATTEMPTS (default 6) and EMAIL_RETRY_DELAY (default 15s)
+func OutboxFromEnv(dataStore store.Store, mailer Mailer) *Outbox {
+	outbox := NewOutbox(dataStore, mailer)
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{"EMAIL_WORKERS", &outbox.Workers},
+		{"EMAIL_MAX_ATTEMPTS", &outbox.MaxAttempts},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+				*setting.value = parsed
+			} else {
+				log.Printf("Invalid %s %q, using %d\n", setting.name, value, *setting.value)
+			}
+		}
+	}
+	if value := os.Getenv("EMAIL_RETRY_DELAY"); value != "" {
+		if delay, err := time.ParseDuration(value); err == nil && delay > 0 {
+			outbox.RetryDelay = delay
+		} else {
+			log.Printf("Invalid EMAIL_RETRY_DELAY %q, using %s\n", value, outbox.RetryDelay)
+		}
+	}
+	return outbox
+}
+
+// Enqueue saves email as pending and wakes the workers, returning it with its
+// ID and timestamps filled in
+func (outbox *Outbox) Enqueue(email store.OutboxEmail) (store.OutboxEmail, error) {
+	now := time.Now()
+	email.Id = randomHex(16)
+	email.Status = store.EmailPending
+	email.Attempts = 0
+	email.CreatedAt = now
+	email.NextAttemptAt = now
+	if err := outbox.store.EnqueueEmail(email); err != nil {
+		return email, err
+	}
+
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+	return email, nil
+}
+
+// Requeue gives the dead letter id a fresh set of attempts, failing with
+// store.ErrEmailNotFound if there is no such dead letter
+func (outbox *Outbox) Requeue(id string) (store.OutboxEmail, error) {
+	emails, err := outbox.store.Emails(store.EmailDead)
+	if err != nil {
+		return store.OutboxEmail{}, err
+	}
+	for _, email := range emails {
+		if email.Id != id {
+			continue
+		}
+		email.Status = store.EmailPending
+		email.Attempts = 0
+		email.LastError = ""
+		email.NextAttemptAt = time.Now()
+		email.FinishedAt = time.Time{}
+		if err := outbox.store.UpdateEmail(email); err != nil {
+			return email, err
+		}
+
+		select {
+		case outbox.wake <- struct{}{}:
+		default:
+		}
+		return email, nil
+	}
+	return store.OutboxEmail{}, store.ErrEmailNotFound
+}
+
+// Start runs the workers until Stop is called
+func (outbox *Outbox) Start() {
+	queue := make(chan store.OutboxEmail)
+	for i := 0; i < outbox.Workers; i++ {
+		outbox.running.Add(1)
+		go func() {
+			defer outbox.running.Done()
+			for email := range queue {
+				outbox.deliver(email)
+				outbox.mutex.Lock()
+				delete(outbox.inFlight, email.Id)
+				outbox.mutex.Unlock()
+			}
+		}()
+	}
+
+	outbox.running.Add(1)
+	go func() {
+		defer outbox.running.Done()
+		defer close(queue)
+		ticker := time.NewTicker(outbox.PollInterval)
+		defer ticker.Stop()
+		for {
+			if !outbox.dispatch(queue) {
+				return
+			}
+			select {
+			case <-outbox.stop:
+				return
+			case <-outbox.wake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop waits for the emails being sent and stops the workers, emails still
+// waiting stay in the store for the next Start
+func (outbox *Outbox) Stop() {
+	close(outbox.stop)
+	outbox.running.Wait()
+}
+
+// dispatch hands the due emails to the workers, returning false once the
+// outbox is stopped
+func (outbox *Outbox) dispatch(queue chan<- store.OutboxEmail) bool {
+	now := time.Now()
+	outbox.prune(now)
+
+	emails, err := outbox.store.DueEmails(now, 100)
+	if err != nil {
+		log.Println("Error reading the email outbox:", err)
+		return true
+	}
+	for _, email := range emails {
+		outbox.mutex.Lock()
+		busy := outbox.inFlight[email.Id]
+		outbox.inFlight[email.Id] = true
+		outbox.mutex.Unlock()
+		if busy {
+			continue
+		}
+
+		select {
+		case queue <- email:
+		case <-outbox.stop:
+			return false
+		}
+	}
+	return true
+}
+
+// deliver makes one attempt at sending email and saves how it went
+func (outbox *Outbox) deliver(email store.OutboxEmail) {
+	err := outbox.mailer.Send(email.From, email.To, email.Message)
+	now := time.Now()
+	email.Attempts++
+
+	switch {
+	case err == nil:
+		log.Println("Sent email", email.Id, "to NetID:", email.NetId)
+		email.Status = store.EmailSent
+		email.LastError = ""
+	case email.Attempts >= outbox.MaxAttempts || permanent(err):
+		log.Printf("Giving up on email %s to NetID %s after %d attempts: %v\n", email.Id, email.NetId, email.Attempts, err)
+		email.Status = store.EmailDead
+		email.LastError = err.Error()
+	default:
+		email.NextAttemptAt = now.Add(outbox.retryDelay(email.Attempts))
+		email.LastError = err.Error()
+		log.Printf("Error sending email %s to NetID %s (attempt %d of %d, retrying after %s): %v\n",
+			email.Id, email.NetId, email.Attempts, outbox.MaxAttempts, email.NextAttemptAt.Format(time.RFC3339), err)
+	}
+	if email.Status != store.EmailPending {
+		email.FinishedAt = now
+	}
+	// a dead letter keeps its message so it can be requeued
+	if email.Status == store.EmailSent {
+		email.Message = nil
+	}
+
+	// if this fails a sent email stays pending and is sent again
+	if err := outbox.store.UpdateEmail(email); err != nil {
+		log.Println("Error saving the state of email", email.Id, err)
+	}
+	if outbox.OnStatus != nil {
+		outbox.OnStatus(email)
+	}
+}
+
+// retryDelay doubles RetryDelay for each failure after the first, up to MaxRetryDelay
+func (outbox *Outbox) retryDelay(attempts int) time.Duration {
+	delay := outbox.RetryDelay
+	for i := 1; i < attempts && delay < outbox.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, outbox.MaxRetryDelay)
+}
+
+// prune drops finished emails past their retention, at most once an hour
+func (outbox *Outbox) prune(now time.Time) {
+	if now.Sub(outbox.lastPrune) < time.Hour {
+		return
+	}
+	outbox.lastPrune = now
+
+	for status, retention := range map[string]time.Duration{store.EmailSent: sentRetention, store.EmailDead: deadRetention} {
+		removed, err := outbox.store.DeleteEmails(status, now.Add(-retention))
+		if err != nil {
+			log.Printf("Error pruning %s emails: %v\n", status, err)
+		} else if removed > 0 {
+			log.Printf("Pruned %d %s emails\n", removed, status)
+		}
+	}
+}
+
+// permanent reports whether the mail server refused the email outright, a
+// 5xx reply doesn't get better by retrying
+func permanent(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500
+}
@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"utk-auth-go/src/pkg/store"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// flakyMailer fails the first failures sends with err, then captures the rest
+type flakyMailer struct {
+	CapturingMailer
+	failures int
+	err      error
+	delay    time.Duration
+
+	mutex   sync.Mutex
+	calls   int
+	running int
+	busiest int
+}
+
+func (mailer *flakyMailer) Send(from string, to []string, message []byte) error {
+	mailer.mutex.Lock()
+	mailer.calls++
+	call := mailer.calls
+	mailer.running++
+	mailer.busiest = max(mailer.busiest, mailer.running)
+	mailer.mutex.Unlock()
+	defer func() {
+		mailer.mutex.Lock()
+		mailer.running--
+		mailer.mutex.Unlock()
+	}()
+
+	time.Sleep(mailer.delay)
+	if call <= mailer.failures {
+		return mailer.err
+	}
+	return mailer.CapturingMailer.Send(from, to, message)
+}
+
+// statuses collects what OnStatus reports
+type statuses struct {
+	mutex   sync.Mutex
+	updates []store.OutboxEmail
+	changed chan struct{}
+}
+
+func newTestOutbox(dataStore store.Store, mailer Mailer) (*Outbox, *statuses) {
+	reported := &statuses{changed: make(chan struct{}, 100)}
+	outbox := NewOutbox(dataStore, mailer)
+	outbox.RetryDelay = 5 * time.Millisecond
+	outbox.MaxRetryDelay = 20 * time.Millisecond
+	outbox.PollInterval = 5 * time.Millisecond
+	outbox.OnStatus = func(email store.OutboxEmail) {
+		reported.mutex.Lock()
+		reported.updates = append(reported.updates, email)
+		reported.mutex.Unlock()
+		reported.changed <- struct{}{}
+	}
+	return outbox, reported
+}
+
+// waitFor waits until count emails have finished, returning every update seen
+func (reported *statuses) waitFor(t *testing.T, count int) []store.OutboxEmail {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		reported.mutex.Lock()
+		updates := append([]store.OutboxEmail{}, reported.updates...)
+		reported.mutex.Unlock()
+		finished := 0
+		for _, update := range updates {
+			if update.Status != store.EmailPending {
+				finished++
+			}
+		}
+		if finished >= count {
+			return updates
+		}
+		select {
+		case <-reported.changed:
+		case <-deadline:
+			t.Fatalf("only %d of %d emails finished", finished, count)
+		}
+	}
+}
+
+func testEmail(netId string) store.OutboxEmail {
+	return store.OutboxEmail{
+		From:    "bot@example.edu",
+		To:      []string{netId + "@vols.utk.edu"},
+		Message: []byte("Subject: test\r\n\r\nhello " + netId + "\r\n"),
+		GuildId: "guild",
+		UserId:  "user-" + netId,
+		NetId:   netId,
+	}
+}
+
+// runOutbox starts a fresh outbox on dataStore, queues emails and waits for them to finish
+func runOutbox(t *testing.T, dataStore store.Store, mailer Mailer, configure func(*Outbox), netIds ...string) []store.OutboxEmail {
+	t.Helper()
+	outbox, reported := newTestOutbox(dataStore, mailer)
+	if configure != nil {
+		configure(outbox)
+	}
+	outbox.Start()
+	defer outbox.Stop()
+	for _, netId := range netIds {
+		if _, err := outbox.Enqueue(testEmail(netId)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reported.waitFor(t, len(netIds))
+}
+
+// testStores opens an empty store of every backend
+func testStores(t *testing.T) map[string]store.Store {
+	t.Helper()
+	dir := t.TempDir()
+	sqliteStore, err := store.NewSQLiteStore(filepath.Join(dir, "outbox.db"))
+	if err != nil {
+		t.Fatal("opening SQLite store:", err)
+	}
+	t.Cleanup(func() { sqliteStore.Close() })
+	jsonStore, err := store.NewJSONStore(filepath.Join(dir, "json"))
+	if err != nil {
+		t.Fatal("opening JSON store:", err)
+	}
+	return map[string]store.Store{
+		"memory": store.NewMemoryStore(),
+		"json":   jsonStore,
+		"sqlite": sqliteStore,
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, dataStore store.Store)
+	}{
+		{"delivered and forgotten", func(t *testing.T, dataStore store.Store) {
+			mailer := &flakyMailer{}
+			updates := runOutbox(t, dataStore, mailer, nil, "abc123")
+			due, err := dataStore.DueEmails(time.Now(), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent, err := dataStore.Emails(store.EmailSent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(updates) != 1 || updates[0].Status != store.EmailSent || updates[0].Attempts != 1 {
+				t.Errorf("updates %+v", updates)
+			}
+			if len(mailer.Sent()) != 1 || !strings.Contains(string(mailer.Sent()[0].Message), "hello abc123") {
+				t.Errorf("sent %+v", mailer.Sent())
+			}
+			if len(due) != 0 {
+				t.Errorf("still due: %+v", due)
+			}
+			if len(sent) != 1 || sent[0].Message != nil || sent[0].FinishedAt.IsZero() {
+				t.Errorf("kept %+v", sent)
+			}
+		}},
+		{"retried until delivered", func(t *testing.T, dataStore store.Store) {
+			mailer := &flakyMailer{failures: 2, err: errors.New("connection refused")}
+			updates := runOutbox(t, dataStore, mailer, nil, "retry1")
+			if len(updates) != 3 {
+				t.Fatalf("got %d updates, want 3", len(updates))
+			}
+			if updates[0].Status != store.EmailPending || updates[0].LastError != "connection refused" {
+				t.Errorf("first update %+v", updates[0])
+			}
+			if updates[1].NextAttemptAt.Sub(updates[1].CreatedAt) <= updates[0].NextAttemptAt.Sub(updates[0].CreatedAt) {
+				t.Error("backoff didn't grow")
+			}
+			if updates[2].Status != store.EmailSent || updates[2].Attempts != 3 || updates[2].LastError != "" {
+				t.Errorf("last update %+v", updates[2])
+			}
+			if len(mailer.Sent()) != 1 {
+				t.Errorf("sent %d times", len(mailer.Sent()))
+			}
+		}},
+		{"dead letter after the last attempt", func(t *testing.T, dataStore store.Store) {
+			mailer := &flakyMailer{failures: 100, err: errors.New("timeout")}
+			updates := runOutbox(t, dataStore, mailer, func(outbox *Outbox) { outbox.MaxAttempts = 3 }, "dead1")
+			dead, err := dataStore.Emails(store.EmailDead)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(updates) != 3 || updates[2].Status != store.EmailDead {
+				t.Errorf("updates %+v", updates)
+			}
+			if len(dead) != 1 || dead[0].NetId != "dead1" || dead[0].Attempts != 3 || dead[0].LastError != "timeout" || dead[0].Message == nil {
+				t.Errorf("dead letters %+v", dead)
+			}
+		}},
+		{"requeued dead letter sent again", func(t *testing.T, dataStore store.Store) {
+			runOutbox(t, dataStore, &flakyMailer{failures: 100, err: &textproto.Error{Code: 550}}, nil, "dead3")
+			dead, err := dataStore.Emails(store.EmailDead)
+			if err != nil || len(dead) != 1 {
+				t.Fatalf("dead letters %+v, %v", dead, err)
+			}
+
+			mailer := &flakyMailer{}
+			outbox, reported := newTestOutbox(dataStore, mailer)
+			if _, err := outbox.Requeue("missing"); !errors.Is(err, store.ErrEmailNotFound) {
+				t.Errorf("requeueing a missing email got %v", err)
+			}
+			requeued, err := outbox.Requeue(dead[0].Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if requeued.Status != store.EmailPending || requeued.Attempts != 0 || requeued.LastError != "" {
+				t.Errorf("requeued %+v", requeued)
+			}
+			outbox.Start()
+			defer outbox.Stop()
+			updates := reported.waitFor(t, 1)
+			if len(updates) != 1 || updates[0].Status != store.EmailSent || updates[0].Attempts != 1 {
+				t.Errorf("updates %+v", updates)
+			}
+			if len(mailer.Sent()) != 1 || !strings.Contains(string(mailer.Sent()[0].Message), "hello dead3") {
+				t.Errorf("sent %+v", mailer.Sent())
+			}
+		}},
+		{"refused emails aren't retried", func(t *testing.T, dataStore store.Store) {
+			mailer := &flakyMailer{failures: 100, err: &textproto.Error{Code: 550, Msg: "no such user"}}
+			updates := runOutbox(t, dataStore, mailer, nil, "nouser")
+			if len(updates) != 1 || updates[0].Status != store.EmailDead || updates[0].Attempts != 1 {
+				t.Errorf("updates %+v", updates)
+			}
+		}},
+		{"workers send at the same time", func(t *testing.T, dataStore store.Store) {
+			mailer := &flakyMailer{delay: 20 * time.Millisecond}
+			netIds := []string{"w1", "w2", "w3", "w4", "w5", "w6", "w7", "w8"}
+			runOutbox(t, dataStore, mailer, func(outbox *Outbox) { outbox.Workers = 4 }, netIds...)
+			recipients := make(map[string]int)
+			for _, sent := range mailer.Sent() {
+				recipients[sent.To[0]]++
+			}
+			if len(recipients) != len(netIds) || len(mailer.Sent()) != len(netIds) {
+				t.Errorf("sent %v", recipients)
+			}
+			if mailer.busiest <= 1 || mailer.busiest > 4 {
+				t.Errorf("%d sends at once", mailer.busiest)
+			}
+		}},
+		{"pending emails survive a restart", func(t *testing.T, dataStore store.Store) {
+			// queue without starting, as if the bot stopped before sending
+			stopped, _ := newTestOutbox(dataStore, &flakyMailer{})
+			if _, err := stopped.Enqueue(testEmail("restart1")); err != nil {
+				t.Fatal(err)
+			}
+			mailer := &flakyMailer{}
+			outbox, reported := newTestOutbox(dataStore, mailer)
+			outbox.Start()
+			defer outbox.Stop()
+			updates := reported.waitFor(t, 1)
+			if len(mailer.Sent()) != 1 || updates[0].NetId != "restart1" {
+				t.Errorf("updates %+v", updates)
+			}
+		}},
+		{"finished emails pruned", func(t *testing.T, dataStore store.Store) {
+			runOutbox(t, dataStore, &flakyMailer{}, nil, "sent1", "sent2")
+			runOutbox(t, dataStore, &flakyMailer{failures: 100, err: &textproto.Error{Code: 550}}, nil, "dead2")
+			removed, err := dataStore.DeleteEmails(store.EmailSent, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent, err := dataStore.Emails(store.EmailSent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dead, err := dataStore.Emails(store.EmailDead)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 2 || len(sent) != 0 {
+				t.Errorf("removed %d, %d left", removed, len(sent))
+			}
+			if len(dead) != 1 {
+				t.Errorf("%d dead letters, want 1", len(dead))
+			}
+		}},
+		{"verification email queued for the interaction", func(t *testing.T, dataStore store.Store) {
+			templates, err := LoadEmailTemplates("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mailer := &flakyMailer{}
+			outbox, reported := newTestOutbox(dataStore, mailer)
+			service := NewAuthService(outbox, "bot@example.edu", templates)
+			queued, err := service.QueueAuthEmail(NewPreAuthUser("user1", "guild", "vol42", ""), "https://auth.example.edu/verify?token=t",
+				EmailOverrides{CourseName: "COSC 202"}, &discordgo.Interaction{AppID: "app", Token: "interaction-token"}, "\nnote")
+			if err != nil {
+				t.Fatal(err)
+			}
+			outbox.Start()
+			defer outbox.Stop()
+			updates := reported.waitFor(t, 1)
+			message := string(mailer.Sent()[0].Message)
+			if queued.ApplicationId != "app" || queued.InteractionToken != "interaction-token" || queued.Note != "\nnote" {
+				t.Errorf("queued %+v", queued)
+			}
+			if updates[0].Id != queued.Id || updates[0].UserId != "user1" || updates[0].GuildId != "guild" {
+				t.Errorf("updates %+v", updates)
+			}
+			if !strings.Contains(message, "To: <vol42@vols.utk.edu>") || !strings.Contains(message, "COSC 202") {
+				t.Errorf("message %s", message)
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		for backend, dataStore := range testStores(t) {
+			t.Run(fmt.Sprintf("%s/%s", backend, test.name), func(t *testing.T) {
+				test.run(t, dataStore)
+			})
+		}
+	}
+}
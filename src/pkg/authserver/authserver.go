@@ -4,12 +4,22 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvasoauth"
+	"utk-auth-go/src/pkg/policy"
+	"utk-auth-go/src/pkg/signedlink"
+	"utk-auth-go/src/pkg/store"
+	"utk-auth-go/src/pkg/utils"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/joho/godotenv"
@@ -17,6 +27,10 @@ import (
 
 var mutex sync.Mutex
 var session *discordgo.Session
+var dataStore store.Store
+
+// keyring for signed verification links, nil when tokens are stored instead
+var keyring *signedlink.Keyring
 
 type ApiResponse struct {
 	Success bool        `json:"success"`
@@ -32,12 +46,6 @@ func init() {
 	}
 }
 
-// TokenData holds the token and guild ID
-type TokenData struct {
-	Token   string `json:"token"`
-	GuildID string `json:"guild_id"`
-}
-
 type TokenResponse struct {
 	Token string `json:"token"`
 }
@@ -71,27 +79,25 @@ func GenerateUserTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check if id already exists
-	{
-		mutex.Lock()
-		defer mutex.Unlock()
-		file, err := os.ReadFile("/data/tokens.json")
+	// signed links carry everything themselves, nothing to store
+	if keyring != nil {
+		token, err := keyring.Sign(signedlink.Claims{
+			UserId:    userDiscordID,
+			GuildId:   guildDiscordID,
+			CourseId:  r.URL.Query().Get("course-id"),
+			NetId:     r.URL.Query().Get("netid"),
+			ExpiresAt: time.Now().Add(tokenTTL()).Unix(),
+		})
 		if err != nil {
-			if !os.IsNotExist(err) {
-				http.Error(w, "tokens.json does not exist", http.StatusInternalServerError)
-			}
-		} else {
-			var tokens map[string]TokenData
-			err = json.Unmarshal(file, &tokens)
-			if err != nil {
-				http.Error(w, "Error parsing file", http.StatusInternalServerError)
-			}
-
-			if _, ok := tokens[userDiscordID]; ok {
-				http.Error(w, "User already has a token", http.StatusConflict)
-				return
-			}
+			log.Println("Error signing token:", err)
+			http.Error(w, "Error generating token", http.StatusInternalServerError)
+			return
 		}
+
+		response := ApiResponse{Success: true, Message: "Token generated successfully", Data: TokenResponse{Token: token}}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
 	token, err := generateToken()
@@ -101,45 +107,37 @@ func GenerateUserTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read the existing tokens
-	var tokens map[string]TokenData
-	{
-		mutex.Lock()
-		defer mutex.Unlock()
-		file, err := os.ReadFile("/data/tokens.json")
-		if err != nil {
-			if !os.IsNotExist(err) {
-				http.Error(w, "Error reading file", http.StatusInternalServerError)
-				return
-			}
-			file = []byte("{}") // If the file does not exist, start with an empty JSON object
-		}
+	now := time.Now()
+	tokenData := store.TokenData{
+		Token:     token,
+		GuildID:   guildDiscordID,
+		CourseID:  r.URL.Query().Get("course-id"),
+		NetID:     r.URL.Query().Get("netid"),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(tokenTTL()),
+	}
 
-		err = json.Unmarshal(file, &tokens)
-		if err != nil {
-			http.Error(w, "Error parsing file", http.StatusInternalServerError)
-			return
+	// store the token, unless the user already has a live one pending
+	err = dataStore.CreateToken(userDiscordID, tokenData)
+	if err == store.ErrTokenExists {
+		existing, err := dataStore.Token(userDiscordID)
+		if err == nil && existing != nil && existing.Expired(now) {
+			// the old link is dead anyway, replace it so "run /auth again" works
+			if err = dataStore.DeleteToken(userDiscordID); err == nil {
+				err = dataStore.CreateToken(userDiscordID, tokenData)
+			}
+		} else if err == nil {
+			err = store.ErrTokenExists
 		}
 	}
-
-	// Add or update the token for the user
-	tokens[userDiscordID] = TokenData{Token: token, GuildID: guildDiscordID}
-
-	// Write the updated tokens back to the file
-	updatedData, err := json.Marshal(tokens)
-	if err != nil {
-		http.Error(w, "Error marshalling JSON", http.StatusInternalServerError)
+	if err == store.ErrTokenExists {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ApiResponse{Success: false, Message: "User already has a token, check your email for the existing link"})
+		return
+	} else if err != nil {
+		http.Error(w, "Error saving token", http.StatusInternalServerError)
 		return
-	}
-
-	{
-		mutex.Lock()
-		defer mutex.Unlock()
-		err = os.WriteFile("/data/tokens.json", updatedData, 0644)
-		if err != nil {
-			http.Error(w, "Error writing to file", http.StatusInternalServerError)
-			return
-		}
 	}
 
 	response := ApiResponse{Success: true, Message: "Token generated successfully", Data: TokenResponse{Token: token}}
@@ -159,6 +157,18 @@ func VerifyHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// don't offer a button for a link that can no longer work
+		if keyring != nil {
+			if _, err := keyring.Verify(token, time.Now()); err == signedlink.ErrExpired {
+				renderExpiredPage(w)
+				return
+			}
+		} else if tokenData, err := dataStore.Token(userDiscordID); err == nil && tokenData != nil &&
+			tokenData.Token == token && tokenData.Expired(time.Now()) {
+			renderExpiredPage(w)
+			return
+		}
+
 		// Load HTML content from file
 		htmlContent, err := os.ReadFile("./static/verify.html")
 		if err != nil {
@@ -190,77 +200,485 @@ func VerifyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var tokens map[string]TokenData
-	{
+	if keyring != nil {
+		claims, err := keyring.Verify(token, time.Now())
+		if err == signedlink.ErrExpired {
+			log.Println("Expired signed token used by user:", userDiscordID)
+			renderExpiredPage(w)
+		} else if err != nil || claims.UserId != userDiscordID {
+			log.Println("Rejected signed token for user:", userDiscordID, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(ApiResponse{Success: false, Message: "Invalid token"})
+		} else if claims.NetId == "" {
+			log.Println("Signed token without a NetID used by user:", userDiscordID)
+			renderOutdatedPage(w)
+		} else if err := dataStore.UseNonce(claims.Nonce, time.Unix(claims.ExpiresAt, 0)); err == store.ErrNonceUsed {
+			log.Println("Reused signed token for user:", userDiscordID)
+			renderUsedPage(w)
+		} else if err != nil {
+			log.Println("Error recording signed token nonce:", err)
+			http.Error(w, "Error reading token", http.StatusInternalServerError)
+		} else if !grantCourseRoles(w, userDiscordID, claims.GuildId, claims.CourseId, claims.NetId) {
+			// nothing was granted, release the nonce so the link works once staff sort it out
+			if err := dataStore.ReleaseNonce(claims.Nonce); err != nil {
+				log.Println("Error releasing signed token nonce:", err)
+			}
+		}
+		return
+	}
+
+	// tokens are single use, taking it means a second submission can't also pass
+	tokenData, err := dataStore.TakeToken(userDiscordID, token)
+	if err != nil {
+		http.Error(w, "Error reading token", http.StatusInternalServerError)
+		return
+	}
+
+	if tokenData == nil {
+		if pending, err := dataStore.Token(userDiscordID); err != nil {
+			http.Error(w, "Error reading token", http.StatusInternalServerError)
+		} else if pending != nil {
+			json.NewEncoder(w).Encode(ApiResponse{Success: false, Message: "Invalid token"})
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			http.Error(w, "User not found", http.StatusNotFound)
+		}
+	} else if tokenData.Expired(time.Now()) {
+		log.Println("Expired token used by user:", userDiscordID)
+		renderExpiredPage(w)
+	} else if tokenData.NetID == "" {
+		log.Println("Token without a NetID used by user:", userDiscordID)
+		renderOutdatedPage(w)
+	} else if !grantCourseRoles(w, userDiscordID, tokenData.GuildID, tokenData.CourseID, tokenData.NetID) {
+		// nothing was granted, put the token back so the link works once staff sort it out
+		if err := dataStore.CreateToken(userDiscordID, *tokenData); err != nil && err != store.ErrTokenExists {
+			log.Println("Error restoring token:", err)
+		}
+	}
+}
+
+// verificationCourses returns the courses a verified token grants: the one it
+// was issued for, or every course of the guild the NetID is enrolled in. A
+// course the NetID has left the roster of since the link was sent grants nothing.
+func verificationCourses(guildID string, courseID string, netID string) ([]canvas.Course, error) {
+	if courseID != "" {
+		course, err := dataStore.Course(guildID, courseID)
+		if err != nil || course == nil || course.Student(netID) == nil {
+			return nil, err
+		}
+		return []canvas.Course{*course}, nil
+	}
+	return utils.StudentCourses(guildID, netID)
+}
+
+// grantCourseRoles gives a user whose token checked out the auth role and
+// section roles of each course they verified for and records which NetID they
+// verified with. It reports whether any course was granted
+func grantCourseRoles(w http.ResponseWriter, userDiscordID string, guildID string, courseID string, netID string) bool {
+	courses, err := verificationCourses(guildID, courseID, netID)
+	if err != nil {
+		log.Println("Error reading courses while verifying:", err)
+		renderPage(w, http.StatusInternalServerError, "Verification Failed",
+			"Something went wrong while looking up your course. Try again in a few minutes.")
+		return false
+	}
+	if len(courses) == 0 {
+		log.Println("No matching course is registered for guildId:", guildID)
+		renderPage(w, http.StatusNotFound, "Verification Failed",
+			"Your course is no longer registered for this Discord server, or you are no longer enrolled. Please contact course staff.")
+		return false
+	}
+
+	// previous are the records of the accounts a transfer takes the NetID from
+	var previous []store.VerifiedMember
+	// rebound are the courses the user already held the NetID in before this verification
+	rebound := make(map[string]bool)
+
+	// the binding may have changed since the link was sent. The NetID is claimed
+	// before any role is given, checking and recording it in one step so two
+	// links clicked at once can't both get past the policy
+	mode := policy.ModeFromEnv()
+	held, err := dataStore.VerifiedMembersByNetId(guildID, netID)
+	if err == nil && mode == policy.ModeTransfer {
+		courses, err = transferredCourses(guildID, userDiscordID, netID, held, courses)
+	}
+	if err != nil {
+		log.Println("Error reading the NetID's records:", err)
+		renderPage(w, http.StatusInternalServerError, "Verification Failed",
+			"Something went wrong while checking your verification status. Try again in a few minutes.")
+		return false
+	}
+	var records []store.VerifiedMember
+	for _, member := range held {
+		if member.UserId == userDiscordID {
+			rebound[member.CourseId] = true
+		}
+	}
+	for _, course := range courses {
+		records = append(records, store.VerifiedMember{
+			GuildId:    guildID,
+			NetId:      netID,
+			UserId:     userDiscordID,
+			CourseId:   course.CourseId,
+			VerifiedAt: time.Now(),
+		})
+	}
+
+	others, err := dataStore.BindVerifiedMembers(mode.BindMode(), records...)
+	if err == store.ErrNetIdBound {
+		utils.NotifyStaff(session, guildID, "NetID Conflict",
+			fmt.Sprintf("<@%s> tried to verify as `%s`, which is already linked to <@%s>. The request was refused.",
+				userDiscordID, netID, others[0].UserId))
+		renderPage(w, http.StatusConflict, "Already Linked",
+			"This NetID is already linked to another Discord account in this server. Please contact course staff if this is a mistake.")
+		return false
+	} else if err != nil {
+		log.Println("Error recording verified members:", err)
+		renderPage(w, http.StatusInternalServerError, "Verification Failed",
+			"Something went wrong while checking your verification status. Try again in a few minutes.")
+		return false
+	}
+
+	switch {
+	case len(others) == 0:
+	case mode == policy.ModeFlag:
+		utils.NotifyStaff(session, guildID, "NetID Conflict",
+			fmt.Sprintf("<@%s> verified as `%s`, which is also linked to <@%s>.",
+				userDiscordID, netID, others[0].UserId))
+	case mode == policy.ModeTransfer:
+		previous = others
+	}
+
+	var granted []string
+	var studentMessage string
+	for i := range courses {
+		course := &courses[i]
+		// the first role is the one for their enrollment type, the rest are section roles
+		roleIDs := course.StudentRoles(netID)
+		if len(roleIDs) == 0 {
+			student := course.Student(netID)
+			log.Println("No role for the enrollment of user:", userDiscordID, "in", course.CourseId)
+			studentMessage = "Your Canvas enrollment doesn't come with a role in this server. Please contact course staff."
+			utils.NotifyStaff(session, guildID, "Verification Refused",
+				fmt.Sprintf("<@%s> is a %s in %s, which gets no role. Map one with /enrollmentrole set to let them verify.",
+					userDiscordID, student.EnrollmentType, course.CourseId))
+			continue
+		}
+
+		// add role to user
+		log.Printf("Adding role for -\n"+
+			"   User ID: %s\n"+
+			"   Guild ID: %s\n"+
+			"   Role ID: %s\n",
+			userDiscordID, guildID, roleIDs[0])
+
 		mutex.Lock()
-		defer mutex.Unlock()
-		file, err := os.ReadFile("/data/tokens.json")
+		err = session.GuildMemberRoleAdd(guildID, userDiscordID, roleIDs[0])
+		mutex.Unlock()
 		if err != nil {
-			http.Error(w, "Error reading file", http.StatusInternalServerError)
-			return
+			log.Println("Error adding role to user:", err)
+			var staffMessage string
+			studentMessage, staffMessage = describeRoleError(err, roleIDs[0])
+			utils.NotifyStaff(session, guildID, "Verification Failed",
+				fmt.Sprintf("Could not give <@%s> the auth role for %s: %s", userDiscordID, course.CourseId, staffMessage))
+			continue
+		}
+
+		// section roles are extras, a failure there doesn't undo the verification
+		for _, roleID := range roleIDs[1:] {
+			mutex.Lock()
+			err = session.GuildMemberRoleAdd(guildID, userDiscordID, roleID)
+			mutex.Unlock()
+			if err != nil {
+				log.Println("Error adding section role to user:", err)
+				_, staffMessage := describeRoleError(err, roleID)
+				utils.NotifyStaff(session, guildID, "Section Role Failed",
+					fmt.Sprintf("Could not give <@%s> the section role <@&%s> for %s: %s", userDiscordID, roleID, course.CourseId, staffMessage))
+			}
+		}
+
+		granted = append(granted, course.CourseId)
+	}
+
+	releaseUngranted(guildID, userDiscordID, netID, courses, granted, rebound, previous)
+	// only now that the new account has its roles are they taken from the old one
+	if len(previous) > 0 {
+		revokeTransferred(guildID, netID, userDiscordID, previous, courses, granted)
+	}
+
+	if len(granted) == 0 {
+		renderPage(w, http.StatusBadGateway, "Verification Failed", studentMessage)
+		return false
+	}
+	log.Println("Verification successful")
+
+	message := "You've been verified for " + strings.Join(granted, ", ") + ". You can close this page and head back to Discord."
+	if studentMessage != "" {
+		message += " " + studentMessage
+	}
+	renderPage(w, http.StatusOK, "Verified", message)
+	return true
+}
+
+// describeRoleError turns a failed role grant into a message for the student
+// and a more specific one for staff
+func describeRoleError(err error, roleID string) (string, string) {
+	studentMessage := "Your email was verified, but the bot couldn't give you the course role. Course staff have been notified."
+
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil {
+		switch restErr.Message.Code {
+		case discordgo.ErrCodeUnknownRole:
+			return studentMessage, fmt.Sprintf("role `%s` no longer exists. Update the course's auth role.", roleID)
+		case discordgo.ErrCodeMissingPermissions:
+			return studentMessage, fmt.Sprintf("the bot is missing Manage Roles, or its highest role is below <@&%s>.", roleID)
+		case discordgo.ErrCodeUnknownMember:
+			return "Your Discord account is no longer a member of the course server. Rejoin it and run /auth again.",
+				"they are no longer a member of this server."
 		}
+	}
+	return studentMessage, err.Error()
+}
 
-		err = json.Unmarshal(file, &tokens)
+// transferredCourses adds the courses other accounts hold netID in to courses,
+// so a transfer moves the whole binding instead of leaving the old account
+// verified for the guild's other courses
+func transferredCourses(guildID string, userDiscordID string, netID string, members []store.VerifiedMember, courses []canvas.Course) ([]canvas.Course, error) {
+	for _, member := range members {
+		if member.UserId == userDiscordID {
+			continue
+		}
+		if slices.ContainsFunc(courses, func(course canvas.Course) bool { return course.CourseId == member.CourseId }) {
+			continue
+		}
+		course, err := dataStore.Course(guildID, member.CourseId)
 		if err != nil {
-			http.Error(w, "Error parsing file", http.StatusInternalServerError)
-			return
+			return courses, err
+		}
+		// a course that was unregistered or dropped them has nothing to move
+		if course != nil && course.Student(netID) != nil {
+			courses = append(courses, *course)
 		}
 	}
+	return courses, nil
+}
 
-	if tokenData, ok := tokens[userDiscordID]; ok {
-		if tokenData.Token == token {
-			log.Println("Verification successful")
-			json.NewEncoder(w).Encode(ApiResponse{Success: true, Message: "Verification successful"})
-
-			// add role to user
-			log.Printf("Adding role for -\n"+
-				"   User ID: %s\n"+
-				"   Guild ID: %s\n"+
-				"   Role ID: %s\n",
-				userDiscordID, tokens[userDiscordID].GuildID, os.Getenv("AUTH_ROLE_ID"))
-
-			{
-				mutex.Lock()
-				defer mutex.Unlock()
-				err := session.GuildMemberRoleAdd(tokens[userDiscordID].GuildID, userDiscordID, os.Getenv("AUTH_ROLE_ID"))
-				if err != nil {
-					log.Println("Error adding roll to user:", err)
-				}
-				log.Println("Role added successfully")
+// releaseUngranted gives up the claim on netID in the courses whose role
+// couldn't be given, unless the user already held it there, and hands a
+// transfer's records for them back to the accounts they were taken from
+func releaseUngranted(guildID string, userDiscordID string, netID string, courses []canvas.Course, granted []string, rebound map[string]bool, previous []store.VerifiedMember) {
+	for _, course := range courses {
+		if slices.Contains(granted, course.CourseId) {
+			continue
+		}
+		if !rebound[course.CourseId] {
+			if err := dataStore.DeleteVerifiedMember(guildID, course.CourseId, netID, userDiscordID); err != nil {
+				log.Println("Error releasing verified member:", err)
 			}
+		}
+		for _, member := range previous {
+			if member.CourseId != course.CourseId {
+				continue
+			}
+			if err := dataStore.PutVerifiedMembers(member); err != nil {
+				log.Println("Error restoring transferred verified member:", err)
+			}
+		}
+	}
+}
 
-			// remove key from map
-			delete(tokens, userDiscordID)
-
-			// Write the updated tokens back to the file
-			updatedData, err := json.Marshal(tokens)
+// revokeTransferred takes the roles of the granted courses away from the
+// accounts that held netID before, a course the new account didn't get stays
+// with the old one
+func revokeTransferred(guildID string, netID string, userDiscordID string, previous []store.VerifiedMember, courses []canvas.Course, granted []string) {
+	moved := make(map[string]bool)
+	for _, member := range previous {
+		if !slices.Contains(granted, member.CourseId) {
+			continue
+		}
+		index := slices.IndexFunc(courses, func(course canvas.Course) bool { return course.CourseId == member.CourseId })
+		for _, roleID := range courses[index].StudentRoles(netID) {
+			mutex.Lock()
+			err := session.GuildMemberRoleRemove(guildID, member.UserId, roleID)
+			mutex.Unlock()
 			if err != nil {
-				http.Error(w, "Error marshalling JSON", http.StatusInternalServerError)
+				log.Println("Error removing role from previous account:", err)
 			}
+		}
+		moved[member.UserId] = true
+	}
 
-			{
-				mutex.Lock()
-				defer mutex.Unlock()
-				err = os.WriteFile("/data/tokens.json", updatedData, 0644)
-			}
+	for userId := range moved {
+		utils.NotifyStaff(session, guildID, "NetID Transferred",
+			fmt.Sprintf("`%s` moved from <@%s> to <@%s>.", netID, userId, userDiscordID))
+	}
+}
+
+// CanvasCallbackHandler finishes the Canvas OAuth flow that /registercourse
+// started, turning the authorization code into tokens and showing staff the
+// course preview back in Discord
+func CanvasCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	request, err := utils.TakeConnectRequest(query.Get("state"))
+	if err != nil {
+		log.Println("Error reading Canvas connect request:", err)
+		renderPage(w, http.StatusInternalServerError, "Canvas Not Connected",
+			"Something went wrong while reading your Canvas connection. Run /registercourse again in Discord.")
+		return
+	}
+	if request == nil {
+		renderPage(w, http.StatusBadRequest, "Link Expired",
+			"This Canvas connection link has expired or was already used. Run /registercourse again in Discord.")
+		return
+	}
+
+	// tell staff in Discord as well as on the page
+	interaction := &discordgo.Interaction{AppID: request.ApplicationId, Token: request.InteractionToken}
+	fail := func(status int, message string) {
+		session.InteractionResponseEdit(interaction, &discordgo.WebhookEdit{
+			Content:    &message,
+			Embeds:     &[]*discordgo.MessageEmbed{},
+			Components: &[]discordgo.MessageComponent{},
+		})
+		renderPage(w, status, "Canvas Not Connected", message)
+	}
 
+	if query.Get("error") != "" {
+		log.Println("Canvas OAuth returned an error:", query.Get("error"))
+		fail(http.StatusForbidden, "Canvas wasn't connected because access was denied. Run /registercourse again to retry.")
+		return
+	}
+	config := canvasoauth.ConfigFromEnv()
+	if config == nil {
+		fail(http.StatusInternalServerError, "Canvas OAuth isn't set up for this bot.")
+		return
+	}
+
+	now := time.Now()
+	token, err := config.Exchange(query.Get("code"))
+	if err != nil {
+		log.Println("Error exchanging Canvas authorization code:", err)
+		fail(http.StatusBadGateway, "Canvas didn't accept the connection. Run /registercourse again to retry.")
+		return
+	}
+
+	preview, err := utils.PreviewCourse(request.GuildId, token.AccessToken, request.CourseId, request.AuthRoleId, request.StaffChannelId)
+	if err != nil {
+		log.Println("Error previewing course:", err)
+		fail(http.StatusBadRequest, utils.DescribePreviewError(err))
+		return
+	}
+	preview.Course.CanvasRefreshToken = token.RefreshToken
+	preview.Course.CanvasTokenExpiresAt = token.ExpiresAt(now)
+
+	previewId, err := utils.HoldPreview(preview)
+	if err != nil {
+		log.Println("Error holding course preview:", err)
+		fail(http.StatusInternalServerError, "Failed to register course, something went wrong.")
+		return
+	}
+	if _, err := session.InteractionResponseEdit(interaction, utils.PreviewEdit(preview, previewId)); err != nil {
+		log.Println("Error showing course preview:", err)
+	}
+	connected := "Canvas is connected."
+	if token.User.Name != "" {
+		connected = "Canvas is connected as " + token.User.Name + "."
+	}
+	renderPage(w, http.StatusOK, "Canvas Connected", connected+" Head back to Discord to confirm the course.")
+}
+
+// renderPage serves static/message.html with the given title and message
+func renderPage(w http.ResponseWriter, status int, title string, message string) {
+	htmlContent, err := os.ReadFile("./static/message.html")
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	pageContent := strings.Replace(string(htmlContent), "{{TITLE}}", html.EscapeString(title), -1)
+	pageContent = strings.Replace(pageContent, "{{MESSAGE}}", html.EscapeString(message), -1)
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	w.Write([]byte(pageContent))
+}
+
+func renderExpiredPage(w http.ResponseWriter) {
+	renderPage(w, http.StatusGone, "Link Expired",
+		"This verification link has expired. Run /auth again in Discord to get a new one.")
+}
+
+// renderOutdatedPage answers a link from before NetIDs were bound to links,
+// which can't be checked against a roster
+func renderOutdatedPage(w http.ResponseWriter) {
+	renderPage(w, http.StatusGone, "Link Outdated",
+		"This verification link is from an older version of the bot. Run /auth again in Discord to get a new one.")
+}
+
+func renderUsedPage(w http.ResponseWriter) {
+	renderPage(w, http.StatusGone, "Link Already Used",
+		"This verification link has already been used. Run /auth again in Discord to get a new one.")
+}
+
+// tokenTTL is how long a verification link stays valid, set by TOKEN_TTL (default 30m)
+func tokenTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("TOKEN_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 30 * time.Minute
+}
+
+// StartTokenSweeper removes expired tokens, used nonces and Canvas connect
+// requests from the store every interval
+func StartTokenSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for now := range ticker.C {
+			removed, err := dataStore.DeleteExpiredTokens(now)
 			if err != nil {
-				http.Error(w, "Error writing to file", http.StatusInternalServerError)
+				log.Println("Error sweeping expired tokens:", err)
+			} else if removed > 0 {
+				log.Println("Swept", removed, "expired tokens")
+			}
+			removed, err = dataStore.DeleteExpiredNonces(now)
+			if err != nil {
+				log.Println("Error sweeping used nonces:", err)
+			} else if removed > 0 {
+				log.Println("Swept", removed, "used nonces")
+			}
+			removed, err = dataStore.DeleteExpiredConnectRequests(now)
+			if err != nil {
+				log.Println("Error sweeping Canvas connect requests:", err)
+			} else if removed > 0 {
+				log.Println("Swept", removed, "expired Canvas connect requests")
 			}
-		} else {
-			json.NewEncoder(w).Encode(ApiResponse{Success: false, Message: "Invalid token"})
-			w.WriteHeader(http.StatusUnauthorized)
 		}
-	} else {
-		http.Error(w, "User not found", http.StatusNotFound)
-	}
+	}()
 }
 
-func StartServer(sessionPass *discordgo.Session) {
+func StartServer(sessionPass *discordgo.Session, storePass store.Store) {
 	session = sessionPass
+	dataStore = storePass
 	port := os.Getenv("PORT")
 	http.HandleFunc("/generate-user-token", GenerateUserTokenHandler)
 	http.HandleFunc("/verify", VerifyHandler)
+	http.HandleFunc("/canvas/callback", CanvasCallbackHandler)
+
+	// TOKEN_MODE=signed swaps stored random tokens for HMAC-signed links
+	if os.Getenv("TOKEN_MODE") == "signed" {
+		var err error
+		keyring, err = signedlink.ParseKeyring(os.Getenv("LINK_SIGNING_KEYS"))
+		if err != nil {
+			log.Fatalf("Invalid LINK_SIGNING_KEYS: %v", err)
+		}
+		log.Println("Using signed verification links")
+	}
+
+	sweepInterval, err := time.ParseDuration(os.Getenv("TOKEN_SWEEP_INTERVAL"))
+	if err != nil || sweepInterval <= 0 {
+		sweepInterval = 5 * time.Minute
+	}
+	StartTokenSweeper(sweepInterval)
 
 	fmt.Println("Server is running on port", port)
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
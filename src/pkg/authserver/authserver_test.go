@@ -0,0 +1,257 @@
+package authserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvas/canvastest"
+	"utk-auth-go/src/pkg/canvasoauth/oauthtest"
+	"utk-auth-go/src/pkg/store"
+	"utk-auth-go/src/pkg/utils"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeInteractions records the bodies of interaction response edits
+type fakeInteractions struct {
+	mutex sync.Mutex
+	edits []string
+}
+
+func (fake *fakeInteractions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	fake.mutex.Lock()
+	fake.edits = append(fake.edits, string(body))
+	fake.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"id": "1"}`))
+}
+
+func (fake *fakeInteractions) sent() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]string{}, fake.edits...)
+}
+
+// startCallback sets the package up against a fake Discord, Canvas API and
+// Canvas OAuth provider, with a memory store
+func startCallback(t *testing.T) (*fakeInteractions, *oauthtest.Fake) {
+	t.Helper()
+	interactions := &fakeInteractions{}
+	discord := httptest.NewServer(interactions)
+	t.Cleanup(discord.Close)
+	webhooks := discordgo.EndpointWebhooks
+	discordgo.EndpointWebhooks = discord.URL + "/webhooks/"
+	t.Cleanup(func() { discordgo.EndpointWebhooks = webhooks })
+
+	canvasFake, err := canvastest.New(canvastest.Fixtures)
+	if err != nil {
+		t.Fatal("loading fixtures:", err)
+	}
+	canvasServer := canvasFake.Start()
+	t.Cleanup(canvasServer.Close)
+	t.Setenv("CANVAS_BASE_URL", canvasServer.URL)
+
+	provider := oauthtest.New()
+	provider.AccessToken = canvastest.Token
+	providerServer := provider.Start()
+	t.Cleanup(providerServer.Close)
+	t.Setenv("CANVAS_OAUTH_BASE_URL", providerServer.URL)
+	t.Setenv("CANVAS_OAUTH_CLIENT_ID", oauthtest.ClientId)
+	t.Setenv("CANVAS_OAUTH_CLIENT_SECRET", oauthtest.ClientSecret)
+
+	session, err = discordgo.New("Bot test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore = store.NewMemoryStore()
+	utils.SetStore(dataStore)
+	return interactions, provider
+}
+
+func TestCanvasCallbackHandler(t *testing.T) {
+	request := store.ConnectRequest{GuildId: "guild", CourseId: "1001", AuthRoleId: "role", ApplicationId: "app", InteractionToken: "interaction"}
+
+	tests := []struct {
+		name string
+		// expired holds the request as already expired, missing doesn't hold it at all
+		expired  bool
+		missing  bool
+		noConfig bool
+		// query is added to the callback's state, code is filled in from the fake if it's "valid"
+		query      url.Values
+		wantStatus int
+		// wantEdit is in the interaction edit, empty when there shouldn't be one
+		wantEdit string
+	}{
+		{name: "connected", query: url.Values{"code": {"valid"}}, wantStatus: http.StatusOK, wantEdit: "Register"},
+		{name: "unknown state", missing: true, query: url.Values{"code": {"valid"}}, wantStatus: http.StatusBadRequest},
+		{name: "expired state", expired: true, query: url.Values{"code": {"valid"}}, wantStatus: http.StatusBadRequest},
+		{name: "access denied", query: url.Values{"error": {"access_denied"}}, wantStatus: http.StatusForbidden, wantEdit: "access was denied"},
+		{name: "bad code", query: url.Values{"code": {"made-up"}}, wantStatus: http.StatusBadGateway, wantEdit: "didn't accept"},
+		{name: "no developer key", noConfig: true, query: url.Values{"code": {"valid"}}, wantStatus: http.StatusInternalServerError, wantEdit: "isn't set up"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			interactions, provider := startCallback(t)
+			if test.noConfig {
+				t.Setenv("CANVAS_OAUTH_CLIENT_ID", "")
+			}
+			state := "unknown"
+			if !test.missing {
+				held := request
+				held.ExpiresAt = time.Now().Add(time.Hour)
+				if test.expired {
+					held.ExpiresAt = time.Now().Add(-time.Minute)
+				}
+				state = "state"
+				if err := dataStore.PutConnectRequest(state, held); err != nil {
+					t.Fatal(err)
+				}
+			}
+			query := url.Values{"state": {state}}
+			for key, values := range test.query {
+				query[key] = values
+			}
+			if query.Get("code") == "valid" {
+				query.Set("code", provider.Code())
+			}
+
+			callback := func() *httptest.ResponseRecorder {
+				recorder := httptest.NewRecorder()
+				CanvasCallbackHandler(recorder, httptest.NewRequest(http.MethodGet, "/canvas/callback?"+query.Encode(), nil))
+				return recorder
+			}
+			recorder := callback()
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body)
+			}
+
+			edits := interactions.sent()
+			if test.wantEdit == "" {
+				if len(edits) != 0 {
+					t.Errorf("edited the interaction %d times", len(edits))
+				}
+				return
+			}
+			if len(edits) != 1 {
+				t.Fatalf("edited the interaction %d times", len(edits))
+			}
+			if !strings.Contains(edits[0], test.wantEdit) {
+				t.Errorf("edit %s is missing %q", edits[0], test.wantEdit)
+			}
+
+			// the state only works once
+			if again := callback(); again.Code != http.StatusBadRequest {
+				t.Errorf("second callback got status %d", again.Code)
+			}
+		})
+	}
+}
+
+func TestCanvasCallbackHoldsToken(t *testing.T) {
+	interactions, provider := startCallback(t)
+	err := dataStore.PutConnectRequest("state", store.ConnectRequest{GuildId: "guild", CourseId: "1001", AuthRoleId: "role",
+		ApplicationId: "app", InteractionToken: "interaction", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	query := url.Values{"state": {"state"}, "code": {provider.Code()}}
+	CanvasCallbackHandler(recorder, httptest.NewRequest(http.MethodGet, "/canvas/callback?"+query.Encode(), nil))
+	if !strings.Contains(recorder.Body.String(), "connected as "+oauthtest.UserName) {
+		t.Errorf("page is %s", recorder.Body)
+	}
+
+	edits := interactions.sent()
+	if len(edits) != 1 {
+		t.Fatalf("edits %q", edits)
+	}
+	_, previewId, _ := strings.Cut(edits[0], utils.RegisterConfirmId+":")
+	previewId, _, _ = strings.Cut(previewId, `"`)
+	preview := utils.TakePreview(previewId)
+	if preview == nil {
+		t.Fatalf("no preview held for %q", previewId)
+	}
+	course := preview.Course
+	if course.CanvasSecret != canvastest.Token || course.CanvasRefreshToken == "" || !course.CanvasTokenExpiresAt.After(time.Now()) {
+		t.Errorf("held course is %+v", course)
+	}
+}
+
+func TestVerificationCourses(t *testing.T) {
+	startCallback(t)
+	for _, course := range []canvas.Course{
+		{GuildId: "guild", CourseId: "1001", AuthRoleId: "role", Students: []canvas.Student{{NetId: "abc123"}}},
+		{GuildId: "guild", CourseId: "1002", AuthRoleId: "role", Students: []canvas.Student{{NetId: "abc123"}, {NetId: "def456"}}},
+	} {
+		if err := dataStore.AddCourse(course); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		courseId string
+		netId    string
+		want     []string
+	}{
+		{name: "enrolled", courseId: "1001", netId: "abc123", want: []string{"1001"}},
+		{name: "not on the roster", courseId: "1001", netId: "def456"},
+		{name: "unregistered course", courseId: "1003", netId: "abc123"},
+		{name: "every course of the guild", netId: "abc123", want: []string{"1001", "1002"}},
+		{name: "one course of the guild", netId: "def456", want: []string{"1002"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			courses, err := verificationCourses("guild", test.courseId, test.netId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, course := range courses {
+				got = append(got, course.CourseId)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenWithoutNetId(t *testing.T) {
+	startCallback(t)
+	if err := dataStore.AddCourse(canvas.Course{GuildId: "guild", CourseId: "1001", AuthRoleId: "role"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// a link from before NetIDs were bound to tokens
+	err := dataStore.CreateToken("user1", store.TokenData{Token: "legacy", GuildID: "guild", IssuedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"user-discord-id": {"user1"}, "token": {"legacy"}}
+	request := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	VerifyHandler(recorder, request)
+	if recorder.Code != http.StatusGone {
+		t.Errorf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	if members, _ := dataStore.VerifiedMembersByUser("guild", "user1"); len(members) != 0 {
+		t.Errorf("verified %+v", members)
+	}
+	if pending, _ := dataStore.Token("user1"); pending != nil {
+		t.Errorf("token is still pending: %+v", pending)
+	}
+}
@@ -1,95 +1,348 @@
 package canvas
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Student struct {
 	NetId string `json:"netId"`
-	Name  string `json:"name"`
+	// Name is the full name as Canvas shows it
+	Name string `json:"name"`
+	// SortableName is e.g. "Hopper, Grace" and ShortName the name the user goes by
+	SortableName string    `json:"sortableName,omitempty"`
+	ShortName    string    `json:"shortName,omitempty"`
+	CanvasUserId int       `json:"canvasUserId,omitempty"`
+	SisUserId    string    `json:"sisUserId,omitempty"`
+	Sections     []Section `json:"sections,omitempty"`
+	// EnrollmentType is the Canvas enrollment type, e.g. StudentEnrollment or TaEnrollment
+	EnrollmentType string `json:"enrollmentType,omitempty"`
+	// EnrollmentRole is the Canvas role name, which differs from the type for custom roles
+	EnrollmentRole string `json:"enrollmentRole,omitempty"`
+}
+
+// Canvas enrollment types
+const (
+	StudentEnrollment  = "StudentEnrollment"
+	TaEnrollment       = "TaEnrollment"
+	TeacherEnrollment  = "TeacherEnrollment"
+	DesignerEnrollment = "DesignerEnrollment"
+	ObserverEnrollment = "ObserverEnrollment"
+)
+
+// enrollmentRank orders enrollment types so someone enrolled more than once is
+// treated as their most privileged enrollment
+var enrollmentRank = map[string]int{
+	ObserverEnrollment: 1,
+	StudentEnrollment:  2,
+	DesignerEnrollment: 3,
+	TaEnrollment:       4,
+	TeacherEnrollment:  5,
+}
+
+// Section is a Canvas course section, usually a lab
+type Section struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
 }
 
 type Course struct {
-	GuildId      string    `json:"guildId"`
-	CanvasSecret string    `json:"canvasSecret"`
-	CourseId     string    `json:"courseId"`
-	Students     []Student `json:"students"`
-	AuthRoleId   string    `json:"authRoleId"`
+	GuildId        string    `json:"guildId"`
+	CanvasSecret   string    `json:"canvasSecret"`
+	CourseId       string    `json:"courseId"`
+	Students       []Student `json:"students"`
+	AuthRoleId     string    `json:"authRoleId"`
+	StaffChannelId string    `json:"staffChannelId,omitempty"`
+	// SectionRoles maps a Canvas section ID to the Discord role its students get
+	SectionRoles map[string]string `json:"sectionRoles,omitempty"`
+	// EnrollmentRoles maps a Canvas enrollment type to the Discord role it gets
+	// in place of AuthRoleId
+	EnrollmentRoles map[string]string `json:"enrollmentRoles,omitempty"`
+	// DropPolicy decides what happens to a verified member who leaves the Canvas course
+	DropPolicy   string `json:"dropPolicy,omitempty"`
+	AlumniRoleId string `json:"alumniRoleId,omitempty"`
+	// DropDryRun only reports what DropPolicy would do
+	DropDryRun bool `json:"dropDryRun,omitempty"`
+	// StaffRoleIds may use the admin commands for this course without Manage Server
+	StaffRoleIds []string `json:"staffRoleIds,omitempty"`
+	// CanvasRefreshToken and CanvasTokenExpiresAt are only set when CanvasSecret
+	// is an access token from the OAuth flow
+	CanvasRefreshToken   string    `json:"canvasRefreshToken,omitempty"`
+	CanvasTokenExpiresAt time.Time `json:"canvasTokenExpiresAt"`
+	// EmailSubject, EmailCourseName and EmailSignature replace the defaults in
+	// the verification email when set
+	EmailSubject    string `json:"emailSubject,omitempty"`
+	EmailCourseName string `json:"emailCourseName,omitempty"`
+	EmailSignature  string `json:"emailSignature,omitempty"`
 }
 
-// Enrollment represents the structure of the enrollment data in the JSON response
-type Enrollment struct {
-	User struct {
-		LoginID string `json:"login_id"`
-		Name    string `json:"name"`
-	} `json:"user"`
-}
-
-func getNextURL(linkHeader string) string {
-	links := strings.Split(linkHeader, ",")
-	for _, link := range links {
-		parts := strings.Split(link, ";")
-		if len(parts) == 2 && strings.TrimSpace(parts[1]) == `rel="next"` {
-			nextURL := strings.Trim(parts[0], "<>")
-			return nextURL
+// drop policies, a course without one reports drops
+const (
+	// DropReport tells staff and leaves the member's roles alone
+	DropReport = "report"
+	// DropRemove takes the course's roles away
+	DropRemove = "remove"
+	// DropAlumni takes the course's roles away and gives the alumni role
+	DropAlumni = "alumni"
+)
+
+// EnrollmentRoleId returns the role for an enrollment type, DefaultRoleId unless
+// the type has its own. It is empty when the enrollment gets no role
+func (course Course) EnrollmentRoleId(enrollmentType string) string {
+	if roleId, ok := course.EnrollmentRoles[enrollmentType]; ok && roleId != "" {
+		return roleId
+	}
+	return course.DefaultRoleId(enrollmentType)
+}
+
+// DefaultRoleId returns the role an enrollment type gets without a mapping:
+// AuthRoleId, except observers and designers aren't taking the course and get
+// nothing until staff map them a role
+func (course Course) DefaultRoleId(enrollmentType string) string {
+	switch enrollmentType {
+	case ObserverEnrollment, DesignerEnrollment:
+		return ""
+	}
+	return course.AuthRoleId
+}
+
+// Student returns the roster entry for netId, or nil if they aren't enrolled
+func (course Course) Student(netId string) *Student {
+	for _, student := range course.Students {
+		if student.NetId == netId {
+			return &student
 		}
 	}
-	return ""
+	return nil
 }
 
-func GetCourseStudents(courseId string, canvasSecret string) ([]Student, error) {
-	var students []Student
-	url := fmt.Sprintf("https://canvas.instructure.com/api/v1/courses/%s/enrollments?per_page=100", courseId)
+// StudentRoles returns every role a verified netId gets in the course: the role
+// of their enrollment type first, then the role of each of their mapped sections.
+// It is empty when their enrollment gets no role or they aren't on the roster
+func (course Course) StudentRoles(netId string) []string {
+	student := course.Student(netId)
+	if student == nil {
+		return nil
+	}
+	return course.RolesFor(*student)
+}
 
-	for url != "" {
-		request, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			log.Println("Error generating Canvas API request for GetCourseStudents:", err)
-			return nil, err
+// RolesFor returns the roles of a roster entry, which may have left the roster since
+func (course Course) RolesFor(student Student) []string {
+	roleId := course.EnrollmentRoleId(student.EnrollmentType)
+	if roleId == "" {
+		return nil
+	}
+	roles := []string{roleId}
+	for _, section := range student.Sections {
+		if roleId, ok := course.SectionRoles[section.Id]; ok && roleId != "" {
+			roles = append(roles, roleId)
 		}
+	}
+	return roles
+}
 
-		request.Header.Add("Authorization", "Bearer "+canvasSecret)
-		client := &http.Client{}
-		response, err := client.Do(request)
-		if err != nil {
-			log.Println("Error sending request to Canvas API while getting course students:", err)
-			return nil, err
+// Sections returns every section that appears in the course's roster
+func (course Course) Sections() []Section {
+	seen := make(map[string]bool)
+	var sections []Section
+	for _, student := range course.Students {
+		for _, section := range student.Sections {
+			if !seen[section.Id] {
+				seen[section.Id] = true
+				sections = append(sections, section)
+			}
 		}
-		defer response.Body.Close()
+	}
+	return sections
+}
+
+// Enrollment represents the structure of the enrollment data in the JSON response
+type Enrollment struct {
+	Id              int    `json:"id"`
+	CourseSectionId int    `json:"course_section_id"`
+	Type            string `json:"type"`
+	Role            string `json:"role"`
+	User            User   `json:"user"`
+}
+
+// User represents the structure of the user data in the JSON response
+type User struct {
+	Id           int    `json:"id"`
+	Name         string `json:"name"`
+	SortableName string `json:"sortable_name"`
+	ShortName    string `json:"short_name"`
+	LoginId      string `json:"login_id"`
+	SisUserId    string `json:"sis_user_id"`
+}
 
-		body, err := io.ReadAll(response.Body)
-		if err != nil {
-			log.Println("Error reading response from Canvas API while getting course students:", err)
-			return nil, err
+// DisplayName is the user's full name, falling back on the other names Canvas
+// has for them and finally the login ID
+func (user User) DisplayName() string {
+	if name := strings.Join(strings.Fields(user.Name), " "); name != "" {
+		return name
+	}
+	if name := strings.Join(strings.Fields(user.ShortName), " "); name != "" {
+		return name
+	}
+	// "Last, First" reads better turned around
+	if last, first, ok := strings.Cut(user.SortableName, ","); ok && strings.TrimSpace(first) != "" {
+		return strings.Join(strings.Fields(first+" "+last), " ")
+	}
+	if name := strings.Join(strings.Fields(user.SortableName), " "); name != "" {
+		return name
+	}
+	return strings.TrimSpace(user.LoginId)
+}
+
+// SkippedEnrollment is an enrollment left off the roster because it can't be
+// matched to a NetID
+type SkippedEnrollment struct {
+	EnrollmentId int
+	CanvasUserId int
+	Name         string
+	Reason       string
+}
+
+func (skipped SkippedEnrollment) String() string {
+	who := skipped.Name
+	if who == "" {
+		who = fmt.Sprintf("Canvas user %d", skipped.CanvasUserId)
+	}
+	return fmt.Sprintf("%s (enrollment %d): %s", who, skipped.EnrollmentId, skipped.Reason)
+}
+
+// CanvasSection represents the structure of the section data in the JSON response
+type CanvasSection struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// CourseInfo represents the structure of the course data in the JSON response
+type CourseInfo struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	CourseCode string `json:"course_code"`
+	Term       struct {
+		Name string `json:"name"`
+	} `json:"term"`
+	// Enrollments are the token user's own enrollments in the course
+	Enrollments []struct {
+		Type string `json:"type"`
+		Role string `json:"role"`
+	} `json:"enrollments"`
+}
+
+// TeachesCourse reports whether the token's user is a teacher or TA in the course
+func (info CourseInfo) TeachesCourse() bool {
+	for _, enrollment := range info.Enrollments {
+		switch enrollment.Type {
+		case "teacher", "ta", TeacherEnrollment, TaEnrollment:
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ErrUnauthorized = errors.New("Canvas rejected the API secret")
+	ErrForbidden    = errors.New("Canvas does not let the token's user see this")
+	ErrNotFound     = errors.New("Canvas could not find the course")
+	ErrThrottled    = errors.New("Canvas is rate limiting requests")
+	ErrUnavailable  = errors.New("Canvas is not responding")
+)
+
+// GetCourse looks up a course as the token's user sees it
+func GetCourse(courseId string, canvasSecret string) (*CourseInfo, error) {
+	info, err := NewClient(canvasSecret).Course(courseId)
+	if err != nil {
+		log.Println("Error getting course from Canvas API:", err)
+		return nil, err
+	}
+	return info, nil
+}
+
+// GetCourseSections returns the names of the course's sections keyed by section ID
+func GetCourseSections(courseId string, canvasSecret string) (map[string]string, error) {
+	sections, err := NewClient(canvasSecret).Sections(courseId)
+	if err != nil {
+		log.Println("Error getting course sections from Canvas API:", err)
+		return nil, err
+	}
+	sectionNames := make(map[string]string)
+	for _, section := range sections {
+		sectionNames[strconv.Itoa(section.Id)] = section.Name
+	}
+	return sectionNames, nil
+}
+
+// GetCourseStudents fetches the course's roster, merging each user's
+// enrollments. Enrollments that can't be used are returned separately so they
+// can be reported instead of failing the whole roster.
+func GetCourseStudents(courseId string, canvasSecret string) ([]Student, []SkippedEnrollment, error) {
+	// section names are nice to have, a roster without them still works
+	sectionNames, err := GetCourseSections(courseId, canvasSecret)
+	if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrThrottled) {
+		// the enrollments would fail the same way
+		return nil, nil, err
+	} else if err != nil {
+		sectionNames = make(map[string]string)
+	}
+
+	var students []Student
+	var skipped []SkippedEnrollment
+	// a student enrolled in several sections has one enrollment per section
+	studentIndex := make(map[string]int)
+	enrollments, err := NewClient(canvasSecret).Enrollments(courseId)
+	if err != nil {
+		log.Println("Error getting course students from Canvas API:", err)
+		return nil, nil, err
+	}
+
+	for _, enrollment := range enrollments {
+		user := enrollment.User
+		netId := strings.TrimSpace(user.LoginId)
+		if netId == "" {
+			skipped = append(skipped, SkippedEnrollment{
+				EnrollmentId: enrollment.Id,
+				CanvasUserId: user.Id,
+				Name:         strings.Join(strings.Fields(user.Name), " "),
+				Reason:       "no login ID, so it can't be matched to a NetID",
+			})
+			continue
 		}
 
-		var enrollments []Enrollment
-		err = json.Unmarshal(body, &enrollments)
-		if err != nil {
-			log.Println("Error unmarshalling response from Canvas API while getting course students:", err)
-			return nil, err
+		i, ok := studentIndex[netId]
+		if !ok {
+			students = append(students, Student{
+				NetId:        netId,
+				Name:         user.DisplayName(),
+				SortableName: strings.TrimSpace(user.SortableName),
+				ShortName:    strings.TrimSpace(user.ShortName),
+				CanvasUserId: user.Id,
+				SisUserId:    strings.TrimSpace(user.SisUserId),
+			})
+			i = len(students) - 1
+			studentIndex[netId] = i
+		}
+		if enrollmentRank[enrollment.Type] > enrollmentRank[students[i].EnrollmentType] {
+			students[i].EnrollmentType = enrollment.Type
+			students[i].EnrollmentRole = enrollment.Role
 		}
 
-		for _, enrollment := range enrollments {
-			words := strings.Fields(enrollment.User.Name)
-			netId := enrollment.User.LoginID
-			name := words[0] + " " + words[len(words)-1]
-			students = append(students, Student{NetId: netId, Name: name})
+		if enrollment.CourseSectionId != 0 {
+			sectionId := strconv.Itoa(enrollment.CourseSectionId)
+			students[i].Sections = append(students[i].Sections, Section{Id: sectionId, Name: sectionNames[sectionId]})
 		}
-		url = getNextURL(response.Header.Get("Link"))
 	}
 
-	// Name field contains only the first and last words
-	for i, student := range students {
-		words := strings.Fields(student.Name)
-		students[i].Name = words[0] + " " + words[len(words)-1]
+	for _, enrollment := range skipped {
+		log.Println("Skipped Canvas enrollment in course", courseId+":", enrollment)
 	}
-
-	log.Println(len(students), "registered to server_config.json")
-	return students, nil
+	log.Println("Fetched", len(students), "students of course", courseId, "from Canvas")
+	return students, skipped, nil
 }
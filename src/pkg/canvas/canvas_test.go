@@ -0,0 +1,100 @@
+package canvas_test
+
+import (
+	"reflect"
+	"testing"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvas/canvastest"
+)
+
+func TestGetCourseStudents(t *testing.T) {
+	startFake(t)
+
+	t.Run("students merged across sections", func(t *testing.T) {
+		students, skipped, err := canvas.GetCourseStudents("1001", canvastest.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byNetId := make(map[string]canvas.Student)
+		for _, student := range students {
+			byNetId[student.NetId] = student
+		}
+		if len(students) != 28 || len(skipped) != 0 {
+			t.Errorf("got %d students, skipped %v", len(students), skipped)
+		}
+		if ta := byNetId["aturing2"]; ta.EnrollmentType != canvas.TaEnrollment || len(ta.Sections) != 2 {
+			t.Errorf("TA is %+v", ta)
+		}
+		if honors := byNetId["bbrook2"]; len(honors.Sections) != 2 || honors.Sections[1].Name != "COSC 202 - Honors Lab" {
+			t.Errorf("student in two sections is %+v", honors)
+		}
+	})
+
+	t.Run("names kept whole and malformed enrollments skipped", func(t *testing.T) {
+		students, skipped, err := canvas.GetCourseStudents("1004", canvastest.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(students) != 5 || len(skipped) != 2 {
+			t.Fatalf("got %d students, skipped %v", len(students), skipped)
+		}
+		names := make(map[string]string)
+		for _, student := range students {
+			names[student.NetId] = student.Name
+		}
+		for _, want := range []struct{ netId, name string }{
+			{"ghopper1", "Grace Brewster Hopper"},
+			{"mgarci1", "María José García-López"},
+			{"ssmith5", "Sam"},
+			{"jdoe12", "Jane Doe"},
+			{"nonam1", "nonam1"},
+		} {
+			if names[want.netId] != want.name {
+				t.Errorf("name of %s is %q, want %q", want.netId, names[want.netId], want.name)
+			}
+		}
+		garcia := students[1]
+		if garcia.SortableName != "García-López, María José" || garcia.ShortName != "Majo" || garcia.CanvasUserId != 200 || garcia.SisUserId != "000000200" {
+			t.Errorf("profile is %+v", garcia)
+		}
+	})
+}
+
+func TestStudentRoles(t *testing.T) {
+	course := canvas.Course{
+		AuthRoleId:   "auth",
+		SectionRoles: map[string]string{"11": "lab"},
+		Students: []canvas.Student{
+			{NetId: "student", EnrollmentType: canvas.StudentEnrollment, Sections: []canvas.Section{{Id: "11"}}},
+			{NetId: "old", Sections: []canvas.Section{{Id: "12"}}},
+			{NetId: "ta", EnrollmentType: canvas.TaEnrollment},
+			{NetId: "observer", EnrollmentType: canvas.ObserverEnrollment, Sections: []canvas.Section{{Id: "11"}}},
+			{NetId: "designer", EnrollmentType: canvas.DesignerEnrollment},
+		},
+	}
+	mapped := course
+	mapped.EnrollmentRoles = map[string]string{canvas.TaEnrollment: "ta-role", canvas.ObserverEnrollment: "observer-role"}
+
+	tests := []struct {
+		name   string
+		course canvas.Course
+		netId  string
+		roles  []string
+	}{
+		{name: "student with a section", course: course, netId: "student", roles: []string{"auth", "lab"}},
+		{name: "roster from before enrollment types", course: course, netId: "old", roles: []string{"auth"}},
+		{name: "unmapped TA", course: course, netId: "ta", roles: []string{"auth"}},
+		{name: "mapped TA", course: mapped, netId: "ta", roles: []string{"ta-role"}},
+		{name: "unmapped observer", course: course, netId: "observer", roles: nil},
+		{name: "mapped observer", course: mapped, netId: "observer", roles: []string{"observer-role", "lab"}},
+		{name: "unmapped designer", course: mapped, netId: "designer", roles: nil},
+		{name: "not on the roster", course: course, netId: "nobody", roles: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if roles := test.course.StudentRoles(test.netId); !reflect.DeepEqual(roles, test.roles) {
+				t.Errorf("got %v, want %v", roles, test.roles)
+			}
+		})
+	}
+}
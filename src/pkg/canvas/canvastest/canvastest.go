@@ -0,0 +1,319 @@
+// Package canvastest is a fake Canvas API for exercising the canvas client and
+// course registration without the network. Courses come from fixture files
+// shaped like Canvas's own responses, one <courseId>.json per course:
+//
+//	{"course": {...}, "sections": [...], "enrollments": [...]}
+//
+// Lists are paginated with Link headers the way Canvas does it, and SetMode
+// makes the fake fail in the ways Canvas does.
+package canvastest
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+)
+
+//go:embed fixtures/*.json
+var embedded embed.FS
+
+// Fixtures are the bundled courses: 1001 has students in several sections and
+// pages of enrollments, 1002 has no students, 1003 is taken by the token's
+// user as a student and 1004 has missing names and malformed enrollments
+var Fixtures, _ = fs.Sub(embedded, "fixtures")
+
+// Token is the access token the fake accepts unless Fake.Token is changed
+const Token = "fake-canvas-token"
+
+// Mode is how the fake answers requests
+type Mode int
+
+const (
+	Normal Mode = iota
+	// Unauthorized answers 401 as for a revoked token
+	Unauthorized
+	// NotFound answers 404 for every course
+	NotFound
+	// Throttled answers 403 Rate Limit Exceeded
+	Throttled
+	// Malformed answers 200 with a body that isn't valid JSON
+	Malformed
+	// Unavailable answers 503
+	Unavailable
+)
+
+// Course is one fixture file
+type Course struct {
+	Course      json.RawMessage   `json:"course"`
+	Sections    []json.RawMessage `json:"sections"`
+	Enrollments []json.RawMessage `json:"enrollments"`
+}
+
+// Fake serves the Canvas API endpoints the bot uses from fixtures
+type Fake struct {
+	Token string
+	// Self is who /users/self returns
+	Self canvas.User
+	// PageSize caps per_page well below Canvas's 100 so pagination gets exercised
+	PageSize int
+
+	mutex   sync.Mutex
+	courses map[string]*Course
+	mode    Mode
+	// modeRequests is how many more requests get mode, 0 keeps it until changed
+	modeRequests int
+	requests     int
+}
+
+// New loads every <courseId>.json in fixtures
+func New(fixtures fs.FS) (*Fake, error) {
+	names, err := fs.Glob(fixtures, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	courses := make(map[string]*Course)
+	for _, name := range names {
+		data, err := fs.ReadFile(fixtures, name)
+		if err != nil {
+			return nil, err
+		}
+		var course Course
+		if err := json.Unmarshal(data, &course); err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", name, err)
+		}
+		courses[strings.TrimSuffix(path.Base(name), ".json")] = &course
+	}
+	return &Fake{
+		Token:    Token,
+		Self:     canvas.User{Id: 10, Name: "Grace Brewster Hopper", ShortName: "Grace Hopper", SortableName: "Hopper, Grace Brewster", LoginId: "ghopper1"},
+		PageSize: 10,
+		courses:  courses,
+	}, nil
+}
+
+// Start serves the fake on a local port, close the server when done
+func (fake *Fake) Start() *httptest.Server {
+	return httptest.NewServer(fake)
+}
+
+// Client returns a canvas client for the fake served at baseURL, retrying
+// without the real backoff so throttling doesn't slow anything down
+func (fake *Fake) Client(baseURL string) *canvas.Client {
+	return &canvas.Client{
+		BaseURL:    baseURL,
+		Token:      fake.Token,
+		HTTP:       &http.Client{Timeout: 10 * time.Second},
+		Retries:    3,
+		RetryDelay: time.Millisecond,
+	}
+}
+
+// SetMode makes the next requests answer with mode, all of them until the
+// mode is changed again if requests is 0
+func (fake *Fake) SetMode(mode Mode, requests int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.mode = mode
+	fake.modeRequests = requests
+}
+
+// Requests is how many requests the fake has answered
+func (fake *Fake) Requests() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.requests
+}
+
+// takeMode counts a request and returns the mode to answer it with
+func (fake *Fake) takeMode() Mode {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.requests++
+	mode := fake.mode
+	if fake.modeRequests > 0 {
+		fake.modeRequests--
+		if fake.modeRequests == 0 {
+			fake.mode = Normal
+		}
+	}
+	return mode
+}
+
+func (fake *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mode := fake.takeMode()
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Only GET is faked.")
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fake.Token || mode == Unauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="canvas-lms"`)
+		writeError(w, http.StatusUnauthorized, "Invalid access token.")
+		return
+	}
+
+	switch mode {
+	case NotFound:
+		writeError(w, http.StatusNotFound, "The specified resource does not exist.")
+		return
+	case Throttled:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "403 Forbidden (Rate Limit Exceeded)")
+		return
+	case Unavailable:
+		writeError(w, http.StatusServiceUnavailable, "Canvas is down for maintenance.")
+		return
+	}
+	w.Header().Set("X-Rate-Limit-Remaining", "700.0")
+
+	body, status := fake.route(r)
+	if status != http.StatusOK {
+		writeError(w, status, "The specified resource does not exist.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if mode == Malformed {
+		w.Write([]byte(`[{"id": 1, "user": {"name": `))
+		return
+	}
+	if list, ok := body.([]json.RawMessage); ok {
+		body = fake.paginate(w, r, list)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// route finds the fixture data for a request
+func (fake *Fake) route(r *http.Request) (any, int) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "users":
+		return fake.user(parts[1])
+	case len(parts) >= 2 && parts[0] == "courses":
+		course := fake.courses[parts[1]]
+		if course == nil {
+			return nil, http.StatusNotFound
+		}
+		if len(parts) == 2 {
+			return course.Course, http.StatusOK
+		}
+		if len(parts) != 3 {
+			return nil, http.StatusNotFound
+		}
+		switch parts[2] {
+		case "sections":
+			return course.Sections, http.StatusOK
+		case "enrollments":
+			return filterEnrollments(course.Enrollments, r.URL.Query()["type[]"]), http.StatusOK
+		case "users":
+			return courseUsers(course.Enrollments), http.StatusOK
+		}
+	}
+	return nil, http.StatusNotFound
+}
+
+func (fake *Fake) user(userId string) (any, int) {
+	if userId == "self" || userId == strconv.Itoa(fake.Self.Id) {
+		return fake.Self, http.StatusOK
+	}
+	for _, course := range fake.courses {
+		for _, user := range courseUsers(course.Enrollments) {
+			var id struct {
+				Id int `json:"id"`
+			}
+			if json.Unmarshal(user, &id) == nil && strconv.Itoa(id.Id) == userId {
+				return user, http.StatusOK
+			}
+		}
+	}
+	return nil, http.StatusNotFound
+}
+
+// filterEnrollments keeps the enrollments of the given types, all if none are given
+func filterEnrollments(enrollments []json.RawMessage, types []string) []json.RawMessage {
+	if len(types) == 0 {
+		return enrollments
+	}
+	filtered := []json.RawMessage{}
+	for _, enrollment := range enrollments {
+		var fields struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(enrollment, &fields)
+		for _, enrollmentType := range types {
+			if fields.Type == enrollmentType {
+				filtered = append(filtered, enrollment)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// courseUsers is every enrolled user once
+func courseUsers(enrollments []json.RawMessage) []json.RawMessage {
+	users := []json.RawMessage{}
+	seen := make(map[string]bool)
+	for _, enrollment := range enrollments {
+		var fields struct {
+			User json.RawMessage `json:"user"`
+		}
+		json.Unmarshal(enrollment, &fields)
+		if fields.User != nil && !seen[string(fields.User)] {
+			seen[string(fields.User)] = true
+			users = append(users, fields.User)
+		}
+	}
+	return users
+}
+
+// paginate returns the requested page of list and sets the Link header the
+// way Canvas does, with current, next, prev, first and last relations
+func (fake *Fake) paginate(w http.ResponseWriter, r *http.Request, list []json.RawMessage) []json.RawMessage {
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage <= 0 {
+		perPage = 10
+	}
+	perPage = min(perPage, fake.PageSize)
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+	lastPage := max((len(list)+perPage-1)/perPage, 1)
+
+	pageURL := func(page int) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(perPage))
+		return (&url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawQuery: query.Encode()}).String()
+	}
+	links := []string{fmt.Sprintf(`<%s>; rel="current"`, pageURL(page))}
+	if page < lastPage {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(page+1)))
+	}
+	if page > 1 {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(page-1)))
+	}
+	links = append(links, fmt.Sprintf(`<%s>; rel="first"`, pageURL(1)), fmt.Sprintf(`<%s>; rel="last"`, pageURL(lastPage)))
+	w.Header().Set("Link", strings.Join(links, ","))
+
+	start := min((page-1)*perPage, len(list))
+	return append([]json.RawMessage{}, list[start:min(start+perPage, len(list))]...)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"message": message}},
+	})
+}
@@ -0,0 +1,350 @@
+package canvas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the Canvas instance used when CANVAS_BASE_URL is unset
+const DefaultBaseURL = "https://canvas.instructure.com"
+
+// perPage is the page size asked for on list endpoints, Canvas caps it at 100
+const perPage = "100"
+
+const (
+	defaultRetries    = 3
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = 30 * time.Second
+	// lowRateLimit is the X-Rate-Limit-Remaining below which requests start
+	// slowing down. Canvas's bucket holds 700 and refills over time.
+	lowRateLimit = 100
+	// maxRateLimitPause is the pause between requests once the bucket is empty
+	maxRateLimitPause = 5 * time.Second
+)
+
+// httpClient is shared by every Client so connections to Canvas get reused
+var httpClient = &http.Client{
+	Timeout: 60 * time.Second,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+	},
+}
+
+// Client talks to the Canvas REST API as the owner of one access token
+type Client struct {
+	// BaseURL is the Canvas instance, e.g. https://utk.instructure.com or a local mock
+	BaseURL string
+	Token   string
+	HTTP    *http.Client
+	// Retries is how often a throttled or failed request is tried again
+	Retries int
+	// RetryDelay is the backoff before the first retry, it doubles after each one
+	RetryDelay time.Duration
+	// pauseUntil holds the next request back while the rate limit refills
+	pauseUntil time.Time
+}
+
+// BaseURLFromEnv reads CANVAS_BASE_URL, defaulting to DefaultBaseURL
+func BaseURLFromEnv() string {
+	baseURL := os.Getenv("CANVAS_BASE_URL")
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return strings.TrimSuffix(baseURL, "/")
+}
+
+// NewClient returns a client for the Canvas instance named by CANVAS_BASE_URL
+func NewClient(token string) *Client {
+	return &Client{
+		BaseURL:    BaseURLFromEnv(),
+		Token:      token,
+		HTTP:       httpClient,
+		Retries:    defaultRetries,
+		RetryDelay: defaultRetryDelay,
+	}
+}
+
+// Course looks up a course, with its term, as the token's user sees it
+func (client *Client) Course(courseId string) (*CourseInfo, error) {
+	var info CourseInfo
+	err := client.get(client.endpoint("courses/"+url.PathEscape(courseId), url.Values{"include[]": {"term"}}), &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Enrollments lists every enrollment in a course, only those of the given
+// types if any are given
+func (client *Client) Enrollments(courseId string, types ...string) ([]Enrollment, error) {
+	query := url.Values{"per_page": {perPage}}
+	for _, enrollmentType := range types {
+		query.Add("type[]", enrollmentType)
+	}
+	return getAll[Enrollment](client, client.endpoint("courses/"+url.PathEscape(courseId)+"/enrollments", query))
+}
+
+// Sections lists a course's sections
+func (client *Client) Sections(courseId string) ([]CanvasSection, error) {
+	query := url.Values{"per_page": {perPage}}
+	return getAll[CanvasSection](client, client.endpoint("courses/"+url.PathEscape(courseId)+"/sections", query))
+}
+
+// Users lists the users enrolled in a course
+func (client *Client) Users(courseId string) ([]User, error) {
+	query := url.Values{"per_page": {perPage}}
+	return getAll[User](client, client.endpoint("courses/"+url.PathEscape(courseId)+"/users", query))
+}
+
+// User looks up a user by Canvas ID, "self" is the token's own user
+func (client *Client) User(userId string) (*User, error) {
+	var user User
+	if err := client.get(client.endpoint("users/"+url.PathEscape(userId), nil), &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (client *Client) endpoint(path string, query url.Values) string {
+	endpoint := client.BaseURL + "/api/v1/" + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	return endpoint
+}
+
+// get GETs one resource into value
+func (client *Client) get(endpoint string, value any) error {
+	response, err := client.do(endpoint)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(value); err != nil {
+		return fmt.Errorf("decoding Canvas response from %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+// getAll GETs a list endpoint, following the Link header through every page
+func getAll[T any](client *Client, endpoint string) ([]T, error) {
+	var all []T
+	for endpoint != "" {
+		response, err := client.do(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		var page []T
+		err = json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding Canvas response from %s: %w", endpoint, err)
+		}
+		all = append(all, page...)
+
+		endpoint, err = client.nextPage(response)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
+
+// nextPage resolves the response's next link, refusing to send the token to
+// any other host
+func (client *Client) nextPage(response *http.Response) (string, error) {
+	next := getNextURL(response.Header.Get("Link"))
+	if next == "" {
+		return "", nil
+	}
+	nextURL, err := response.Request.URL.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page link %q: %w", next, err)
+	}
+	if nextURL.Host != response.Request.URL.Host {
+		return "", fmt.Errorf("next page link %q points away from %s", next, response.Request.URL.Host)
+	}
+	return nextURL.String(), nil
+}
+
+// do GETs endpoint, retrying while Canvas is throttling or failing
+func (client *Client) do(endpoint string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if wait := time.Until(client.pauseUntil); wait > 0 {
+			time.Sleep(wait)
+		}
+		response, retryAfter, err := client.try(endpoint)
+		if err == nil {
+			return response, nil
+		}
+		if !errors.Is(err, ErrThrottled) && !errors.Is(err, ErrUnavailable) || attempt >= client.Retries {
+			return nil, err
+		}
+
+		delay := client.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		log.Println("Retrying Canvas request in", delay, "after:", err)
+		time.Sleep(delay)
+	}
+}
+
+// try makes one request, returning the response only if it succeeded along
+// with any Retry-After Canvas asked for
+func (client *Client) try(endpoint string) (*http.Response, time.Duration, error) {
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+client.Token)
+	request.Header.Set("Accept", "application/json")
+
+	response, err := client.HTTP.Do(request)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	remaining, hasRemaining := client.trackRateLimit(response)
+	if response.StatusCode == http.StatusOK {
+		return response, 0, nil
+	}
+
+	// only a little of the body is needed to tell throttling apart
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	response.Body.Close()
+	retryAfter := time.Duration(0)
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		return nil, 0, ErrUnauthorized
+	case response.StatusCode == http.StatusTooManyRequests,
+		response.StatusCode == http.StatusForbidden && (strings.Contains(string(body), "Rate Limit Exceeded") || hasRemaining && remaining <= 0):
+		return nil, retryAfter, ErrThrottled
+	case response.StatusCode == http.StatusForbidden:
+		return nil, 0, ErrForbidden
+	case response.StatusCode == http.StatusNotFound:
+		return nil, 0, ErrNotFound
+	case response.StatusCode >= 500:
+		return nil, retryAfter, fmt.Errorf("%w: %s for %s", ErrUnavailable, response.Status, request.URL.Path)
+	default:
+		return nil, 0, fmt.Errorf("Canvas returned %s for %s", response.Status, request.URL.Path)
+	}
+}
+
+// trackRateLimit reads X-Rate-Limit-Remaining, spacing out the following
+// requests the closer it gets to zero
+func (client *Client) trackRateLimit(response *http.Response) (float64, bool) {
+	remaining, err := strconv.ParseFloat(response.Header.Get("X-Rate-Limit-Remaining"), 64)
+	if err != nil {
+		return 0, false
+	}
+	if remaining < lowRateLimit {
+		pause := time.Duration(float64(maxRateLimitPause) * (lowRateLimit - max(remaining, 0)) / lowRateLimit)
+		client.pauseUntil = time.Now().Add(pause)
+	}
+	return remaining, true
+}
+
+// backoff doubles RetryDelay for every attempt so far, picking a random delay
+// in the upper half so many clients don't retry in lockstep
+func (client *Client) backoff(attempt int) time.Duration {
+	delay := client.RetryDelay
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// getNextURL returns the rel="next" target of a Link header, or "" if there is none
+func getNextURL(linkHeader string) string {
+	return parseLinkHeader(linkHeader)["next"]
+}
+
+// parseLinkHeader maps each relation type of an RFC 8288 Link header to its
+// target. A link can carry several space separated relation types, relation
+// types are case insensitive, and the first link with a relation type wins.
+// Quoted parameter values may contain commas and semicolons.
+func parseLinkHeader(header string) map[string]string {
+	links := make(map[string]string)
+	rest := header
+	for {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			return links
+		}
+		end := strings.IndexByte(rest[start:], '>')
+		if end < 0 {
+			return links
+		}
+		target := strings.TrimSpace(rest[start+1 : start+end])
+
+		var params map[string]string
+		params, rest = parseLinkParams(rest[start+end+1:])
+		for _, rel := range strings.Fields(strings.ToLower(params["rel"])) {
+			if _, ok := links[rel]; !ok {
+				links[rel] = target
+			}
+		}
+	}
+}
+
+// parseLinkParams reads the ;name=value parameters of one link up to the comma
+// that ends it, returning them and whatever follows the comma
+func parseLinkParams(s string) (map[string]string, string) {
+	params := make(map[string]string)
+	var param strings.Builder
+	addParam := func() {
+		name, value, _ := strings.Cut(param.String(), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := params[name]; name != "" && !ok {
+			params[name] = strings.TrimSpace(value)
+		}
+		param.Reset()
+	}
+
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s):
+			i++
+			param.WriteByte(s[i])
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+			param.WriteByte(c)
+		case c == ';':
+			addParam()
+		case c == ',':
+			addParam()
+			return params, s[i+1:]
+		default:
+			param.WriteByte(c)
+		}
+	}
+	addParam()
+	return params, ""
+}
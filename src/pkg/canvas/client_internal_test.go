@@ -0,0 +1,52 @@
+package canvas
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLinkHeader(t *testing.T) {
+	const page2 = "https://canvas.example.edu/api/v1/courses/1/enrollments?page=2&per_page=100"
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]string
+	}{
+		{name: "empty", header: "", want: map[string]string{}},
+		{
+			name: "canvas pagination",
+			header: `<https://canvas.example.edu/api/v1/courses/1/enrollments?page=1&per_page=100>; rel="current",` +
+				`<` + page2 + `>; rel="next",` +
+				`<https://canvas.example.edu/api/v1/courses/1/enrollments?page=1&per_page=100>; rel="first",` +
+				`<https://canvas.example.edu/api/v1/courses/1/enrollments?page=3&per_page=100>; rel="last"`,
+			want: map[string]string{
+				"current": "https://canvas.example.edu/api/v1/courses/1/enrollments?page=1&per_page=100",
+				"next":    page2,
+				"first":   "https://canvas.example.edu/api/v1/courses/1/enrollments?page=1&per_page=100",
+				"last":    "https://canvas.example.edu/api/v1/courses/1/enrollments?page=3&per_page=100",
+			},
+		},
+		{name: "unquoted rel", header: `<` + page2 + `>; rel=next`, want: map[string]string{"next": page2}},
+		{name: "rel is case insensitive", header: `<` + page2 + `>; REL="Next"`, want: map[string]string{"next": page2}},
+		{name: "several relation types", header: `<` + page2 + `>; rel="next last"`, want: map[string]string{"next": page2, "last": page2}},
+		{name: "first link wins", header: `<a>; rel="next", <b>; rel="next"`, want: map[string]string{"next": "a"}},
+		{
+			name:   "quoted parameters with commas and semicolons",
+			header: `<a>; title="one, two; three"; rel="prev", <b>; rel="next"`,
+			want:   map[string]string{"prev": "a", "next": "b"},
+		},
+		{name: "escaped quote", header: `<a>; title="say \"hi\", then"; rel="next"`, want: map[string]string{"next": "a"}},
+		{name: "first rel parameter counts", header: `<a>; rel="next"; rel="last"`, want: map[string]string{"next": "a"}},
+		{name: "whitespace around parts", header: "  < a >  ;  rel = \"next\"  ,  <b>;rel=last ", want: map[string]string{"next": "a", "last": "b"}},
+		{name: "link without rel", header: `<a>; title="x", <b>; rel="next"`, want: map[string]string{"next": "b"}},
+		{name: "unterminated target", header: `<a; rel="next"`, want: map[string]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseLinkHeader(test.header); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package canvas_test
+
+import (
+	"errors"
+	"testing"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvas/canvastest"
+)
+
+// startFake serves the bundled fixtures for one test, with the package level
+// helpers pointed at it through CANVAS_BASE_URL
+func startFake(t *testing.T) (*canvastest.Fake, string) {
+	t.Helper()
+	fake, err := canvastest.New(canvastest.Fixtures)
+	if err != nil {
+		t.Fatal("loading fixtures:", err)
+	}
+	server := fake.Start()
+	t.Cleanup(server.Close)
+	t.Setenv("CANVAS_BASE_URL", server.URL)
+	return fake, server.URL
+}
+
+func TestClient(t *testing.T) {
+	tests := []struct {
+		name string
+		// mode is set for modeRequests requests before run, 0 keeps it for the whole test
+		mode         canvastest.Mode
+		modeRequests int
+		run          func(t *testing.T, client *canvas.Client, fake *canvastest.Fake)
+	}{
+		{name: "course with term", run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			info, err := client.Course("1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Name != "Data Structures and Algorithms" || info.Term.Name != "Fall 2026" {
+				t.Errorf("got %q in %q", info.Name, info.Term.Name)
+			}
+			if !info.TeachesCourse() {
+				t.Error("token user should teach the course")
+			}
+		}},
+		{name: "enrollments follow every page", run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			before := fake.Requests()
+			enrollments, err := client.Enrollments("1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(enrollments) != 30 {
+				t.Errorf("got %d enrollments, want 30", len(enrollments))
+			}
+			if requests := fake.Requests() - before; requests != 3 {
+				t.Errorf("took %d requests for 3 pages", requests)
+			}
+		}},
+		{name: "enrollments filtered by type", run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			enrollments, err := client.Enrollments("1001", canvas.StudentEnrollment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, enrollment := range enrollments {
+				if enrollment.Type != canvas.StudentEnrollment {
+					t.Errorf("got a %s", enrollment.Type)
+				}
+			}
+			if len(enrollments) != 26 {
+				t.Errorf("got %d student enrollments, want 26", len(enrollments))
+			}
+		}},
+		{name: "sections", run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			sections, err := client.Sections("1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sections) != 3 {
+				t.Errorf("got %d sections, want 3", len(sections))
+			}
+		}},
+		{name: "users", run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			users, err := client.Users("1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 28 {
+				t.Errorf("got %d users, want 28", len(users))
+			}
+		}},
+		{name: "self", run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			user, err := client.User("self")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.LoginId != "ghopper1" {
+				t.Errorf("got %q", user.LoginId)
+			}
+		}},
+		{name: "unknown course", run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			_, err := client.Course("404")
+			expectError(t, err, canvas.ErrNotFound)
+		}},
+		{name: "wrong token", run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			client.Token = "wrong"
+			_, err := client.Enrollments("1001")
+			expectError(t, err, canvas.ErrUnauthorized)
+		}},
+		{name: "revoked token", mode: canvastest.Unauthorized, run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			_, err := client.Course("1001")
+			expectError(t, err, canvas.ErrUnauthorized)
+		}},
+		{name: "not found", mode: canvastest.NotFound, run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			_, err := client.Sections("1001")
+			expectError(t, err, canvas.ErrNotFound)
+		}},
+		{name: "throttling is retried", mode: canvastest.Throttled, modeRequests: 2, run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			enrollments, err := client.Enrollments("1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(enrollments) != 30 {
+				t.Errorf("got %d enrollments, want 30", len(enrollments))
+			}
+		}},
+		{name: "throttling gives up", mode: canvastest.Throttled, run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			_, err := client.Course("1001")
+			expectError(t, err, canvas.ErrThrottled)
+		}},
+		{name: "outage is retried", mode: canvastest.Unavailable, modeRequests: 1, run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			if _, err := client.Course("1001"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "outage gives up", mode: canvastest.Unavailable, run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			_, err := client.Course("1001")
+			expectError(t, err, canvas.ErrUnavailable)
+		}},
+		{name: "malformed JSON", mode: canvastest.Malformed, run: func(t *testing.T, client *canvas.Client, fake *canvastest.Fake) {
+			_, err := client.Enrollments("1001")
+			if err == nil || errors.Is(err, canvas.ErrUnavailable) {
+				t.Errorf("expected a decoding error, got %v", err)
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, baseURL := startFake(t)
+			fake.SetMode(test.mode, test.modeRequests)
+			test.run(t, fake.Client(baseURL), fake)
+		})
+	}
+}
+
+func expectError(t *testing.T, err error, target error) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Errorf("expected %v, got %v", target, err)
+	}
+}
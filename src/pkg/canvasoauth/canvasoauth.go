@@ -0,0 +1,157 @@
+package canvasoauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/store"
+)
+
+// Config is a Canvas developer key, see
+// https://canvas.instructure.com/doc/api/file.oauth.html
+type Config struct {
+	ClientId     string
+	ClientSecret string
+	// BaseURL is the Canvas instance, or a fake provider in tests
+	BaseURL string
+	// RedirectURL is the authserver's callback, registered with the developer key
+	RedirectURL string
+}
+
+// refreshMargin refreshes an access token this long before it actually expires
+const refreshMargin = 5 * time.Minute
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// ConfigFromEnv reads CANVAS_OAUTH_CLIENT_ID and CANVAS_OAUTH_CLIENT_SECRET,
+// returning nil if they're unset. CANVAS_OAUTH_BASE_URL defaults to the API's
+// CANVAS_BASE_URL and the callback lives on AUTH_SERVER_URL.
+func ConfigFromEnv() *Config {
+	clientId := os.Getenv("CANVAS_OAUTH_CLIENT_ID")
+	clientSecret := os.Getenv("CANVAS_OAUTH_CLIENT_SECRET")
+	if clientId == "" || clientSecret == "" {
+		return nil
+	}
+	baseURL := os.Getenv("CANVAS_OAUTH_BASE_URL")
+	if baseURL == "" {
+		baseURL = canvas.BaseURLFromEnv()
+	}
+	return &Config{
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		RedirectURL:  strings.TrimSuffix(os.Getenv("AUTH_SERVER_URL"), "/") + "/canvas/callback",
+	}
+}
+
+// Token is what Canvas hands back for an authorization code or refresh token
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	User         struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"user"`
+}
+
+// ExpiresAt is when the access token stops working, zero if it never does
+func (token Token) ExpiresAt(now time.Time) time.Time {
+	if token.ExpiresIn <= 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(token.ExpiresIn) * time.Second)
+}
+
+// AuthURL is where the instructor approves the bot, state comes back on the callback
+func (config *Config) AuthURL(state string) string {
+	query := url.Values{
+		"client_id":     {config.ClientId},
+		"response_type": {"code"},
+		"redirect_uri":  {config.RedirectURL},
+		"state":         {state},
+	}
+	return config.BaseURL + "/login/oauth2/auth?" + query.Encode()
+}
+
+// Exchange trades an authorization code for access and refresh tokens
+func (config *Config) Exchange(code string) (*Token, error) {
+	return config.requestToken(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {config.RedirectURL},
+	})
+}
+
+// Refresh gets a new access token, Canvas keeps the refresh token the same
+func (config *Config) Refresh(refreshToken string) (*Token, error) {
+	token, err := config.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	return token, nil
+}
+
+func (config *Config) requestToken(form url.Values) (*Token, error) {
+	form.Set("client_id", config.ClientId)
+	form.Set("client_secret", config.ClientSecret)
+
+	response, err := client.PostForm(config.BaseURL+"/login/oauth2/token", form)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Canvas token endpoint returned %s", response.Status)
+	}
+
+	var token Token
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("Canvas token endpoint returned no access token")
+	}
+	return &token, nil
+}
+
+// EnsureFresh refreshes the course's access token if it came from OAuth and is
+// about to expire, saving only the new token so a concurrent edit of the course
+// isn't overwritten. Courses with a pasted API secret are left alone.
+func EnsureFresh(dataStore store.Store, course *canvas.Course) error {
+	if course.CanvasRefreshToken == "" || course.CanvasTokenExpiresAt.IsZero() {
+		return nil
+	}
+	now := time.Now()
+	if now.Add(refreshMargin).Before(course.CanvasTokenExpiresAt) {
+		return nil
+	}
+
+	config := ConfigFromEnv()
+	if config == nil {
+		return fmt.Errorf("course %s needs its Canvas token refreshed but CANVAS_OAUTH_CLIENT_ID is unset", course.CourseId)
+	}
+	token, err := config.Refresh(course.CanvasRefreshToken)
+	if err != nil {
+		log.Println("Error refreshing Canvas token for course", course.CourseId, err)
+		return err
+	}
+
+	course.CanvasSecret = token.AccessToken
+	course.CanvasRefreshToken = token.RefreshToken
+	course.CanvasTokenExpiresAt = token.ExpiresAt(now)
+	log.Println("Refreshed Canvas token for course", course.CourseId)
+	return dataStore.SetCanvasToken(course.GuildId, course.CourseId, course.CanvasSecret, course.CanvasRefreshToken, course.CanvasTokenExpiresAt)
+}
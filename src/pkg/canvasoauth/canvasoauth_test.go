@@ -0,0 +1,157 @@
+package canvasoauth_test
+
+import (
+	"testing"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvasoauth"
+	"utk-auth-go/src/pkg/canvasoauth/oauthtest"
+	"utk-auth-go/src/pkg/store"
+)
+
+// startFake serves a fake provider and sets the developer key it accepts
+func startFake(t *testing.T) *oauthtest.Fake {
+	t.Helper()
+	fake := oauthtest.New()
+	server := fake.Start()
+	t.Cleanup(server.Close)
+	t.Setenv("CANVAS_OAUTH_BASE_URL", server.URL)
+	t.Setenv("CANVAS_OAUTH_CLIENT_ID", oauthtest.ClientId)
+	t.Setenv("CANVAS_OAUTH_CLIENT_SECRET", oauthtest.ClientSecret)
+	t.Setenv("AUTH_SERVER_URL", "https://auth.example.edu/")
+	return fake
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("CANVAS_OAUTH_CLIENT_ID", "")
+	if config := canvasoauth.ConfigFromEnv(); config != nil {
+		t.Errorf("config without a client ID is %+v", config)
+	}
+
+	startFake(t)
+	config := canvasoauth.ConfigFromEnv()
+	if config == nil || config.RedirectURL != "https://auth.example.edu/canvas/callback" {
+		t.Errorf("config is %+v", config)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	fake := startFake(t)
+	config := canvasoauth.ConfigFromEnv()
+
+	tests := []struct {
+		name    string
+		code    string
+		secret  string
+		wantErr bool
+	}{
+		{name: "approved", code: fake.Code(), secret: oauthtest.ClientSecret},
+		{name: "unknown code", code: "made-up", secret: oauthtest.ClientSecret, wantErr: true},
+		{name: "wrong client secret", code: fake.Code(), secret: "wrong", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyed := *config
+			keyed.ClientSecret = test.secret
+			token, err := keyed.Exchange(test.code)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got %+v, want an error", token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken == "" || token.RefreshToken == "" || token.User.Name != oauthtest.UserName {
+				t.Errorf("token is %+v", token)
+			}
+			// a code works once
+			if _, err := keyed.Exchange(test.code); err == nil {
+				t.Error("exchanged the same code twice")
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	fake := startFake(t)
+	config := canvasoauth.ConfigFromEnv()
+
+	refreshToken := fake.RefreshToken()
+	token, err := config.Refresh(refreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Canvas doesn't send the refresh token again
+	if token.AccessToken == "" || token.RefreshToken != refreshToken {
+		t.Errorf("token is %+v", token)
+	}
+	if _, err := config.Refresh("revoked"); err == nil {
+		t.Error("refreshed an unknown refresh token")
+	}
+}
+
+func TestTokenExpiresAt(t *testing.T) {
+	now := time.Now()
+	if got := (canvasoauth.Token{ExpiresIn: 60}).ExpiresAt(now); !got.Equal(now.Add(time.Minute)) {
+		t.Errorf("expires at %s", got)
+	}
+	if got := (canvasoauth.Token{}).ExpiresAt(now); !got.IsZero() {
+		t.Errorf("token without expires_in expires at %s", got)
+	}
+}
+
+func TestEnsureFresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		// refresh is false for a pasted API secret
+		refresh   bool
+		expiresAt time.Time
+		noConfig  bool
+		wantErr   bool
+		// wantRefreshed says a new access token was fetched and saved
+		wantRefreshed bool
+	}{
+		{name: "pasted secret", expiresAt: now.Add(-time.Hour)},
+		{name: "still fresh", refresh: true, expiresAt: now.Add(time.Hour)},
+		{name: "about to expire", refresh: true, expiresAt: now.Add(time.Minute), wantRefreshed: true},
+		{name: "expired", refresh: true, expiresAt: now.Add(-time.Hour), wantRefreshed: true},
+		{name: "no developer key", refresh: true, expiresAt: now.Add(-time.Hour), noConfig: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := startFake(t)
+			if test.noConfig {
+				t.Setenv("CANVAS_OAUTH_CLIENT_ID", "")
+			}
+			dataStore := store.NewMemoryStore()
+			course := canvas.Course{GuildId: "guild", CourseId: "1001", CanvasSecret: "old-token", CanvasTokenExpiresAt: test.expiresAt}
+			if test.refresh {
+				course.CanvasRefreshToken = fake.RefreshToken()
+			}
+			if err := dataStore.AddCourse(course); err != nil {
+				t.Fatal(err)
+			}
+
+			err := canvasoauth.EnsureFresh(dataStore, &course)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v", err)
+			}
+			stored, _ := dataStore.Course("guild", "1001")
+			wantRefreshes := 0
+			if test.wantRefreshed {
+				wantRefreshes = 1
+			}
+			refreshed := course.CanvasSecret != "old-token"
+			if refreshed != test.wantRefreshed || stored.CanvasSecret != course.CanvasSecret || fake.Refreshes() != wantRefreshes {
+				t.Errorf("course has %q, stored %q after %d refreshes", course.CanvasSecret, stored.CanvasSecret, fake.Refreshes())
+			}
+			if test.wantRefreshed && !course.CanvasTokenExpiresAt.After(now.Add(time.Hour/2)) {
+				t.Errorf("refreshed token expires at %s", course.CanvasTokenExpiresAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Package oauthtest is a fake Canvas OAuth provider for exercising the Connect
+// Canvas flow without the network. The authorize page approves straight away
+// unless Deny is set, and the token endpoint hands out tokens for the
+// codes and refresh tokens it issued.
+package oauthtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+)
+
+const (
+	// ClientId and ClientSecret are the developer key the fake accepts
+	ClientId     = "fake-client"
+	ClientSecret = "fake-secret"
+	// UserName is who the tokens are issued to
+	UserName = "Fake Instructor"
+)
+
+// Fake serves /login/oauth2/auth and /login/oauth2/token
+type Fake struct {
+	// Deny makes the authorize page send the user back with access_denied
+	Deny bool
+	// ExpiresIn is how many seconds access tokens last
+	ExpiresIn int
+	// AccessToken is handed out for every grant if set, so the tokens can be
+	// used against a fake Canvas API, otherwise each one is random
+	AccessToken string
+
+	mutex sync.Mutex
+	// codes and refresh tokens handed out so far
+	codes         map[string]bool
+	refreshTokens map[string]bool
+	refreshes     int
+}
+
+// New returns a fake whose access tokens last an hour
+func New() *Fake {
+	return &Fake{
+		ExpiresIn:     3600,
+		codes:         make(map[string]bool),
+		refreshTokens: make(map[string]bool),
+	}
+}
+
+// Start serves the fake on a local port, close the server when done
+func (fake *Fake) Start() *httptest.Server {
+	return httptest.NewServer(fake)
+}
+
+// Code issues an authorization code as if the user had approved the bot
+func (fake *Fake) Code() string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	code := randomToken()
+	fake.codes[code] = true
+	return code
+}
+
+// RefreshToken issues a refresh token as if a code had been exchanged for it
+func (fake *Fake) RefreshToken() string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	refreshToken := randomToken()
+	fake.refreshTokens[refreshToken] = true
+	return refreshToken
+}
+
+// Refreshes is how many access tokens the fake has refreshed
+func (fake *Fake) Refreshes() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.refreshes
+}
+
+func randomToken() string {
+	tokenBytes := make([]byte, 16)
+	rand.Read(tokenBytes)
+	return hex.EncodeToString(tokenBytes)
+}
+
+func (fake *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/login/oauth2/auth":
+		fake.authorize(w, r)
+	case "/login/oauth2/token":
+		fake.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (fake *Fake) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != ClientId {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	params := url.Values{"state": {query.Get("state")}}
+	if fake.Deny {
+		params.Set("error", "access_denied")
+	} else {
+		params.Set("code", fake.Code())
+	}
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (fake *Fake) token(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("client_id") != ClientId || r.PostFormValue("client_secret") != ClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	accessToken := fake.AccessToken
+	if accessToken == "" {
+		accessToken = randomToken()
+	}
+	response := map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   fake.ExpiresIn,
+		"user":         map[string]any{"id": 1, "name": UserName},
+	}
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		code := r.PostFormValue("code")
+		if !fake.codes[code] {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		delete(fake.codes, code)
+		refreshToken := randomToken()
+		fake.refreshTokens[refreshToken] = true
+		response["refresh_token"] = refreshToken
+	case "refresh_token":
+		if !fake.refreshTokens[r.PostFormValue("refresh_token")] {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		fake.refreshes++
+	default:
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
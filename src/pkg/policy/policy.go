@@ -0,0 +1,90 @@
+package policy
+
+import (
+	"log"
+	"os"
+	"utk-auth-go/src/pkg/store"
+)
+
+// Mode decides what happens when a NetID is already bound to another Discord account
+type Mode string
+
+const (
+	// ModeReject refuses to verify the second account
+	ModeReject Mode = "reject"
+	// ModeFlag lets the second account verify and tells staff about it
+	ModeFlag Mode = "flag"
+	// ModeTransfer moves the binding to the second account once it verifies
+	ModeTransfer Mode = "transfer"
+)
+
+// ModeFromEnv reads NETID_BINDING_MODE, defaulting to ModeReject
+func ModeFromEnv() Mode {
+	switch mode := Mode(os.Getenv("NETID_BINDING_MODE")); mode {
+	case ModeReject, ModeFlag, ModeTransfer:
+		return mode
+	case "":
+		return ModeReject
+	default:
+		log.Printf("Unknown NETID_BINDING_MODE %q, rejecting conflicting bindings\n", mode)
+		return ModeReject
+	}
+}
+
+// BindMode is how the store records a verification under mode
+func (mode Mode) BindMode() store.BindMode {
+	switch mode {
+	case ModeFlag:
+		return store.BindShared
+	case ModeTransfer:
+		return store.BindTransfer
+	default:
+		return store.BindExclusive
+	}
+}
+
+type Decision int
+
+const (
+	// Allow means the NetID is free or already bound to this user
+	Allow Decision = iota
+	// Reject means the user may not verify with this NetID
+	Reject
+	// Flag means the user may verify but staff should be told
+	Flag
+	// Transfer means verifying moves the binding away from the existing user
+	Transfer
+)
+
+// Result is the outcome of a binding check, Existing is the conflicting record if there is one
+type Result struct {
+	Decision Decision
+	Existing *store.VerifiedMember
+}
+
+// CheckBinding decides whether userId may verify with netId in guildId
+func CheckBinding(dataStore store.Store, mode Mode, guildId string, userId string, netId string) (Result, error) {
+	members, err := dataStore.VerifiedMembersByNetId(guildId, netId)
+	if err != nil {
+		return Result{}, err
+	}
+	var existing *store.VerifiedMember
+	for i := range members {
+		if members[i].UserId != userId {
+			existing = &members[i]
+			break
+		}
+	}
+	if existing == nil {
+		return Result{Decision: Allow}, nil
+	}
+
+	switch mode {
+	case ModeFlag:
+		return Result{Decision: Flag, Existing: existing}, nil
+	case ModeTransfer:
+		return Result{Decision: Transfer, Existing: existing}, nil
+	default:
+		return Result{Decision: Reject, Existing: existing}, nil
+	}
+}
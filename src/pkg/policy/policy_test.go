@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"testing"
+	"utk-auth-go/src/pkg/store"
+)
+
+func TestCheckBinding(t *testing.T) {
+	dataStore := store.NewMemoryStore()
+	for _, member := range []store.VerifiedMember{
+		{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "owner"},
+		{GuildId: "guild", CourseId: "1002", NetId: "abc123", UserId: "owner"},
+		{GuildId: "other", CourseId: "1001", NetId: "xyz789", UserId: "someone"},
+	} {
+		if err := dataStore.PutVerifiedMembers(member); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		mode     Mode
+		guildId  string
+		userId   string
+		netId    string
+		decision Decision
+	}{
+		{name: "free NetID", mode: ModeReject, guildId: "guild", userId: "new", netId: "free1", decision: Allow},
+		{name: "same user again", mode: ModeReject, guildId: "guild", userId: "owner", netId: "abc123", decision: Allow},
+		{name: "bound in another guild only", mode: ModeReject, guildId: "guild", userId: "new", netId: "xyz789", decision: Allow},
+		{name: "reject", mode: ModeReject, guildId: "guild", userId: "new", netId: "abc123", decision: Reject},
+		{name: "unknown mode rejects", mode: Mode("bogus"), guildId: "guild", userId: "new", netId: "abc123", decision: Reject},
+		{name: "flag", mode: ModeFlag, guildId: "guild", userId: "new", netId: "abc123", decision: Flag},
+		{name: "transfer", mode: ModeTransfer, guildId: "guild", userId: "new", netId: "abc123", decision: Transfer},
+		{name: "transfer of a free NetID", mode: ModeTransfer, guildId: "guild", userId: "new", netId: "free1", decision: Allow},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := CheckBinding(dataStore, test.mode, test.guildId, test.userId, test.netId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Decision != test.decision {
+				t.Errorf("got decision %d, want %d", result.Decision, test.decision)
+			}
+			if test.decision == Allow {
+				if result.Existing != nil {
+					t.Errorf("allowed with an existing record %+v", result.Existing)
+				}
+			} else if result.Existing == nil || result.Existing.UserId != "owner" {
+				t.Errorf("existing record is %+v", result.Existing)
+			}
+		})
+	}
+}
+
+func TestModeFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		mode  Mode
+	}{
+		{"", ModeReject},
+		{"reject", ModeReject},
+		{"flag", ModeFlag},
+		{"transfer", ModeTransfer},
+		{"Transfer", ModeReject},
+		{"steal", ModeReject},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv("NETID_BINDING_MODE", test.value)
+			if mode := ModeFromEnv(); mode != test.mode {
+				t.Errorf("got %q, want %q", mode, test.mode)
+			}
+		})
+	}
+}
+
+func TestBindMode(t *testing.T) {
+	tests := []struct {
+		mode Mode
+		bind store.BindMode
+	}{
+		{ModeReject, store.BindExclusive},
+		{ModeFlag, store.BindShared},
+		{ModeTransfer, store.BindTransfer},
+		{Mode("bogus"), store.BindExclusive},
+	}
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			if bind := test.mode.BindMode(); bind != test.bind {
+				t.Errorf("got %d, want %d", bind, test.bind)
+			}
+		})
+	}
+}
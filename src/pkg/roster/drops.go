@@ -0,0 +1,189 @@
+package roster
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/store"
+	"utk-auth-go/src/pkg/utils"
+)
+
+// maxReportLines keeps a drop report inside Discord's embed description limit
+const maxReportLines = 30
+
+// handleDrops applies the course's drop policy to its verified members who
+// aren't on the current roster, and reports what it did to staff. It works from
+// the verified records rather than the roster diff, so a drop that a dry run or
+// a failed removal left behind is applied by a later sync. Only students who
+// left since previous are reported when nothing is applied, so staff hear about
+// each drop once.
+func handleDrops(course canvas.Course, previous []canvas.Student, current []canvas.Student) {
+	members, err := dataStore.VerifiedMembersByCourse(course.GuildId, course.CourseId)
+	if err != nil {
+		log.Println("Error reading verified members for drops:", course.CourseId, err)
+		return
+	}
+	enrolled := make(map[string]bool)
+	for _, student := range current {
+		enrolled[student.NetId] = true
+	}
+	left := make(map[string]canvas.Student)
+	for _, student := range previous {
+		left[student.NetId] = student
+	}
+
+	// report-only and dry-run drops stay verified, so they'd come up every sync
+	reportOnly := course.DropDryRun || course.DropPolicy != canvas.DropRemove && course.DropPolicy != canvas.DropAlumni
+
+	var lines []string
+	for _, member := range members {
+		if enrolled[member.NetId] {
+			continue
+		}
+		student, justLeft := left[member.NetId]
+		if !justLeft && reportOnly {
+			continue
+		}
+		roles := course.RolesFor(student)
+		if !justLeft {
+			// their roster entry went in an earlier sync, so take every role the course gives
+			roles = courseRoles(course)
+		}
+		lines = append(lines, applyDropPolicy(course, roles, member))
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	if len(lines) > maxReportLines {
+		lines = append(lines[:maxReportLines], fmt.Sprintf("...and %d more", len(lines)-maxReportLines))
+	}
+	title := "Dropped Students in " + course.CourseId
+	if course.DropDryRun {
+		title += " (dry run)"
+	}
+	utils.NotifyCourseStaff(session, course, title, strings.Join(lines, "\n"))
+}
+
+// courseRoles returns every role the course can give, in a stable order
+func courseRoles(course canvas.Course) []string {
+	var roles []string
+	add := func(roleId string) {
+		if roleId != "" && !slices.Contains(roles, roleId) {
+			roles = append(roles, roleId)
+		}
+	}
+	add(course.AuthRoleId)
+	for _, mapping := range []map[string]string{course.EnrollmentRoles, course.SectionRoles} {
+		keys := make([]string, 0, len(mapping))
+		for key := range mapping {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			add(mapping[key])
+		}
+	}
+	return roles
+}
+
+// applyDropPolicy takes roles from one dropped verified member and describes
+// what happened, or with DropDryRun what would have. Roles the member still
+// gets from another course stay.
+func applyDropPolicy(course canvas.Course, roles []string, member store.VerifiedMember) string {
+	who := fmt.Sprintf("<@%s> (`%s`)", member.UserId, member.NetId)
+	kept := rolesHeldElsewhere(course, member)
+	var removed, mentions, keptMentions []string
+	for _, roleId := range roles {
+		if kept[roleId] {
+			keptMentions = append(keptMentions, fmt.Sprintf("<@&%s>", roleId))
+			continue
+		}
+		removed = append(removed, roleId)
+		mentions = append(mentions, fmt.Sprintf("<@&%s>", roleId))
+	}
+
+	from := strings.Join(mentions, ", ")
+	if len(removed) == 0 {
+		from = "no roles"
+	}
+
+	var plan, done string
+	switch course.DropPolicy {
+	case canvas.DropRemove:
+		plan = fmt.Sprintf("remove %s from %s", from, who)
+		done = fmt.Sprintf("Removed %s from %s", from, who)
+	case canvas.DropAlumni:
+		plan = fmt.Sprintf("move %s from %s to <@&%s>", who, from, course.AlumniRoleId)
+		done = fmt.Sprintf("Moved %s from %s to <@&%s>", who, from, course.AlumniRoleId)
+	default:
+		return who + " left the course"
+	}
+	if len(keptMentions) > 0 {
+		note := fmt.Sprintf(", keeping %s from their other courses", strings.Join(keptMentions, ", "))
+		plan += note
+		done += note
+	}
+	if course.DropDryRun {
+		return "Would " + plan
+	}
+
+	var failures []string
+	for _, roleId := range removed {
+		err := session.GuildMemberRoleRemove(course.GuildId, member.UserId, roleId)
+		if err != nil {
+			log.Println("Error removing role from dropped member:", err)
+			failures = append(failures, fmt.Sprintf("removing <@&%s>: %v", roleId, err))
+		}
+	}
+	if course.DropPolicy == canvas.DropAlumni && course.AlumniRoleId != "" {
+		err := session.GuildMemberRoleAdd(course.GuildId, member.UserId, course.AlumniRoleId)
+		if err != nil {
+			log.Println("Error adding alumni role to dropped member:", err)
+			failures = append(failures, fmt.Sprintf("adding <@&%s>: %v", course.AlumniRoleId, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		// keep the record so staff can still find them with /whois
+		return "Could not " + plan + ": " + strings.Join(failures, "; ")
+	}
+	if err := dataStore.DeleteVerifiedMember(course.GuildId, course.CourseId, member.NetId, member.UserId); err != nil {
+		log.Println("Error deleting verified member after drop:", err)
+	}
+	return done
+}
+
+// rolesHeldElsewhere returns the roles the member still gets from the guild's
+// other courses, where they're verified and still on the roster, so dropping
+// one course doesn't take away a shared role like AuthRoleId or a section role
+func rolesHeldElsewhere(course canvas.Course, member store.VerifiedMember) map[string]bool {
+	kept := make(map[string]bool)
+	records, err := dataStore.VerifiedMembersByUser(course.GuildId, member.UserId)
+	if err != nil {
+		log.Println("Error reading verified members for dropped member:", err)
+		return kept
+	}
+	for _, record := range records {
+		if record.CourseId == course.CourseId {
+			continue
+		}
+		other, err := dataStore.Course(course.GuildId, record.CourseId)
+		if err != nil {
+			log.Println("Error reading course for dropped member:", err)
+			continue
+		}
+		if other == nil {
+			continue
+		}
+		if student := other.Student(record.NetId); student != nil {
+			for _, roleId := range other.RolesFor(*student) {
+				kept[roleId] = true
+			}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,290 @@
+package roster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/store"
+	"utk-auth-go/src/pkg/utils"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeDiscord records the role changes and staff messages the package sends
+type fakeDiscord struct {
+	mutex    sync.Mutex
+	requests []string
+	messages []string
+	// lockedRoles can't be removed, as when the role sits above the bot's
+	lockedRoles []string
+}
+
+// startFakeDiscord points discordgo at a fake and sets up the package with it
+// and a memory store
+func startFakeDiscord(t *testing.T) (*fakeDiscord, store.Store) {
+	t.Helper()
+	fake := &fakeDiscord{}
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(server.Close)
+
+	guilds, channels := discordgo.EndpointGuilds, discordgo.EndpointChannels
+	discordgo.EndpointGuilds = server.URL + "/guilds/"
+	discordgo.EndpointChannels = server.URL + "/channels/"
+	t.Cleanup(func() {
+		discordgo.EndpointGuilds, discordgo.EndpointChannels = guilds, channels
+	})
+
+	discord, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore := store.NewMemoryStore()
+	Setup(discord, dataStore)
+	utils.SetStore(dataStore)
+	return fake, dataStore
+}
+
+func (fake *fakeDiscord) serve(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if strings.HasPrefix(r.URL.Path, "/channels/") {
+		var message discordgo.MessageSend
+		json.NewDecoder(r.Body).Decode(&message)
+		for _, embed := range message.Embeds {
+			fake.messages = append(fake.messages, embed.Title+"\n"+embed.Description)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "1"}`))
+		return
+	}
+
+	fake.requests = append(fake.requests, r.Method+" "+r.URL.Path)
+	roleId := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if slices.Contains(fake.lockedRoles, roleId) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message": "Missing Permissions", "code": 50013}`))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fake *fakeDiscord) sent() ([]string, []string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	requests := append([]string{}, fake.requests...)
+	slices.Sort(requests)
+	return requests, append([]string{}, fake.messages...)
+}
+
+func dropsCourse(courseId string, students ...canvas.Student) canvas.Course {
+	return canvas.Course{
+		GuildId:         "guild",
+		CourseId:        courseId,
+		AuthRoleId:      "auth",
+		StaffChannelId:  "staff",
+		AlumniRoleId:    "alumni",
+		SectionRoles:    map[string]string{"s1": "section1"},
+		EnrollmentRoles: map[string]string{canvas.TaEnrollment: "ta"},
+		Students:        students,
+	}
+}
+
+func TestHandleDrops(t *testing.T) {
+	abc := canvas.Student{NetId: "abc123", EnrollmentType: canvas.StudentEnrollment, Sections: []canvas.Section{{Id: "s1"}}}
+	def := canvas.Student{NetId: "def456", EnrollmentType: canvas.StudentEnrollment}
+	// abc123 just left, def456 is still enrolled and ghi789 left in an earlier sync
+	previous := []canvas.Student{abc, def}
+	current := []canvas.Student{def}
+
+	tests := []struct {
+		name         string
+		policy       string
+		dryRun       bool
+		lockedRoles  []string
+		wantRequests []string
+		// wantVerified are the users still verified in 1001 afterwards
+		wantVerified []string
+		wantReport   []string
+		skipReport   []string
+	}{
+		{
+			name:   "remove",
+			policy: canvas.DropRemove,
+			// auth stays with user1 through course 1002
+			wantRequests: []string{
+				"DELETE /guilds/guild/members/user1/roles/section1",
+				"DELETE /guilds/guild/members/user3/roles/auth",
+				"DELETE /guilds/guild/members/user3/roles/section1",
+				"DELETE /guilds/guild/members/user3/roles/ta",
+			},
+			wantVerified: []string{"user2"},
+			wantReport:   []string{"Removed <@&section1> from <@user1>", "keeping <@&auth>", "<@user3>"},
+		},
+		{
+			name:   "alumni",
+			policy: canvas.DropAlumni,
+			wantRequests: []string{
+				"DELETE /guilds/guild/members/user1/roles/section1",
+				"DELETE /guilds/guild/members/user3/roles/auth",
+				"DELETE /guilds/guild/members/user3/roles/section1",
+				"DELETE /guilds/guild/members/user3/roles/ta",
+				"PUT /guilds/guild/members/user1/roles/alumni",
+				"PUT /guilds/guild/members/user3/roles/alumni",
+			},
+			wantVerified: []string{"user2"},
+			wantReport:   []string{"Moved <@user1> (`abc123`) from <@&section1> to <@&alumni>"},
+		},
+		{
+			name:         "report",
+			policy:       canvas.DropReport,
+			wantVerified: []string{"user1", "user2", "user3"},
+			wantReport:   []string{"<@user1> (`abc123`) left the course"},
+			skipReport:   []string{"user3"},
+		},
+		{
+			name:         "dry run",
+			policy:       canvas.DropRemove,
+			dryRun:       true,
+			wantVerified: []string{"user1", "user2", "user3"},
+			wantReport:   []string{"(dry run)", "Would remove <@&section1> from <@user1>"},
+			skipReport:   []string{"user3"},
+		},
+		{
+			name:        "failed removal",
+			policy:      canvas.DropRemove,
+			lockedRoles: []string{"section1"},
+			wantRequests: []string{
+				"DELETE /guilds/guild/members/user1/roles/section1",
+				"DELETE /guilds/guild/members/user3/roles/auth",
+				"DELETE /guilds/guild/members/user3/roles/section1",
+				"DELETE /guilds/guild/members/user3/roles/ta",
+			},
+			// kept so the next sync tries again
+			wantVerified: []string{"user1", "user2", "user3"},
+			wantReport:   []string{"Could not remove <@&section1> from <@user1>", "Missing Permissions"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, dataStore := startFakeDiscord(t)
+			fake.lockedRoles = test.lockedRoles
+			now := time.Now()
+			other := dropsCourse("1002", canvas.Student{NetId: "abc123", EnrollmentType: canvas.StudentEnrollment})
+			if err := dataStore.AddCourse(other); err != nil {
+				t.Fatal(err)
+			}
+			err := dataStore.PutVerifiedMembers(
+				store.VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+				store.VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "def456", UserId: "user2", VerifiedAt: now},
+				store.VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "ghi789", UserId: "user3", VerifiedAt: now},
+				store.VerifiedMember{GuildId: "guild", CourseId: "1002", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			course := dropsCourse("1001", current...)
+			course.DropPolicy = test.policy
+			course.DropDryRun = test.dryRun
+			handleDrops(course, previous, current)
+
+			requests, messages := fake.sent()
+			if !slices.Equal(requests, test.wantRequests) {
+				t.Errorf("requests %q, want %q", requests, test.wantRequests)
+			}
+			members, _ := dataStore.VerifiedMembersByCourse("guild", "1001")
+			var verified []string
+			for _, member := range members {
+				verified = append(verified, member.UserId)
+			}
+			slices.Sort(verified)
+			if !slices.Equal(verified, test.wantVerified) {
+				t.Errorf("verified %q, want %q", verified, test.wantVerified)
+			}
+			if len(messages) != 1 {
+				t.Fatalf("sent %d reports: %q", len(messages), messages)
+			}
+			for _, want := range test.wantReport {
+				if !strings.Contains(messages[0], want) {
+					t.Errorf("report %q is missing %q", messages[0], want)
+				}
+			}
+			for _, skip := range test.skipReport {
+				if strings.Contains(messages[0], skip) {
+					t.Errorf("report %q mentions %q", messages[0], skip)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleDropsAfterDryRun(t *testing.T) {
+	fake, dataStore := startFakeDiscord(t)
+	abc := canvas.Student{NetId: "abc123", EnrollmentType: canvas.StudentEnrollment}
+	err := dataStore.PutVerifiedMembers(store.VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user1", VerifiedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	course := dropsCourse("1001")
+	course.DropPolicy = canvas.DropRemove
+	course.DropDryRun = true
+	handleDrops(course, []canvas.Student{abc}, nil)
+	// a later sync where the roster didn't change reports nothing new
+	handleDrops(course, nil, nil)
+	if requests, messages := fake.sent(); len(requests) != 0 || len(messages) != 1 {
+		t.Fatalf("dry run sent %q and %q", requests, messages)
+	}
+
+	// ending the dry run applies the drop it held back
+	course.DropDryRun = false
+	handleDrops(course, nil, nil)
+	requests, messages := fake.sent()
+	want := []string{
+		"DELETE /guilds/guild/members/user1/roles/auth",
+		"DELETE /guilds/guild/members/user1/roles/section1",
+		"DELETE /guilds/guild/members/user1/roles/ta",
+	}
+	if !slices.Equal(requests, want) || len(messages) != 2 {
+		t.Errorf("after the dry run sent %q and %q", requests, messages)
+	}
+	if members, _ := dataStore.VerifiedMembersByCourse("guild", "1001"); len(members) != 0 {
+		t.Errorf("still verified: %+v", members)
+	}
+}
+
+func TestRolesHeldElsewhere(t *testing.T) {
+	_, dataStore := startFakeDiscord(t)
+	ta := canvas.Student{NetId: "abc123", EnrollmentType: canvas.TaEnrollment, Sections: []canvas.Section{{Id: "s1"}}}
+	for _, course := range []canvas.Course{dropsCourse("1001"), dropsCourse("1002", ta), dropsCourse("1003")} {
+		if err := dataStore.AddCourse(course); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	err := dataStore.PutVerifiedMembers(
+		store.VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+		store.VerifiedMember{GuildId: "guild", CourseId: "1002", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+		// dropped from 1003 too, so it keeps nothing
+		store.VerifiedMember{GuildId: "guild", CourseId: "1003", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+		// and 1004 isn't registered any more
+		store.VerifiedMember{GuildId: "guild", CourseId: "1004", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := rolesHeldElsewhere(dropsCourse("1001"), store.VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user1"})
+	if len(kept) != 2 || !kept["ta"] || !kept["section1"] {
+		t.Errorf("kept %v", kept)
+	}
+}
@@ -0,0 +1,249 @@
+package roster
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvasoauth"
+	"utk-auth-go/src/pkg/store"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	session   *discordgo.Session
+	dataStore store.Store
+
+	// syncMutex keeps the scheduler and manual syncs from syncing at the same time
+	syncMutex sync.Mutex
+
+	// backoffs holds the courses whose last sync failed, keyed by courseKey
+	backoffs      = make(map[string]*backoff)
+	backoffsMutex sync.Mutex
+)
+
+// maxBackoff caps how long a failing course waits between attempts
+const maxBackoff = 24 * time.Hour
+
+var ErrEmptyRoster = errors.New("Canvas returned an empty roster for a course that had students")
+
+type backoff struct {
+	failures int
+	retryAt  time.Time
+}
+
+// Diff is the difference between a stored roster and the one Canvas returned
+type Diff struct {
+	Added     []canvas.Student
+	Removed   []canvas.Student
+	Unchanged int
+	// Skipped are the enrollments Canvas returned that couldn't be used
+	Skipped []canvas.SkippedEnrollment
+}
+
+// DiffRosters compares two rosters by NetID
+func DiffRosters(previous []canvas.Student, current []canvas.Student) Diff {
+	var diff Diff
+	previousNetIds := make(map[string]bool)
+	for _, student := range previous {
+		previousNetIds[student.NetId] = true
+	}
+	currentNetIds := make(map[string]bool)
+	for _, student := range current {
+		currentNetIds[student.NetId] = true
+		if previousNetIds[student.NetId] {
+			diff.Unchanged++
+		} else {
+			diff.Added = append(diff.Added, student)
+		}
+	}
+	for _, student := range previous {
+		if !currentNetIds[student.NetId] {
+			diff.Removed = append(diff.Removed, student)
+		}
+	}
+	return diff
+}
+
+// CSV lists the added and removed students, one per row
+func (diff Diff) CSV() ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{"change", "net_id", "name", "enrollment_type", "sections"})
+	for _, change := range []struct {
+		name     string
+		students []canvas.Student
+	}{{"added", diff.Added}, {"removed", diff.Removed}} {
+		for _, student := range change.students {
+			var sections []string
+			for _, section := range student.Sections {
+				sections = append(sections, section.Name)
+			}
+			writer.Write([]string{change.name, student.NetId, student.Name, student.EnrollmentType, strings.Join(sections, "; ")})
+		}
+	}
+	writer.Flush()
+	return buffer.Bytes(), writer.Error()
+}
+
+// IntervalFromEnv reads ROSTER_SYNC_INTERVAL (default 6h), zero or a negative
+// duration turns scheduled syncs off
+func IntervalFromEnv() time.Duration {
+	value := os.Getenv("ROSTER_SYNC_INTERVAL")
+	if value == "" {
+		return 6 * time.Hour
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid ROSTER_SYNC_INTERVAL %q, using 6h\n", value)
+		return 6 * time.Hour
+	}
+	return interval
+}
+
+// Setup hands the package the Discord session and store that syncs work with
+func Setup(sessionPass *discordgo.Session, storePass store.Store) {
+	session = sessionPass
+	dataStore = storePass
+}
+
+// keepSkipped carries over the stored records of students whose enrollment
+// came back malformed, so a bad record from Canvas doesn't count as a drop
+func keepSkipped(previous []canvas.Student, current []canvas.Student, skipped []canvas.SkippedEnrollment) []canvas.Student {
+	skippedUsers := make(map[int]bool)
+	for _, enrollment := range skipped {
+		if enrollment.CanvasUserId != 0 {
+			skippedUsers[enrollment.CanvasUserId] = true
+		}
+	}
+	if len(skippedUsers) == 0 {
+		return current
+	}
+
+	currentNetIds := make(map[string]bool)
+	for _, student := range current {
+		currentNetIds[student.NetId] = true
+	}
+	for _, student := range previous {
+		if skippedUsers[student.CanvasUserId] && !currentNetIds[student.NetId] {
+			current = append(current, student)
+			currentNetIds[student.NetId] = true
+		}
+	}
+	return current
+}
+
+// SyncCourse fetches a course's roster from Canvas and replaces the stored one
+// with it in a single write
+func SyncCourse(course canvas.Course) (Diff, error) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	if err := canvasoauth.EnsureFresh(dataStore, &course); err != nil {
+		return Diff{}, err
+	}
+	students, skipped, err := canvas.GetCourseStudents(course.CourseId, course.CanvasSecret)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	// the stored roster may have changed since course was read
+	previous, err := dataStore.Students(course.GuildId, course.CourseId)
+	if err != nil {
+		return Diff{}, err
+	}
+	students = keepSkipped(previous, students, skipped)
+	// a roster that vanishes at once is far more likely a Canvas problem than a
+	// course that everyone dropped
+	if len(students) == 0 && len(previous) > 0 {
+		return Diff{}, ErrEmptyRoster
+	}
+
+	diff := DiffRosters(previous, students)
+	diff.Skipped = skipped
+	if err := dataStore.SetStudents(course.GuildId, course.CourseId, students); err != nil {
+		return Diff{}, err
+	}
+	log.Printf("Synced roster of %s for guildId %s: %d added, %d removed, %d unchanged\n",
+		course.CourseId, course.GuildId, len(diff.Added), len(diff.Removed), diff.Unchanged)
+
+	// a manual sync that works ends any backoff too
+	backoffsMutex.Lock()
+	delete(backoffs, courseKey(course))
+	backoffsMutex.Unlock()
+
+	handleDrops(course, previous, students)
+	return diff, nil
+}
+
+// StartScheduler syncs every registered course's roster every interval, backing
+// off a course whose syncs keep failing
+func StartScheduler(interval time.Duration) {
+	if interval <= 0 {
+		log.Println("Scheduled roster syncs are off")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for now := range ticker.C {
+			syncAll(now, interval)
+		}
+	}()
+}
+
+func syncAll(now time.Time, interval time.Duration) {
+	courses, err := dataStore.Courses()
+	if err != nil {
+		log.Println("Error reading courses for roster sync:", err)
+		return
+	}
+
+	for _, course := range courses {
+		key := courseKey(course)
+		backoffsMutex.Lock()
+		state := backoffs[key]
+		backoffsMutex.Unlock()
+		if state != nil && now.Before(state.retryAt) {
+			continue
+		}
+
+		_, err := SyncCourse(course)
+
+		if err == nil {
+			continue
+		}
+		backoffsMutex.Lock()
+		if state == nil {
+			state = &backoff{}
+			backoffs[key] = state
+		}
+		state.failures++
+		state.retryAt = now.Add(backoffDelay(interval, state.failures))
+		log.Printf("Error syncing roster of %s for guildId %s (failure %d, retrying after %s): %v\n",
+			course.CourseId, course.GuildId, state.failures, state.retryAt.Format(time.RFC3339), err)
+		backoffsMutex.Unlock()
+	}
+}
+
+// backoffDelay doubles the wait with each consecutive failure, up to maxBackoff
+func backoffDelay(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
+
+func courseKey(course canvas.Course) string {
+	return course.GuildId + "/" + course.CourseId
+}
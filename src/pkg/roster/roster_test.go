@@ -0,0 +1,255 @@
+package roster
+
+import (
+	"errors"
+	"io/fs"
+	"slices"
+	"testing"
+	"testing/fstest"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvas/canvastest"
+	"utk-auth-go/src/pkg/store"
+)
+
+func netIds(students []canvas.Student) []string {
+	var ids []string
+	for _, student := range students {
+		ids = append(ids, student.NetId)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func students(ids ...string) []canvas.Student {
+	var list []canvas.Student
+	for _, id := range ids {
+		list = append(list, canvas.Student{NetId: id, EnrollmentType: canvas.StudentEnrollment})
+	}
+	return list
+}
+
+func TestDiffRosters(t *testing.T) {
+	tests := []struct {
+		name          string
+		previous      []canvas.Student
+		current       []canvas.Student
+		wantAdded     []string
+		wantRemoved   []string
+		wantUnchanged int
+	}{
+		{name: "first sync", current: students("a", "b"), wantAdded: []string{"a", "b"}},
+		{name: "no change", previous: students("a", "b"), current: students("b", "a"), wantUnchanged: 2},
+		{name: "adds and drops", previous: students("a", "b", "c"), current: students("b", "d"), wantAdded: []string{"d"}, wantRemoved: []string{"a", "c"}, wantUnchanged: 1},
+		{name: "everyone dropped", previous: students("a"), wantRemoved: []string{"a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := DiffRosters(test.previous, test.current)
+			if added := netIds(diff.Added); !slices.Equal(added, test.wantAdded) {
+				t.Errorf("added %q, want %q", added, test.wantAdded)
+			}
+			if removed := netIds(diff.Removed); !slices.Equal(removed, test.wantRemoved) {
+				t.Errorf("removed %q, want %q", removed, test.wantRemoved)
+			}
+			if diff.Unchanged != test.wantUnchanged {
+				t.Errorf("unchanged %d, want %d", diff.Unchanged, test.wantUnchanged)
+			}
+		})
+	}
+}
+
+func TestKeepSkipped(t *testing.T) {
+	ghost := canvas.Student{NetId: "ghost1", CanvasUserId: 204}
+	previous := []canvas.Student{ghost, {NetId: "gone1", CanvasUserId: 300}, {NetId: "kept1", CanvasUserId: 301}}
+	current := []canvas.Student{{NetId: "kept1", CanvasUserId: 301}}
+
+	tests := []struct {
+		name    string
+		skipped []canvas.SkippedEnrollment
+		want    []string
+	}{
+		{name: "nothing skipped", want: []string{"kept1"}},
+		{name: "skipped student kept", skipped: []canvas.SkippedEnrollment{{EnrollmentId: 1105, CanvasUserId: 204}}, want: []string{"ghost1", "kept1"}},
+		// an enrollment without a user can't be matched to anyone
+		{name: "skipped without a user", skipped: []canvas.SkippedEnrollment{{EnrollmentId: 1106}}, want: []string{"kept1"}},
+		{name: "skipped but still listed", skipped: []canvas.SkippedEnrollment{{CanvasUserId: 301}}, want: []string{"kept1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := keepSkipped(previous, slices.Clone(current), test.skipped)
+			if ids := netIds(got); !slices.Equal(ids, test.want) {
+				t.Errorf("got %q, want %q", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{time.Hour, 0, time.Hour},
+		{time.Hour, 1, 2 * time.Hour},
+		{time.Hour, 3, 8 * time.Hour},
+		{time.Hour, 5, maxBackoff},
+		{time.Hour, 100, maxBackoff},
+		{48 * time.Hour, 1, maxBackoff},
+	}
+
+	for _, test := range tests {
+		if got := backoffDelay(test.interval, test.failures); got != test.want {
+			t.Errorf("backoffDelay(%s, %d) = %s, want %s", test.interval, test.failures, got, test.want)
+		}
+	}
+}
+
+// emptyFixtures has course 1005, which Canvas returns no enrollments for
+var emptyFixtures = fstest.MapFS{"1005.json": {Data: []byte(`{"course": {"id": 1005, "name": "Empty"}, "sections": [], "enrollments": []}`)}}
+
+// startFakeCanvas serves fixtures and points the canvas package at them
+func startFakeCanvas(t *testing.T, fixtures fs.FS) *canvastest.Fake {
+	t.Helper()
+	fake, err := canvastest.New(fixtures)
+	if err != nil {
+		t.Fatal("loading fixtures:", err)
+	}
+	server := fake.Start()
+	t.Cleanup(server.Close)
+	t.Setenv("CANVAS_BASE_URL", server.URL)
+	return fake
+}
+
+func TestSyncCourse(t *testing.T) {
+	tests := []struct {
+		name     string
+		courseId string
+		// previous is the stored roster before the sync
+		previous []canvas.Student
+		mode     canvastest.Mode
+		// verified has left1 verified in the course, so the drop policy takes their role
+		verified bool
+		wantErr  error
+		// wantStored is how many students are stored afterwards
+		wantStored  int
+		wantAdded   int
+		wantRemoved []string
+		// wantRequests are the role changes sent to Discord
+		wantRequests []string
+	}{
+		{name: "first sync", courseId: "1001", wantStored: 28, wantAdded: 28},
+		{
+			name:         "drop",
+			courseId:     "1001",
+			previous:     append(students("ghopper1", "aturing2"), canvas.Student{NetId: "left1", EnrollmentType: canvas.StudentEnrollment}),
+			verified:     true,
+			wantStored:   28,
+			wantAdded:    26,
+			wantRemoved:  []string{"left1"},
+			wantRequests: []string{"DELETE /guilds/guild/members/user1/roles/auth"},
+		},
+		{
+			name:       "malformed enrollment isn't a drop",
+			courseId:   "1004",
+			previous:   []canvas.Student{{NetId: "ghost1", CanvasUserId: 204}},
+			wantStored: 6,
+			wantAdded:  5,
+		},
+		{name: "empty roster refused", courseId: "1005", previous: students("a", "b"), wantErr: ErrEmptyRoster, wantStored: 2},
+		{name: "empty course", courseId: "1005", wantStored: 0},
+		{name: "revoked token", courseId: "1001", previous: students("a"), mode: canvastest.Unauthorized, wantErr: canvas.ErrUnauthorized, wantStored: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			discord, dataStore := startFakeDiscord(t)
+			fixtures := canvastest.Fixtures
+			if test.courseId == "1005" {
+				fixtures = emptyFixtures
+			}
+			fake := startFakeCanvas(t, fixtures)
+			fake.SetMode(test.mode, 0)
+
+			course := canvas.Course{
+				GuildId:        "guild",
+				CourseId:       test.courseId,
+				CanvasSecret:   canvastest.Token,
+				AuthRoleId:     "auth",
+				Students:       test.previous,
+				DropPolicy:     canvas.DropRemove,
+				StaffChannelId: "staff",
+			}
+			if err := dataStore.AddCourse(course); err != nil {
+				t.Fatal(err)
+			}
+			if test.verified {
+				err := dataStore.PutVerifiedMembers(store.VerifiedMember{GuildId: "guild", CourseId: test.courseId, NetId: "left1", UserId: "user1", VerifiedAt: time.Now()})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			backoffs[courseKey(course)] = &backoff{failures: 2}
+			t.Cleanup(func() { delete(backoffs, courseKey(course)) })
+
+			diff, err := SyncCourse(course)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			stored, _ := dataStore.Students("guild", test.courseId)
+			if len(stored) != test.wantStored {
+				t.Errorf("stored %d students, want %d", len(stored), test.wantStored)
+			}
+			if len(diff.Added) != test.wantAdded {
+				t.Errorf("added %d, want %d", len(diff.Added), test.wantAdded)
+			}
+			if removed := netIds(diff.Removed); !slices.Equal(removed, test.wantRemoved) {
+				t.Errorf("removed %q, want %q", removed, test.wantRemoved)
+			}
+			if requests, _ := discord.sent(); !slices.Equal(requests, test.wantRequests) {
+				t.Errorf("requests %q, want %q", requests, test.wantRequests)
+			}
+			// only a sync that worked ends the backoff
+			if _, backingOff := backoffs[courseKey(course)]; backingOff != (err != nil) {
+				t.Errorf("backing off is %v after error %v", backingOff, err)
+			}
+		})
+	}
+}
+
+func TestSyncAllBacksOff(t *testing.T) {
+	_, dataStore := startFakeDiscord(t)
+	fake := startFakeCanvas(t, canvastest.Fixtures)
+	course := canvas.Course{GuildId: "guild", CourseId: "1001", CanvasSecret: canvastest.Token, AuthRoleId: "auth"}
+	if err := dataStore.AddCourse(course); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { delete(backoffs, courseKey(course)) })
+
+	now := time.Now()
+	fake.SetMode(canvastest.Unauthorized, 0)
+	syncAll(now, time.Hour)
+	state := backoffs[courseKey(course)]
+	if state == nil || state.failures != 1 || !state.retryAt.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("backoff after a failure is %+v", state)
+	}
+
+	// a tick before retryAt leaves the course alone
+	requests := fake.Requests()
+	syncAll(now.Add(time.Hour), time.Hour)
+	if fake.Requests() != requests {
+		t.Errorf("synced during the backoff")
+	}
+
+	fake.SetMode(canvastest.Normal, 0)
+	syncAll(now.Add(2*time.Hour), time.Hour)
+	if _, backingOff := backoffs[courseKey(course)]; backingOff {
+		t.Error("still backing off after a sync that worked")
+	}
+	if stored, _ := dataStore.Students("guild", "1001"); len(stored) != 28 {
+		t.Errorf("stored %d students", len(stored))
+	}
+}
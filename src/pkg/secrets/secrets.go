@@ -0,0 +1,199 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// prefix marks an encrypted value, anything without it is plaintext
+const prefix = "enc:v1:"
+
+var (
+	ErrMalformed  = errors.New("malformed encrypted secret")
+	ErrUnknownKey = errors.New("encrypted secret uses an unknown key")
+)
+
+// Key is one key-encryption key of a keyring
+type Key struct {
+	Id     string
+	Secret []byte
+}
+
+// Keyring does envelope encryption: every value gets its own random data key,
+// and the data key is stored wrapped by the newest key of the keyring. Older
+// keys only unwrap, so a new key can be rolled out and the values re-encrypted
+// at leisure.
+type Keyring struct {
+	// keys[0] is the newest key and the only one used for wrapping
+	keys []Key
+}
+
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring needs at least one key")
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.Id == "" || strings.Contains(key.Id, ":") {
+			return nil, fmt.Errorf("invalid key id %q", key.Id)
+		}
+		if len(key.Secret) != 32 {
+			return nil, fmt.Errorf("key %q is not 32 bytes", key.Id)
+		}
+		if seen[key.Id] {
+			return nil, fmt.Errorf("duplicate key id %q", key.Id)
+		}
+		seen[key.Id] = true
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// ParseKeyring reads a keyring in the form "id:base64key,id:base64key", newest
+// key first
+func ParseKeyring(value string) (*Keyring, error) {
+	var keys []Key
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("key entry %q is not in the form id:key", entry)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %w", id, err)
+		}
+		keys = append(keys, Key{Id: id, Secret: secret})
+	}
+	return NewKeyring(keys...)
+}
+
+// KeyringFromEnv reads SECRETS_KEYS, or the file named by SECRETS_KEY_FILE,
+// returning nil if neither is set
+func KeyringFromEnv() (*Keyring, error) {
+	if value := os.Getenv("SECRETS_KEYS"); value != "" {
+		return ParseKeyring(value)
+	}
+	if path := os.Getenv("SECRETS_KEY_FILE"); path != "" {
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKeyring(string(value))
+	}
+	return nil, nil
+}
+
+// IsEncrypted reports whether value came from Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt returns plaintext encrypted under a fresh data key, in the form
+// enc:v1:keyId:wrappedDataKey:ciphertext
+func (keyring *Keyring) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	key := keyring.keys[0]
+	wrapped, err := seal(key.Secret, dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return prefix + key.Id + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt reverses Encrypt, passing plaintext values through untouched so
+// secrets stored before encryption was turned on keep working
+func (keyring *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	key := keyring.key(parts[0])
+	if key == nil {
+		return "", ErrUnknownKey
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	dataKey, err := open(key.Secret, wrapped)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Current reports whether value is encrypted under the newest key
+func (keyring *Keyring) Current(value string) bool {
+	return strings.HasPrefix(value, prefix+keyring.keys[0].Id+":")
+}
+
+func (keyring *Keyring) key(id string) *Key {
+	for i := range keyring.keys {
+		if keyring.keys[i].Id == id {
+			return &keyring.keys[i]
+		}
+	}
+	return nil
+}
+
+// seal encrypts with AES-256-GCM and puts the nonce in front of the ciphertext
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key []byte, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
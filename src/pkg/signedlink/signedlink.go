@@ -0,0 +1,155 @@
+package signedlink
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed        = errors.New("malformed signed token")
+	ErrUnknownKey       = errors.New("signed token uses an unknown key")
+	ErrInvalidSignature = errors.New("signed token has an invalid signature")
+	ErrExpired          = errors.New("signed token has expired")
+)
+
+// Claims is the payload carried by a signed verification link. Nonce is
+// unique to the link, so a used link can be told apart from a fresh one.
+type Claims struct {
+	UserId    string `json:"uid"`
+	GuildId   string `json:"gid"`
+	CourseId  string `json:"cid,omitempty"`
+	NetId     string `json:"nid"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"n"`
+}
+
+// Key is one HMAC key of a keyring
+type Key struct {
+	Id     string
+	Secret []byte
+}
+
+// Keyring signs with its newest key and verifies with any of its keys, so a new
+// key can be rolled out without invalidating links signed with the old one
+type Keyring struct {
+	// keys[0] is the newest key and the only one used for signing
+	keys []Key
+}
+
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring needs at least one key")
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.Id == "" || strings.Contains(key.Id, ".") {
+			return nil, fmt.Errorf("invalid key id %q", key.Id)
+		}
+		if len(key.Secret) < 32 {
+			return nil, fmt.Errorf("key %q is shorter than 32 bytes", key.Id)
+		}
+		if seen[key.Id] {
+			return nil, fmt.Errorf("duplicate key id %q", key.Id)
+		}
+		seen[key.Id] = true
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// ParseKeyring reads a keyring in the form "id:base64secret,id:base64secret",
+// newest key first
+func ParseKeyring(value string) (*Keyring, error) {
+	var keys []Key
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("key entry %q is not in the form id:secret", entry)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %w", id, err)
+		}
+		keys = append(keys, Key{Id: id, Secret: secret})
+	}
+	return NewKeyring(keys...)
+}
+
+// Sign returns a token of the form keyId.payload.signature for claims,
+// filling in a random nonce
+func (keyring *Keyring) Sign(claims Claims) (string, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	claims.Nonce = hex.EncodeToString(nonce)
+
+	payloadBytes, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	key := keyring.keys[0]
+	signed := key.Id + "." + base64.RawURLEncoding.EncodeToString(payloadBytes)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key.Secret, signed)), nil
+}
+
+// Verify checks the token's signature against the keyring and returns its
+// claims. A correctly signed token that has expired at now returns its claims
+// along with ErrExpired.
+func (keyring *Keyring) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var key *Key
+	for i := range keyring.keys {
+		if keyring.keys[i].Id == parts[0] {
+			key = &keyring.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal(signature, sign(key.Secret, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidSignature
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	// the nonce is what makes a link single use
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil || claims.Nonce == "" {
+		return nil, ErrMalformed
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return &claims, ErrExpired
+	}
+	return &claims, nil
+}
+
+func sign(secret []byte, data string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,140 @@
+package signedlink
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	var keys []Key
+	for _, id := range ids {
+		keys = append(keys, Key{Id: id, Secret: bytes.Repeat([]byte(id[:1]), 32)})
+	}
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// signedWith signs payload with key as Sign would, without filling in a nonce
+func signedWith(key Key, payload string) string {
+	signed := key.Id + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key.Secret, signed))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	claims := Claims{UserId: "user", GuildId: "guild", CourseId: "1001", NetId: "abc123", ExpiresAt: now.Add(time.Hour).Unix()}
+	signer := testKeyring(t, "k1")
+	token, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		token   string
+		now     time.Time
+		err     error
+		// claims reports whether the claims come back along with err
+		claims bool
+	}{
+		{name: "valid", keyring: signer, token: token, now: now, claims: true},
+		{name: "signed with an older key", keyring: testKeyring(t, "k2", "k1"), token: token, now: now, claims: true},
+		{name: "key dropped from the keyring", keyring: testKeyring(t, "k2"), token: token, now: now, err: ErrUnknownKey},
+		{name: "moved to another key id", keyring: testKeyring(t, "k1x"), token: "k1x." + parts[1] + "." + parts[2], now: now, err: ErrInvalidSignature},
+		{name: "tampered payload", keyring: signer, token: parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"uid":"admin"}`)) + "." + parts[2], now: now, err: ErrInvalidSignature},
+		{name: "tampered signature", keyring: signer, token: parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(make([]byte, 32)), now: now, err: ErrInvalidSignature},
+		{name: "signature not base64", keyring: signer, token: parts[0] + "." + parts[1] + ".!!", now: now, err: ErrMalformed},
+		{name: "missing a part", keyring: signer, token: parts[0] + "." + parts[1], now: now, err: ErrMalformed},
+		{name: "no nonce", keyring: signer, token: signedWith(signer.keys[0], `{"uid":"user","exp":1800003600}`), now: now, err: ErrMalformed},
+		{name: "payload not JSON", keyring: signer, token: signedWith(signer.keys[0], "not json"), now: now, err: ErrMalformed},
+		{name: "last second before expiry", keyring: signer, token: token, now: now.Add(time.Hour - time.Second), claims: true},
+		{name: "expired", keyring: signer, token: token, now: now.Add(time.Hour), err: ErrExpired, claims: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.keyring.Verify(test.token, test.now)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if !test.claims {
+				if got != nil {
+					t.Errorf("got claims %+v with %v", got, err)
+				}
+				return
+			}
+			want := claims
+			want.Nonce = got.Nonce
+			if *got != want || len(got.Nonce) != 24 {
+				t.Errorf("got %+v, want %+v", *got, want)
+			}
+		})
+	}
+}
+
+func TestSignNonces(t *testing.T) {
+	keyring := testKeyring(t, "k1")
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token, err := keyring.Sign(Claims{UserId: "user", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := keyring.Verify(token, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[claims.Nonce] {
+			t.Fatalf("nonce %s repeated", claims.Nonce)
+		}
+		seen[claims.Nonce] = true
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("s"), 32))
+	short := base64.StdEncoding.EncodeToString([]byte("short"))
+	tests := []struct {
+		name  string
+		value string
+		ids   []string
+		valid bool
+	}{
+		{name: "one key", value: "k1:" + secret, ids: []string{"k1"}, valid: true},
+		{name: "newest first", value: " k2:" + secret + ", k1:" + secret + ",", ids: []string{"k2", "k1"}, valid: true},
+		{name: "empty", value: ""},
+		{name: "missing id", value: secret},
+		{name: "dot in id", value: "k.1:" + secret},
+		{name: "short secret", value: "k1:" + short},
+		{name: "duplicate id", value: "k1:" + secret + ",k1:" + secret},
+		{name: "not base64", value: "k1:!!!"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyring, err := ParseKeyring(test.value)
+			if (err == nil) != test.valid {
+				t.Fatalf("got error %v", err)
+			}
+			if !test.valid {
+				return
+			}
+			var ids []string
+			for _, key := range keyring.keys {
+				ids = append(ids, key.Id)
+			}
+			if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+				t.Errorf("got keys %v, want %v", ids, test.ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"log"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/secrets"
+)
+
+// EncryptedStore wraps another store so Canvas secrets are encrypted before
+// they're saved and decrypted when they're read. Everything else passes through.
+type EncryptedStore struct {
+	Store
+	keyring *secrets.Keyring
+}
+
+func NewEncryptedStore(inner Store, keyring *secrets.Keyring) *EncryptedStore {
+	return &EncryptedStore{Store: inner, keyring: keyring}
+}
+
+func (store *EncryptedStore) Courses() ([]canvas.Course, error) {
+	courses, err := store.Store.Courses()
+	if err != nil {
+		return nil, err
+	}
+	return store.decryptCourses(courses)
+}
+
+func (store *EncryptedStore) GuildCourses(guildId string) ([]canvas.Course, error) {
+	courses, err := store.Store.GuildCourses(guildId)
+	if err != nil {
+		return nil, err
+	}
+	return store.decryptCourses(courses)
+}
+
+func (store *EncryptedStore) Course(guildId string, courseId string) (*canvas.Course, error) {
+	course, err := store.Store.Course(guildId, courseId)
+	if err != nil || course == nil {
+		return course, err
+	}
+	if err := store.decryptCourse(course); err != nil {
+		return nil, err
+	}
+	return course, nil
+}
+
+func (store *EncryptedStore) AddCourse(course canvas.Course) error {
+	if err := store.encryptCourse(&course); err != nil {
+		return err
+	}
+	return store.Store.AddCourse(course)
+}
+
+func (store *EncryptedStore) SetCanvasToken(guildId string, courseId string, accessToken string, refreshToken string, expiresAt time.Time) error {
+	course := canvas.Course{CanvasSecret: accessToken, CanvasRefreshToken: refreshToken}
+	if err := store.encryptCourse(&course); err != nil {
+		return err
+	}
+	return store.Store.SetCanvasToken(guildId, courseId, course.CanvasSecret, course.CanvasRefreshToken, expiresAt)
+}
+
+func (store *EncryptedStore) MoveCourse(courseId string, course canvas.Course) error {
+	if err := store.encryptCourse(&course); err != nil {
+		return err
+	}
+	return store.Store.MoveCourse(courseId, course)
+}
+
+func (store *EncryptedStore) decryptCourses(courses []canvas.Course) ([]canvas.Course, error) {
+	for i := range courses {
+		if err := store.decryptCourse(&courses[i]); err != nil {
+			return nil, err
+		}
+	}
+	return courses, nil
+}
+
+// encryptCourse encrypts the course's Canvas secret and OAuth refresh token
+func (store *EncryptedStore) encryptCourse(course *canvas.Course) error {
+	var err error
+	course.CanvasSecret, err = store.keyring.Encrypt(course.CanvasSecret)
+	if err != nil {
+		return err
+	}
+	if course.CanvasRefreshToken != "" {
+		course.CanvasRefreshToken, err = store.keyring.Encrypt(course.CanvasRefreshToken)
+	}
+	return err
+}
+
+func (store *EncryptedStore) decryptCourse(course *canvas.Course) error {
+	var err error
+	course.CanvasSecret, err = store.keyring.Decrypt(course.CanvasSecret)
+	if err != nil {
+		return err
+	}
+	course.CanvasRefreshToken, err = store.keyring.Decrypt(course.CanvasRefreshToken)
+	return err
+}
+
+// needsEncrypting reports whether Reencrypt has work to do for a stored value
+func (store *EncryptedStore) needsEncrypting(value string, rotate bool) bool {
+	if value == "" || store.keyring.Current(value) {
+		return false
+	}
+	return rotate || !secrets.IsEncrypted(value)
+}
+
+// Reencrypt encrypts every plaintext Canvas secret and refresh token with the
+// keyring's newest key and returns how many courses it changed. With rotate set
+// it re-encrypts values under older keys too, after which the older keys can be
+// dropped.
+func (store *EncryptedStore) Reencrypt(rotate bool) (int, error) {
+	courses, err := store.Store.Courses()
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, course := range courses {
+		if !store.needsEncrypting(course.CanvasSecret, rotate) && !store.needsEncrypting(course.CanvasRefreshToken, rotate) {
+			continue
+		}
+		if err := store.decryptCourse(&course); err != nil {
+			return changed, err
+		}
+		if err := store.SetCanvasToken(course.GuildId, course.CourseId, course.CanvasSecret, course.CanvasRefreshToken, course.CanvasTokenExpiresAt); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	if changed > 0 {
+		log.Println("Encrypted the Canvas secrets of", changed, "courses")
+	}
+	return changed, nil
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"utk-auth-go/src/pkg/secrets"
+)
+
+func testKeyring(t *testing.T, ids ...string) *secrets.Keyring {
+	t.Helper()
+	var keys []secrets.Key
+	for _, id := range ids {
+		keys = append(keys, secrets.Key{Id: id, Secret: bytes.Repeat([]byte(id[:1]), 32)})
+	}
+	keyring, err := secrets.NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestReencrypt(t *testing.T) {
+	oldKeys := []string{"old"}
+	rotatedKeys := []string{"new", "old"}
+
+	tests := []struct {
+		name string
+		// savedWith encrypts the course before the test, nil saves it in plaintext
+		savedWith    []string
+		refreshToken string
+		keys         []string
+		rotate       bool
+		changed      int
+		// wantKey is the key the stored values end up under, empty for plaintext
+		wantKey string
+	}{
+		{name: "plaintext gets encrypted", keys: oldKeys, changed: 1, wantKey: "old"},
+		{name: "plaintext refresh token gets encrypted", refreshToken: "refresh", keys: oldKeys, changed: 1, wantKey: "old"},
+		{name: "current key left alone", savedWith: oldKeys, keys: oldKeys, rotate: true, changed: 0, wantKey: "old"},
+		{name: "older key kept without rotate", savedWith: oldKeys, keys: rotatedKeys, changed: 0, wantKey: "old"},
+		{name: "older key rotated", savedWith: oldKeys, refreshToken: "refresh", keys: rotatedKeys, rotate: true, changed: 1, wantKey: "new"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner := NewMemoryStore()
+			course := testCourse("1001")
+			course.CanvasRefreshToken = test.refreshToken
+			var err error
+			if test.savedWith != nil {
+				err = NewEncryptedStore(inner, testKeyring(t, test.savedWith...)).AddCourse(course)
+			} else {
+				err = inner.AddCourse(course)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keyring := testKeyring(t, test.keys...)
+			encrypted := NewEncryptedStore(inner, keyring)
+			changed, err := encrypted.Reencrypt(test.rotate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != test.changed {
+				t.Errorf("changed %d courses, want %d", changed, test.changed)
+			}
+
+			stored, err := inner.Course("guild", "1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, value := range []string{stored.CanvasSecret, stored.CanvasRefreshToken} {
+				if value == "" {
+					continue
+				}
+				if !secrets.IsEncrypted(value) || !strings.HasPrefix(value, "enc:v1:"+test.wantKey+":") {
+					t.Errorf("stored %q, want it under key %q", value, test.wantKey)
+				}
+			}
+
+			read, err := encrypted.Course("guild", "1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.CanvasSecret != course.CanvasSecret || read.CanvasRefreshToken != course.CanvasRefreshToken {
+				t.Errorf("read back %q and %q", read.CanvasSecret, read.CanvasRefreshToken)
+			}
+		})
+	}
+}
+
+func TestEncryptedStoreAfterRotation(t *testing.T) {
+	inner := NewMemoryStore()
+	course := testCourse("1001")
+	if err := NewEncryptedStore(inner, testKeyring(t, "old")).AddCourse(course); err != nil {
+		t.Fatal(err)
+	}
+
+	// until the rotation the old key is still needed
+	if _, err := NewEncryptedStore(inner, testKeyring(t, "new")).Courses(); !errors.Is(err, secrets.ErrUnknownKey) {
+		t.Errorf("reading without the old key got %v", err)
+	}
+	if _, err := NewEncryptedStore(inner, testKeyring(t, "new", "old")).Reencrypt(true); err != nil {
+		t.Fatal(err)
+	}
+
+	moved := course
+	moved.CourseId = "2002"
+	dropped := NewEncryptedStore(inner, testKeyring(t, "new"))
+	if err := dropped.MoveCourse("1001", moved); err != nil {
+		t.Fatal(err)
+	}
+	courses, err := dropped.Courses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(courses) != 1 || courses[0].CourseId != "2002" || courses[0].CanvasSecret != course.CanvasSecret || len(courses[0].Students) != len(course.Students) {
+		t.Errorf("got %+v", courses)
+	}
+	if stored, _ := inner.Course("guild", "2002"); stored == nil || !secrets.IsEncrypted(stored.CanvasSecret) {
+		t.Errorf("stored %+v", stored)
+	}
+}
+
+func TestEncryptedSetCanvasToken(t *testing.T) {
+	inner := NewMemoryStore()
+	encrypted := NewEncryptedStore(inner, testKeyring(t, "k1"))
+	if err := encrypted.AddCourse(testCourse("1001")); err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.SetCanvasToken("guild", "1001", "access", "refresh", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := inner.Course("guild", "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secrets.IsEncrypted(stored.CanvasSecret) || !secrets.IsEncrypted(stored.CanvasRefreshToken) {
+		t.Errorf("stored %q and %q", stored.CanvasSecret, stored.CanvasRefreshToken)
+	}
+	read, err := encrypted.Course("guild", "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.CanvasSecret != "access" || read.CanvasRefreshToken != "refresh" {
+		t.Errorf("read back %q and %q", read.CanvasSecret, read.CanvasRefreshToken)
+	}
+}
@@ -0,0 +1,809 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+)
+
+// JSONStore keeps courses in server_config.json, pending tokens in tokens.json,
+// verification records in verified_members.json, the email outbox in outbox.json,
+// the used nonces of signed links in nonces.json and the /registercourse requests
+// waiting on Canvas OAuth in connect_requests.json
+type JSONStore struct {
+	mutex        sync.Mutex
+	configPath   string
+	tokensPath   string
+	membersPath  string
+	outboxPath   string
+	noncesPath   string
+	connectsPath string
+}
+
+func NewJSONStore(dir string) (*JSONStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("Error creating data directory:", err)
+		return nil, err
+	}
+
+	return &JSONStore{
+		configPath:   filepath.Join(dir, "server_config.json"),
+		tokensPath:   filepath.Join(dir, "tokens.json"),
+		membersPath:  filepath.Join(dir, "verified_members.json"),
+		outboxPath:   filepath.Join(dir, "outbox.json"),
+		noncesPath:   filepath.Join(dir, "nonces.json"),
+		connectsPath: filepath.Join(dir, "connect_requests.json"),
+	}, nil
+}
+
+// readConfig loads server_config.json, treating a missing or empty file as no courses
+func (store *JSONStore) readConfig() (ServerConfig, error) {
+	serverConfig := ServerConfig{Courses: []canvas.Course{}}
+
+	file, err := os.ReadFile(store.configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return serverConfig, nil
+		}
+		log.Println("Error reading server_config.json:", err)
+		return serverConfig, err
+	}
+	if len(file) == 0 {
+		return serverConfig, nil
+	}
+
+	err = json.Unmarshal(file, &serverConfig)
+	if err != nil {
+		log.Println("Error unmarshalling server_config.json:", err)
+		return serverConfig, err
+	}
+	return serverConfig, nil
+}
+
+func (store *JSONStore) writeConfig(serverConfig ServerConfig) error {
+	serverConfigBytes, err := json.Marshal(serverConfig)
+	if err != nil {
+		log.Println("Error marshalling server_config.json:", err)
+		return err
+	}
+	err = writeFileAtomic(store.configPath, serverConfigBytes)
+	if err != nil {
+		log.Println("Error writing server_config.json:", err)
+		return err
+	}
+	return nil
+}
+
+// readTokens loads tokens.json, treating a missing or empty file as no tokens
+func (store *JSONStore) readTokens() (map[string]TokenData, error) {
+	tokens := make(map[string]TokenData)
+
+	file, err := os.ReadFile(store.tokensPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tokens, nil
+		}
+		log.Println("Error reading tokens.json:", err)
+		return nil, err
+	}
+	if len(file) == 0 {
+		return tokens, nil
+	}
+
+	err = json.Unmarshal(file, &tokens)
+	if err != nil {
+		log.Println("Error unmarshalling tokens.json:", err)
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (store *JSONStore) writeTokens(tokens map[string]TokenData) error {
+	tokensBytes, err := json.Marshal(tokens)
+	if err != nil {
+		log.Println("Error marshalling tokens.json:", err)
+		return err
+	}
+	err = writeFileAtomic(store.tokensPath, tokensBytes)
+	if err != nil {
+		log.Println("Error writing tokens.json:", err)
+		return err
+	}
+	return nil
+}
+
+// readNonces loads nonces.json, treating a missing or empty file as no used nonces
+func (store *JSONStore) readNonces() (map[string]time.Time, error) {
+	nonces := make(map[string]time.Time)
+
+	file, err := os.ReadFile(store.noncesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nonces, nil
+		}
+		log.Println("Error reading nonces.json:", err)
+		return nil, err
+	}
+	if len(file) == 0 {
+		return nonces, nil
+	}
+
+	err = json.Unmarshal(file, &nonces)
+	if err != nil {
+		log.Println("Error unmarshalling nonces.json:", err)
+		return nil, err
+	}
+	return nonces, nil
+}
+
+func (store *JSONStore) writeNonces(nonces map[string]time.Time) error {
+	noncesBytes, err := json.Marshal(nonces)
+	if err != nil {
+		log.Println("Error marshalling nonces.json:", err)
+		return err
+	}
+	err = writeFileAtomic(store.noncesPath, noncesBytes)
+	if err != nil {
+		log.Println("Error writing nonces.json:", err)
+		return err
+	}
+	return nil
+}
+
+// readConnectRequests loads connect_requests.json, treating a missing or empty file as no requests
+func (store *JSONStore) readConnectRequests() (map[string]ConnectRequest, error) {
+	requests := make(map[string]ConnectRequest)
+
+	file, err := os.ReadFile(store.connectsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return requests, nil
+		}
+		log.Println("Error reading connect_requests.json:", err)
+		return nil, err
+	}
+	if len(file) == 0 {
+		return requests, nil
+	}
+
+	err = json.Unmarshal(file, &requests)
+	if err != nil {
+		log.Println("Error unmarshalling connect_requests.json:", err)
+		return nil, err
+	}
+	return requests, nil
+}
+
+func (store *JSONStore) writeConnectRequests(requests map[string]ConnectRequest) error {
+	requestsBytes, err := json.Marshal(requests)
+	if err != nil {
+		log.Println("Error marshalling connect_requests.json:", err)
+		return err
+	}
+	err = writeFileAtomic(store.connectsPath, requestsBytes)
+	if err != nil {
+		log.Println("Error writing connect_requests.json:", err)
+		return err
+	}
+	return nil
+}
+
+// readMembers loads verified_members.json, treating a missing or empty file as no records
+func (store *JSONStore) readMembers() ([]VerifiedMember, error) {
+	members := []VerifiedMember{}
+
+	file, err := os.ReadFile(store.membersPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return members, nil
+		}
+		log.Println("Error reading verified_members.json:", err)
+		return nil, err
+	}
+	if len(file) == 0 {
+		return members, nil
+	}
+
+	err = json.Unmarshal(file, &members)
+	if err != nil {
+		log.Println("Error unmarshalling verified_members.json:", err)
+		return nil, err
+	}
+	return members, nil
+}
+
+func (store *JSONStore) writeMembers(members []VerifiedMember) error {
+	membersBytes, err := json.Marshal(members)
+	if err != nil {
+		log.Println("Error marshalling verified_members.json:", err)
+		return err
+	}
+	err = writeFileAtomic(store.membersPath, membersBytes)
+	if err != nil {
+		log.Println("Error writing verified_members.json:", err)
+		return err
+	}
+	return nil
+}
+
+// readEmails loads outbox.json, treating a missing or empty file as an empty outbox
+func (store *JSONStore) readEmails() ([]OutboxEmail, error) {
+	emails := []OutboxEmail{}
+
+	file, err := os.ReadFile(store.outboxPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return emails, nil
+		}
+		log.Println("Error reading outbox.json:", err)
+		return nil, err
+	}
+	if len(file) == 0 {
+		return emails, nil
+	}
+
+	err = json.Unmarshal(file, &emails)
+	if err != nil {
+		log.Println("Error unmarshalling outbox.json:", err)
+		return nil, err
+	}
+	return emails, nil
+}
+
+func (store *JSONStore) writeEmails(emails []OutboxEmail) error {
+	emailsBytes, err := json.Marshal(emails)
+	if err != nil {
+		log.Println("Error marshalling outbox.json:", err)
+		return err
+	}
+	err = writeFileAtomic(store.outboxPath, emailsBytes)
+	if err != nil {
+		log.Println("Error writing outbox.json:", err)
+		return err
+	}
+	return nil
+}
+
+func (store *JSONStore) Courses() ([]canvas.Course, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	return serverConfig.Courses, nil
+}
+
+func (store *JSONStore) GuildCourses(guildId string) ([]canvas.Course, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	return guildCourses(serverConfig.Courses, guildId), nil
+}
+
+func (store *JSONStore) Course(guildId string, courseId string) (*canvas.Course, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	if i := findCourse(serverConfig.Courses, guildId, courseId); i >= 0 {
+		return &serverConfig.Courses[i], nil
+	}
+	return nil, nil
+}
+
+func (store *JSONStore) AddCourse(course canvas.Course) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return err
+	}
+	if findCourse(serverConfig.Courses, course.GuildId, course.CourseId) >= 0 {
+		return ErrCourseExists
+	}
+	serverConfig.Courses = append(serverConfig.Courses, course)
+	return store.writeConfig(serverConfig)
+}
+
+func (store *JSONStore) UpdateCourse(course canvas.Course) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return err
+	}
+	i := findCourse(serverConfig.Courses, course.GuildId, course.CourseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	serverConfig.Courses[i] = updatedCourse(serverConfig.Courses[i], course)
+	return store.writeConfig(serverConfig)
+}
+
+func (store *JSONStore) SetCanvasToken(guildId string, courseId string, accessToken string, refreshToken string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return err
+	}
+	i := findCourse(serverConfig.Courses, guildId, courseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	setCanvasToken(&serverConfig.Courses[i], accessToken, refreshToken, expiresAt)
+	return store.writeConfig(serverConfig)
+}
+
+func (store *JSONStore) RemoveCourse(guildId string, courseId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return err
+	}
+	i := findCourse(serverConfig.Courses, guildId, courseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	members, err := store.readMembers()
+	if err != nil {
+		return err
+	}
+
+	serverConfig.Courses = append(serverConfig.Courses[:i], serverConfig.Courses[i+1:]...)
+	if err := store.writeConfig(serverConfig); err != nil {
+		return err
+	}
+	return store.writeMembers(filterVerifiedMembers(members, func(member VerifiedMember) bool {
+		return member.GuildId != guildId || member.CourseId != courseId
+	}))
+}
+
+func (store *JSONStore) MoveCourse(courseId string, course canvas.Course) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return err
+	}
+	i := findCourse(serverConfig.Courses, course.GuildId, courseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	if course.CourseId != courseId && findCourse(serverConfig.Courses, course.GuildId, course.CourseId) >= 0 {
+		return ErrCourseExists
+	}
+	members, err := store.readMembers()
+	if err != nil {
+		return err
+	}
+	tokens, err := store.readTokens()
+	if err != nil {
+		return err
+	}
+
+	moved := slices.Clone(members)
+	moveVerifiedMembers(moved, course.GuildId, courseId, course.CourseId)
+	movedTokens := maps.Clone(tokens)
+	moveTokens(movedTokens, course.GuildId, courseId, course.CourseId)
+
+	// three files can't change together, so a write that fails puts back the
+	// ones before it. If putting them back fails too the files disagree until
+	// the move is retried, and the error says so.
+	original := serverConfig.Courses[i]
+	serverConfig.Courses[i] = course
+	if err := store.writeConfig(serverConfig); err != nil {
+		return err
+	}
+	if err := store.writeMembers(moved); err != nil {
+		serverConfig.Courses[i] = original
+		return errors.Join(err, store.writeConfig(serverConfig))
+	}
+	if err := store.writeTokens(movedTokens); err != nil {
+		serverConfig.Courses[i] = original
+		return errors.Join(err, store.writeMembers(members), store.writeConfig(serverConfig))
+	}
+	return nil
+}
+
+func (store *JSONStore) Students(guildId string, courseId string) ([]canvas.Student, error) {
+	course, err := store.Course(guildId, courseId)
+	if err != nil {
+		return nil, err
+	}
+	if course == nil {
+		return nil, ErrCourseNotFound
+	}
+	return course.Students, nil
+}
+
+func (store *JSONStore) SetStudents(guildId string, courseId string, students []canvas.Student) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	serverConfig, err := store.readConfig()
+	if err != nil {
+		return err
+	}
+	i := findCourse(serverConfig.Courses, guildId, courseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	serverConfig.Courses[i].Students = students
+	return store.writeConfig(serverConfig)
+}
+
+func (store *JSONStore) Token(userId string) (*TokenData, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tokens, err := store.readTokens()
+	if err != nil {
+		return nil, err
+	}
+	if tokenData, ok := tokens[userId]; ok {
+		return &tokenData, nil
+	}
+	return nil, nil
+}
+
+func (store *JSONStore) CreateToken(userId string, token TokenData) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tokens, err := store.readTokens()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[userId]; ok {
+		return ErrTokenExists
+	}
+	tokens[userId] = token
+	return store.writeTokens(tokens)
+}
+
+func (store *JSONStore) TakeToken(userId string, token string) (*TokenData, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tokens, err := store.readTokens()
+	if err != nil {
+		return nil, err
+	}
+	tokenData, ok := tokens[userId]
+	if !ok || tokenData.Token != token {
+		return nil, nil
+	}
+	delete(tokens, userId)
+	if err := store.writeTokens(tokens); err != nil {
+		return nil, err
+	}
+	return &tokenData, nil
+}
+
+func (store *JSONStore) DeleteToken(userId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tokens, err := store.readTokens()
+	if err != nil {
+		return err
+	}
+	delete(tokens, userId)
+	return store.writeTokens(tokens)
+}
+
+func (store *JSONStore) DeleteExpiredTokens(now time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tokens, err := store.readTokens()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for userId, tokenData := range tokens {
+		if tokenData.Expired(now) {
+			delete(tokens, userId)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, store.writeTokens(tokens)
+}
+
+func (store *JSONStore) UseNonce(nonce string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	nonces, err := store.readNonces()
+	if err != nil {
+		return err
+	}
+	if _, ok := nonces[nonce]; ok {
+		return ErrNonceUsed
+	}
+	nonces[nonce] = expiresAt
+	return store.writeNonces(nonces)
+}
+
+func (store *JSONStore) ReleaseNonce(nonce string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	nonces, err := store.readNonces()
+	if err != nil {
+		return err
+	}
+	if _, ok := nonces[nonce]; !ok {
+		return nil
+	}
+	delete(nonces, nonce)
+	return store.writeNonces(nonces)
+}
+
+func (store *JSONStore) DeleteExpiredNonces(now time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	nonces, err := store.readNonces()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for nonce, expiresAt := range nonces {
+		if !now.Before(expiresAt) {
+			delete(nonces, nonce)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, store.writeNonces(nonces)
+}
+
+func (store *JSONStore) PutConnectRequest(state string, request ConnectRequest) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	requests, err := store.readConnectRequests()
+	if err != nil {
+		return err
+	}
+	requests[state] = request
+	return store.writeConnectRequests(requests)
+}
+
+func (store *JSONStore) TakeConnectRequest(state string, now time.Time) (*ConnectRequest, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	requests, err := store.readConnectRequests()
+	if err != nil {
+		return nil, err
+	}
+	request, ok := requests[state]
+	if !ok {
+		return nil, nil
+	}
+	delete(requests, state)
+	if err := store.writeConnectRequests(requests); err != nil {
+		return nil, err
+	}
+	if !now.Before(request.ExpiresAt) {
+		return nil, nil
+	}
+	return &request, nil
+}
+
+func (store *JSONStore) DeleteExpiredConnectRequests(now time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	requests, err := store.readConnectRequests()
+	if err != nil {
+		return 0, err
+	}
+	removed := deleteExpiredConnectRequests(requests, now)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, store.writeConnectRequests(requests)
+}
+
+func (store *JSONStore) PutVerifiedMembers(members ...VerifiedMember) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stored, err := store.readMembers()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		stored = putVerifiedMember(stored, member)
+	}
+	return store.writeMembers(stored)
+}
+
+func (store *JSONStore) BindVerifiedMembers(mode BindMode, members ...VerifiedMember) ([]VerifiedMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stored, err := store.readMembers()
+	if err != nil {
+		return nil, err
+	}
+	stored, others, err := bindVerifiedMembers(stored, mode, members)
+	if err != nil {
+		return others, err
+	}
+	return others, store.writeMembers(stored)
+}
+
+func (store *JSONStore) DeleteVerifiedMember(guildId string, courseId string, netId string, userId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	members, err := store.readMembers()
+	if err != nil {
+		return err
+	}
+	return store.writeMembers(filterVerifiedMembers(members, func(member VerifiedMember) bool {
+		return member.GuildId != guildId || member.CourseId != courseId || member.NetId != netId || member.UserId != userId
+	}))
+}
+
+func (store *JSONStore) VerifiedMembersByNetId(guildId string, netId string) ([]VerifiedMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	members, err := store.readMembers()
+	if err != nil {
+		return nil, err
+	}
+	return filterVerifiedMembers(members, func(member VerifiedMember) bool {
+		return member.GuildId == guildId && member.NetId == netId
+	}), nil
+}
+
+func (store *JSONStore) VerifiedMembersByUser(guildId string, userId string) ([]VerifiedMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	members, err := store.readMembers()
+	if err != nil {
+		return nil, err
+	}
+	return filterVerifiedMembers(members, func(member VerifiedMember) bool {
+		return member.GuildId == guildId && member.UserId == userId
+	}), nil
+}
+
+func (store *JSONStore) VerifiedMembersByCourse(guildId string, courseId string) ([]VerifiedMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	members, err := store.readMembers()
+	if err != nil {
+		return nil, err
+	}
+	return filterVerifiedMembers(members, func(member VerifiedMember) bool {
+		return member.GuildId == guildId && member.CourseId == courseId
+	}), nil
+}
+
+func (store *JSONStore) EnqueueEmail(email OutboxEmail) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	emails, err := store.readEmails()
+	if err != nil {
+		return err
+	}
+	return store.writeEmails(append(emails, email))
+}
+
+func (store *JSONStore) DueEmails(now time.Time, limit int) ([]OutboxEmail, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	emails, err := store.readEmails()
+	if err != nil {
+		return nil, err
+	}
+	return dueEmails(emails, now, limit), nil
+}
+
+func (store *JSONStore) UpdateEmail(email OutboxEmail) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	emails, err := store.readEmails()
+	if err != nil {
+		return err
+	}
+	if err := putEmail(emails, email); err != nil {
+		return err
+	}
+	return store.writeEmails(emails)
+}
+
+func (store *JSONStore) Emails(status string) ([]OutboxEmail, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	emails, err := store.readEmails()
+	if err != nil {
+		return nil, err
+	}
+	return filterEmails(emails, func(email OutboxEmail) bool {
+		return email.Status == status
+	}), nil
+}
+
+func (store *JSONStore) DeleteEmails(status string, before time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	emails, err := store.readEmails()
+	if err != nil {
+		return 0, err
+	}
+	kept := filterEmails(emails, func(email OutboxEmail) bool {
+		return email.Status != status || !email.FinishedAt.Before(before)
+	})
+	removed := len(emails) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, store.writeEmails(kept)
+}
+
+// writeFileAtomic replaces path with data by renaming a temporary file over it,
+// so a crash mid-write never leaves a half-written file behind. The file ends up
+// readable by its owner only, as it holds Canvas secrets and tokens.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,513 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+)
+
+// MemoryStore keeps everything in process memory, for tests and throwaway runs
+type MemoryStore struct {
+	mutex   sync.Mutex
+	courses []canvas.Course
+	tokens  map[string]TokenData
+	members []VerifiedMember
+	emails  []OutboxEmail
+	// nonces maps the used nonces of signed links to when their links expire
+	nonces map[string]time.Time
+	// connectRequests are keyed by OAuth state
+	connectRequests map[string]ConnectRequest
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		courses:         []canvas.Course{},
+		tokens:          make(map[string]TokenData),
+		nonces:          make(map[string]time.Time),
+		connectRequests: make(map[string]ConnectRequest),
+	}
+}
+
+func (store *MemoryStore) Courses() ([]canvas.Course, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	courses := make([]canvas.Course, len(store.courses))
+	copy(courses, store.courses)
+	return courses, nil
+}
+
+func (store *MemoryStore) GuildCourses(guildId string) ([]canvas.Course, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return guildCourses(store.courses, guildId), nil
+}
+
+func (store *MemoryStore) Course(guildId string, courseId string) (*canvas.Course, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if i := findCourse(store.courses, guildId, courseId); i >= 0 {
+		course := store.courses[i]
+		return &course, nil
+	}
+	return nil, nil
+}
+
+func (store *MemoryStore) AddCourse(course canvas.Course) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if findCourse(store.courses, course.GuildId, course.CourseId) >= 0 {
+		return ErrCourseExists
+	}
+	store.courses = append(store.courses, course)
+	return nil
+}
+
+func (store *MemoryStore) UpdateCourse(course canvas.Course) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	i := findCourse(store.courses, course.GuildId, course.CourseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	store.courses[i] = updatedCourse(store.courses[i], course)
+	return nil
+}
+
+func (store *MemoryStore) SetCanvasToken(guildId string, courseId string, accessToken string, refreshToken string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	i := findCourse(store.courses, guildId, courseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	setCanvasToken(&store.courses[i], accessToken, refreshToken, expiresAt)
+	return nil
+}
+
+func (store *MemoryStore) RemoveCourse(guildId string, courseId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	i := findCourse(store.courses, guildId, courseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	store.courses = append(store.courses[:i], store.courses[i+1:]...)
+	store.members = filterVerifiedMembers(store.members, func(member VerifiedMember) bool {
+		return member.GuildId != guildId || member.CourseId != courseId
+	})
+	return nil
+}
+
+func (store *MemoryStore) MoveCourse(courseId string, course canvas.Course) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	i := findCourse(store.courses, course.GuildId, courseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	if course.CourseId != courseId && findCourse(store.courses, course.GuildId, course.CourseId) >= 0 {
+		return ErrCourseExists
+	}
+	store.courses[i] = course
+	moveVerifiedMembers(store.members, course.GuildId, courseId, course.CourseId)
+	moveTokens(store.tokens, course.GuildId, courseId, course.CourseId)
+	return nil
+}
+
+func (store *MemoryStore) Students(guildId string, courseId string) ([]canvas.Student, error) {
+	course, err := store.Course(guildId, courseId)
+	if err != nil {
+		return nil, err
+	}
+	if course == nil {
+		return nil, ErrCourseNotFound
+	}
+	return course.Students, nil
+}
+
+func (store *MemoryStore) SetStudents(guildId string, courseId string, students []canvas.Student) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	i := findCourse(store.courses, guildId, courseId)
+	if i < 0 {
+		return ErrCourseNotFound
+	}
+	store.courses[i].Students = students
+	return nil
+}
+
+func (store *MemoryStore) Token(userId string) (*TokenData, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if tokenData, ok := store.tokens[userId]; ok {
+		return &tokenData, nil
+	}
+	return nil, nil
+}
+
+func (store *MemoryStore) CreateToken(userId string, token TokenData) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.tokens[userId]; ok {
+		return ErrTokenExists
+	}
+	store.tokens[userId] = token
+	return nil
+}
+
+func (store *MemoryStore) TakeToken(userId string, token string) (*TokenData, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tokenData, ok := store.tokens[userId]
+	if !ok || tokenData.Token != token {
+		return nil, nil
+	}
+	delete(store.tokens, userId)
+	return &tokenData, nil
+}
+
+func (store *MemoryStore) DeleteToken(userId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.tokens, userId)
+	return nil
+}
+
+func (store *MemoryStore) DeleteExpiredTokens(now time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	removed := 0
+	for userId, tokenData := range store.tokens {
+		if tokenData.Expired(now) {
+			delete(store.tokens, userId)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (store *MemoryStore) UseNonce(nonce string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.nonces[nonce]; ok {
+		return ErrNonceUsed
+	}
+	store.nonces[nonce] = expiresAt
+	return nil
+}
+
+func (store *MemoryStore) ReleaseNonce(nonce string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.nonces, nonce)
+	return nil
+}
+
+func (store *MemoryStore) DeleteExpiredNonces(now time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	removed := 0
+	for nonce, expiresAt := range store.nonces {
+		if !now.Before(expiresAt) {
+			delete(store.nonces, nonce)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (store *MemoryStore) PutVerifiedMembers(members ...VerifiedMember) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, member := range members {
+		store.members = putVerifiedMember(store.members, member)
+	}
+	return nil
+}
+
+func (store *MemoryStore) BindVerifiedMembers(mode BindMode, members ...VerifiedMember) ([]VerifiedMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stored, others, err := bindVerifiedMembers(store.members, mode, members)
+	if err != nil {
+		return others, err
+	}
+	store.members = stored
+	return others, nil
+}
+
+func (store *MemoryStore) DeleteVerifiedMember(guildId string, courseId string, netId string, userId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.members = filterVerifiedMembers(store.members, func(member VerifiedMember) bool {
+		return member.GuildId != guildId || member.CourseId != courseId || member.NetId != netId || member.UserId != userId
+	})
+	return nil
+}
+
+func (store *MemoryStore) VerifiedMembersByNetId(guildId string, netId string) ([]VerifiedMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return filterVerifiedMembers(store.members, func(member VerifiedMember) bool {
+		return member.GuildId == guildId && member.NetId == netId
+	}), nil
+}
+
+func (store *MemoryStore) VerifiedMembersByUser(guildId string, userId string) ([]VerifiedMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return filterVerifiedMembers(store.members, func(member VerifiedMember) bool {
+		return member.GuildId == guildId && member.UserId == userId
+	}), nil
+}
+
+func (store *MemoryStore) VerifiedMembersByCourse(guildId string, courseId string) ([]VerifiedMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return filterVerifiedMembers(store.members, func(member VerifiedMember) bool {
+		return member.GuildId == guildId && member.CourseId == courseId
+	}), nil
+}
+
+func (store *MemoryStore) EnqueueEmail(email OutboxEmail) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.emails = append(store.emails, email)
+	return nil
+}
+
+func (store *MemoryStore) DueEmails(now time.Time, limit int) ([]OutboxEmail, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return dueEmails(store.emails, now, limit), nil
+}
+
+func (store *MemoryStore) UpdateEmail(email OutboxEmail) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return putEmail(store.emails, email)
+}
+
+func (store *MemoryStore) Emails(status string) ([]OutboxEmail, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return filterEmails(store.emails, func(email OutboxEmail) bool {
+		return email.Status == status
+	}), nil
+}
+
+func (store *MemoryStore) DeleteEmails(status string, before time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	kept := filterEmails(store.emails, func(email OutboxEmail) bool {
+		return email.Status != status || !email.FinishedAt.Before(before)
+	})
+	removed := len(store.emails) - len(kept)
+	store.emails = kept
+	return removed, nil
+}
+
+// helpers shared by the stores that keep courses, verified members and emails in slices
+
+func findCourse(courses []canvas.Course, guildId string, courseId string) int {
+	for i, course := range courses {
+		if course.GuildId == guildId && course.CourseId == courseId {
+			return i
+		}
+	}
+	return -1
+}
+
+func guildCourses(courses []canvas.Course, guildId string) []canvas.Course {
+	found := []canvas.Course{}
+	for _, course := range courses {
+		if course.GuildId == guildId {
+			found = append(found, course)
+		}
+	}
+	return found
+}
+
+func putVerifiedMember(members []VerifiedMember, member VerifiedMember) []VerifiedMember {
+	for i := range members {
+		if members[i].GuildId == member.GuildId && members[i].CourseId == member.CourseId &&
+			members[i].NetId == member.NetId && members[i].UserId == member.UserId {
+			members[i] = member
+			return members
+		}
+	}
+	return append(members, member)
+}
+
+// bindVerifiedMembers applies BindVerifiedMembers to stored, returning the
+// records to keep and the other accounts' records of the NetID
+func bindVerifiedMembers(stored []VerifiedMember, mode BindMode, members []VerifiedMember) ([]VerifiedMember, []VerifiedMember, error) {
+	if len(members) == 0 {
+		return stored, nil, nil
+	}
+	bound := members[0]
+	others := filterVerifiedMembers(stored, func(member VerifiedMember) bool {
+		return member.GuildId == bound.GuildId && member.NetId == bound.NetId && member.UserId != bound.UserId
+	})
+	if mode == BindExclusive && len(others) > 0 {
+		return stored, others, ErrNetIdBound
+	}
+	if mode == BindTransfer {
+		courses := make(map[string]bool)
+		for _, member := range members {
+			courses[member.CourseId] = true
+		}
+		stored = filterVerifiedMembers(stored, func(member VerifiedMember) bool {
+			return member.GuildId != bound.GuildId || member.NetId != bound.NetId ||
+				member.UserId == bound.UserId || !courses[member.CourseId]
+		})
+	}
+	for _, member := range members {
+		stored = putVerifiedMember(stored, member)
+	}
+	return stored, others, nil
+}
+
+// moveVerifiedMembers points the records of a course at its new course ID
+func moveVerifiedMembers(members []VerifiedMember, guildId string, courseId string, newCourseId string) {
+	for i := range members {
+		if members[i].GuildId == guildId && members[i].CourseId == courseId {
+			members[i].CourseId = newCourseId
+		}
+	}
+}
+
+// moveTokens points the pending tokens for a course at its new course ID
+func moveTokens(tokens map[string]TokenData, guildId string, courseId string, newCourseId string) {
+	for userId, tokenData := range tokens {
+		if tokenData.GuildID == guildId && tokenData.CourseID == courseId {
+			tokenData.CourseID = newCourseId
+			tokens[userId] = tokenData
+		}
+	}
+}
+
+func filterVerifiedMembers(members []VerifiedMember, keep func(VerifiedMember) bool) []VerifiedMember {
+	found := []VerifiedMember{}
+	for _, member := range members {
+		if keep(member) {
+			found = append(found, member)
+		}
+	}
+	return found
+}
+
+func dueEmails(emails []OutboxEmail, now time.Time, limit int) []OutboxEmail {
+	due := filterEmails(emails, func(email OutboxEmail) bool {
+		return email.Status == EmailPending && !email.NextAttemptAt.After(now)
+	})
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due
+}
+
+func putEmail(emails []OutboxEmail, email OutboxEmail) error {
+	for i := range emails {
+		if emails[i].Id == email.Id {
+			emails[i] = email
+			return nil
+		}
+	}
+	return ErrEmailNotFound
+}
+
+func filterEmails(emails []OutboxEmail, keep func(OutboxEmail) bool) []OutboxEmail {
+	found := []OutboxEmail{}
+	for _, email := range emails {
+		if keep(email) {
+			found = append(found, email)
+		}
+	}
+	return found
+}
+
+func (store *MemoryStore) PutConnectRequest(state string, request ConnectRequest) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.connectRequests[state] = request
+	return nil
+}
+
+func (store *MemoryStore) TakeConnectRequest(state string, now time.Time) (*ConnectRequest, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	request, ok := store.connectRequests[state]
+	delete(store.connectRequests, state)
+	if !ok || !now.Before(request.ExpiresAt) {
+		return nil, nil
+	}
+	return &request, nil
+}
+
+func (store *MemoryStore) DeleteExpiredConnectRequests(now time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return deleteExpiredConnectRequests(store.connectRequests, now), nil
+}
+
+// setCanvasToken replaces the OAuth token of a course
+// updatedCourse is course with the roster and Canvas token of stored, which UpdateCourse leaves alone
+func updatedCourse(stored canvas.Course, course canvas.Course) canvas.Course {
+	course.Students = stored.Students
+	setCanvasToken(&course, stored.CanvasSecret, stored.CanvasRefreshToken, stored.CanvasTokenExpiresAt)
+	return course
+}
+
+func setCanvasToken(course *canvas.Course, accessToken string, refreshToken string, expiresAt time.Time) {
+	course.CanvasSecret = accessToken
+	course.CanvasRefreshToken = refreshToken
+	course.CanvasTokenExpiresAt = expiresAt
+}
+
+// deleteExpiredConnectRequests removes the requests expired at now and returns how many it removed
+func deleteExpiredConnectRequests(requests map[string]ConnectRequest, now time.Time) int {
+	removed := 0
+	for state, request := range requests {
+		if !now.Before(request.ExpiresAt) {
+			delete(requests, state)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,998 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+
+	// pure-Go driver, so the bot still builds with CGO_ENABLED=0
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order and recorded in schema_migrations, never edit
+// a migration that has shipped, append a new one instead
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE courses (
+		guild_id      TEXT PRIMARY KEY,
+		course_id     TEXT NOT NULL,
+		canvas_secret TEXT NOT NULL,
+		auth_role_id  TEXT NOT NULL
+	);
+	CREATE TABLE students (
+		guild_id TEXT NOT NULL REFERENCES courses(guild_id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		net_id   TEXT NOT NULL,
+		name     TEXT NOT NULL,
+		PRIMARY KEY (guild_id, position)
+	);
+	CREATE INDEX students_net_id ON students(guild_id, net_id);
+	CREATE TABLE tokens (
+		user_id  TEXT PRIMARY KEY,
+		token    TEXT NOT NULL,
+		guild_id TEXT NOT NULL
+	);
+	CREATE TABLE verified_members (
+		guild_id    TEXT NOT NULL,
+		net_id      TEXT NOT NULL,
+		user_id     TEXT NOT NULL,
+		course_id   TEXT NOT NULL,
+		verified_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (guild_id, net_id)
+	);
+	CREATE INDEX verified_members_user_id ON verified_members(guild_id, user_id);
+	CREATE TABLE meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+
+	// 2: token expiry, rows from before this migration get the zero time and count as expired
+	`ALTER TABLE tokens ADD COLUMN issued_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE tokens ADD COLUMN expires_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	CREATE INDEX tokens_expires_at ON tokens(expires_at);`,
+
+	// 3: the NetID a token was emailed to
+	`ALTER TABLE tokens ADD COLUMN net_id TEXT NOT NULL DEFAULT '';`,
+
+	// 4: per-course staff channel
+	`ALTER TABLE courses ADD COLUMN staff_channel_id TEXT NOT NULL DEFAULT '';`,
+
+	// 5: several courses per guild, courses and verification records are keyed by
+	// guild and course. SQLite can't change a primary key in place, so the tables
+	// are rebuilt.
+	`ALTER TABLE students RENAME TO students_v4;
+	ALTER TABLE courses RENAME TO courses_v4;
+	ALTER TABLE verified_members RENAME TO verified_members_v4;
+	CREATE TABLE courses (
+		guild_id         TEXT NOT NULL,
+		course_id        TEXT NOT NULL,
+		canvas_secret    TEXT NOT NULL,
+		auth_role_id     TEXT NOT NULL,
+		staff_channel_id TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (guild_id, course_id)
+	);
+	CREATE TABLE students (
+		guild_id  TEXT NOT NULL,
+		course_id TEXT NOT NULL,
+		position  INTEGER NOT NULL,
+		net_id    TEXT NOT NULL,
+		name      TEXT NOT NULL,
+		PRIMARY KEY (guild_id, course_id, position),
+		FOREIGN KEY (guild_id, course_id) REFERENCES courses(guild_id, course_id) ON DELETE CASCADE
+	);
+	CREATE TABLE verified_members (
+		guild_id    TEXT NOT NULL,
+		course_id   TEXT NOT NULL,
+		net_id      TEXT NOT NULL,
+		user_id     TEXT NOT NULL,
+		verified_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (guild_id, course_id, net_id)
+	);
+	INSERT INTO courses SELECT guild_id, course_id, canvas_secret, auth_role_id, staff_channel_id FROM courses_v4 ORDER BY rowid;
+	INSERT INTO students SELECT s.guild_id, c.course_id, s.position, s.net_id, s.name FROM students_v4 s JOIN courses_v4 c ON c.guild_id = s.guild_id;
+	INSERT INTO verified_members SELECT guild_id, course_id, net_id, user_id, verified_at FROM verified_members_v4;
+	DROP TABLE students_v4;
+	DROP TABLE courses_v4;
+	DROP TABLE verified_members_v4;
+	CREATE INDEX students_net_id ON students(guild_id, net_id);
+	CREATE INDEX verified_members_net_id ON verified_members(guild_id, net_id);
+	CREATE INDEX verified_members_user_id ON verified_members(guild_id, user_id);
+	ALTER TABLE tokens ADD COLUMN course_id TEXT NOT NULL DEFAULT '';`,
+
+	// 6: Canvas sections, both columns hold JSON
+	`ALTER TABLE courses ADD COLUMN section_roles TEXT NOT NULL DEFAULT '{}';
+	ALTER TABLE students ADD COLUMN sections TEXT NOT NULL DEFAULT '[]';`,
+
+	// 7: Canvas enrollment types
+	`ALTER TABLE courses ADD COLUMN enrollment_roles TEXT NOT NULL DEFAULT '{}';
+	ALTER TABLE students ADD COLUMN enrollment_type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE students ADD COLUMN enrollment_role TEXT NOT NULL DEFAULT '';`,
+
+	// 8: what happens to verified members who drop the course
+	`ALTER TABLE courses ADD COLUMN drop_policy TEXT NOT NULL DEFAULT '';
+	ALTER TABLE courses ADD COLUMN alumni_role_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE courses ADD COLUMN drop_dry_run INTEGER NOT NULL DEFAULT 0;`,
+
+	// 9: staff roles allowed to use the admin commands, as JSON
+	`ALTER TABLE courses ADD COLUMN staff_role_ids TEXT NOT NULL DEFAULT '[]';`,
+
+	// 10: Canvas OAuth tokens
+	`ALTER TABLE courses ADD COLUMN canvas_refresh_token TEXT NOT NULL DEFAULT '';
+	ALTER TABLE courses ADD COLUMN canvas_token_expires_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';`,
+
+	// 11: the rest of the student's Canvas profile
+	`ALTER TABLE students ADD COLUMN sortable_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE students ADD COLUMN short_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE students ADD COLUMN canvas_user_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE students ADD COLUMN sis_user_id TEXT NOT NULL DEFAULT '';`,
+
+	// 12: verification email overrides
+	`ALTER TABLE courses ADD COLUMN email_subject TEXT NOT NULL DEFAULT '';
+	ALTER TABLE courses ADD COLUMN email_course_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE courses ADD COLUMN email_signature TEXT NOT NULL DEFAULT '';`,
+
+	// 13: email outbox, recipients holds JSON
+	`CREATE TABLE outbox (
+		id                TEXT PRIMARY KEY,
+		sender            TEXT NOT NULL,
+		recipients        TEXT NOT NULL,
+		message           BLOB,
+		status            TEXT NOT NULL,
+		attempts          INTEGER NOT NULL DEFAULT 0,
+		last_error        TEXT NOT NULL DEFAULT '',
+		created_at        TIMESTAMP NOT NULL,
+		next_attempt_at   TIMESTAMP NOT NULL,
+		finished_at       TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00',
+		guild_id          TEXT NOT NULL DEFAULT '',
+		user_id           TEXT NOT NULL DEFAULT '',
+		net_id            TEXT NOT NULL DEFAULT '',
+		application_id    TEXT NOT NULL DEFAULT '',
+		interaction_token TEXT NOT NULL DEFAULT '',
+		note              TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX outbox_status ON outbox(status, next_attempt_at);`,
+
+	// 14: used nonces of signed verification links, kept until the link expires
+	`CREATE TABLE used_nonces (
+		nonce      TEXT PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX used_nonces_expires_at ON used_nonces(expires_at);`,
+
+	// 15: /registercourse requests waiting on Canvas OAuth, keyed by OAuth state
+	`CREATE TABLE connect_requests (
+		state             TEXT PRIMARY KEY,
+		guild_id          TEXT NOT NULL,
+		course_id         TEXT NOT NULL,
+		auth_role_id      TEXT NOT NULL,
+		staff_channel_id  TEXT NOT NULL DEFAULT '',
+		application_id    TEXT NOT NULL,
+		interaction_token TEXT NOT NULL,
+		expires_at        TIMESTAMP NOT NULL
+	);`,
+
+	// 16: verified members keyed by account too, so a flagged second account
+	// doesn't overwrite the first one's record
+	`ALTER TABLE verified_members RENAME TO verified_members_v15;
+	CREATE TABLE verified_members (
+		guild_id    TEXT NOT NULL,
+		course_id   TEXT NOT NULL,
+		net_id      TEXT NOT NULL,
+		user_id     TEXT NOT NULL,
+		verified_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (guild_id, course_id, net_id, user_id)
+	);
+	INSERT INTO verified_members SELECT guild_id, course_id, net_id, user_id, verified_at FROM verified_members_v15;
+	DROP TABLE verified_members_v15;
+	CREATE INDEX verified_members_net_id ON verified_members(guild_id, net_id);
+	CREATE INDEX verified_members_user_id ON verified_members(guild_id, user_id);`,
+}
+
+// SQLiteStore keeps courses, rosters and tokens in a SQLite database
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Println("Error creating database directory:", err)
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		log.Println("Error opening SQLite database:", err)
+		return nil, err
+	}
+	// a single connection serializes writers, which is all SQLite allows anyway
+	db.SetMaxOpenConns(1)
+
+	store := &SQLiteStore{db: db}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// the database holds Canvas secrets and tokens, keep it to its owner
+	if err := os.Chmod(path, 0600); err != nil {
+		log.Println("Error restricting database permissions:", err)
+	}
+	return store, nil
+}
+
+func (store *SQLiteStore) Close() error {
+	return store.db.Close()
+}
+
+// migrate applies every migration newer than the database's schema version
+func (store *SQLiteStore) migrate() error {
+	_, err := store.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		log.Println("Error creating schema_migrations table:", err)
+		return err
+	}
+
+	var version int
+	err = store.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		log.Println("Error reading schema version:", err)
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		log.Println("Applying SQLite migration", i+1)
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			log.Printf("Error applying SQLite migration %d: %v\n", i+1, err)
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", i+1, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportJSON copies the courses, tokens, verified members and outbox of a JSONStore directory into the
+// database. It runs once, later calls are no-ops so it is safe on every startup.
+func (store *SQLiteStore) ImportJSON(dir string) error {
+	var importedAt string
+	err := store.db.QueryRow("SELECT value FROM meta WHERE key = 'json_imported_at'").Scan(&importedAt)
+	if err == nil {
+		return nil
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	jsonStore := &JSONStore{
+		configPath:  filepath.Join(dir, "server_config.json"),
+		tokensPath:  filepath.Join(dir, "tokens.json"),
+		membersPath: filepath.Join(dir, "verified_members.json"),
+		outboxPath:  filepath.Join(dir, "outbox.json"),
+	}
+	serverConfig, err := jsonStore.readConfig()
+	if err != nil {
+		return err
+	}
+	tokens, err := jsonStore.readTokens()
+	if err != nil {
+		return err
+	}
+	members, err := jsonStore.readMembers()
+	if err != nil {
+		return err
+	}
+	emails, err := jsonStore.readEmails()
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, course := range serverConfig.Courses {
+		if err := insertCourse(tx, course); err != nil {
+			log.Println("Error importing course for guildId:", course.GuildId, err)
+			return err
+		}
+	}
+	for userId, tokenData := range tokens {
+		if err := insertToken(tx, userId, tokenData); err != nil {
+			log.Println("Error importing token for user:", userId, err)
+			return err
+		}
+	}
+	for _, member := range members {
+		_, err := tx.Exec("INSERT INTO verified_members ("+verifiedMemberColumns+") VALUES (?, ?, ?, ?, ?)",
+			member.GuildId, member.CourseId, member.NetId, member.UserId, member.VerifiedAt.UTC())
+		if err != nil {
+			log.Println("Error importing verified member:", member.NetId, err)
+			return err
+		}
+	}
+	for _, email := range emails {
+		if err := insertEmail(tx, email); err != nil {
+			log.Println("Error importing email:", email.Id, err)
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO meta (key, value) VALUES ('json_imported_at', ?)", time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Imported %d courses, %d tokens, %d verified members and %d emails from %s\n",
+		len(serverConfig.Courses), len(tokens), len(members), len(emails), dir)
+	return nil
+}
+
+// courseColumns lists the courses columns in the order scanCourse expects them
+const courseColumns = "guild_id, course_id, canvas_secret, auth_role_id, staff_channel_id, section_roles, enrollment_roles," +
+	" drop_policy, alumni_role_id, drop_dry_run, staff_role_ids, canvas_refresh_token, canvas_token_expires_at," +
+	" email_subject, email_course_name, email_signature"
+
+// canvasTokenColumns are only written by AddCourse, MoveCourse and SetCanvasToken
+var canvasTokenColumns = map[string]bool{"canvas_secret": true, "canvas_refresh_token": true, "canvas_token_expires_at": true}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// jsonColumn encodes a value kept in a JSON column, nil slices and maps become null
+func jsonColumn(value any) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+func scanCourse(row scanner) (canvas.Course, error) {
+	var course canvas.Course
+	var sectionRoles, enrollmentRoles, staffRoleIds string
+	err := row.Scan(&course.GuildId, &course.CourseId, &course.CanvasSecret, &course.AuthRoleId, &course.StaffChannelId, &sectionRoles, &enrollmentRoles,
+		&course.DropPolicy, &course.AlumniRoleId, &course.DropDryRun, &staffRoleIds, &course.CanvasRefreshToken, &course.CanvasTokenExpiresAt,
+		&course.EmailSubject, &course.EmailCourseName, &course.EmailSignature)
+	if err != nil {
+		return course, err
+	}
+	if err := json.Unmarshal([]byte(sectionRoles), &course.SectionRoles); err != nil {
+		return course, err
+	}
+	if err := json.Unmarshal([]byte(enrollmentRoles), &course.EnrollmentRoles); err != nil {
+		return course, err
+	}
+	err = json.Unmarshal([]byte(staffRoleIds), &course.StaffRoleIds)
+	return course, err
+}
+
+// courseValues returns the values of courseColumns for course
+func courseValues(course canvas.Course) ([]any, error) {
+	sectionRoles, err := jsonColumn(course.SectionRoles)
+	if err != nil {
+		return nil, err
+	}
+	enrollmentRoles, err := jsonColumn(course.EnrollmentRoles)
+	if err != nil {
+		return nil, err
+	}
+	staffRoleIds, err := jsonColumn(course.StaffRoleIds)
+	if err != nil {
+		return nil, err
+	}
+	return []any{course.GuildId, course.CourseId, course.CanvasSecret, course.AuthRoleId, course.StaffChannelId, sectionRoles, enrollmentRoles,
+		course.DropPolicy, course.AlumniRoleId, course.DropDryRun, staffRoleIds, course.CanvasRefreshToken, course.CanvasTokenExpiresAt.UTC(),
+		course.EmailSubject, course.EmailCourseName, course.EmailSignature}, nil
+}
+
+func insertCourse(tx *sql.Tx, course canvas.Course) error {
+	values, err := courseValues(course)
+	if err != nil {
+		return err
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	_, err = tx.Exec("INSERT INTO courses ("+courseColumns+") VALUES ("+placeholders+")", values...)
+	if err != nil {
+		return err
+	}
+	return insertStudents(tx, course.GuildId, course.CourseId, course.Students)
+}
+
+func insertStudents(tx *sql.Tx, guildId string, courseId string, students []canvas.Student) error {
+	for position, student := range students {
+		sections, err := jsonColumn(student.Sections)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO students (guild_id, course_id, position, net_id, name, sections, enrollment_type, enrollment_role,"+
+			" sortable_name, short_name, canvas_user_id, sis_user_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			guildId, courseId, position, student.NetId, student.Name, sections, student.EnrollmentType, student.EnrollmentRole,
+			student.SortableName, student.ShortName, student.CanvasUserId, student.SisUserId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowQueryer is satisfied by both *sql.DB and *sql.Tx
+type rowQueryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func courseExists(queryer rowQueryer, guildId string, courseId string) (bool, error) {
+	var exists bool
+	err := queryer.QueryRow("SELECT EXISTS (SELECT 1 FROM courses WHERE guild_id = ? AND course_id = ?)", guildId, courseId).Scan(&exists)
+	return exists, err
+}
+
+// queryCourses loads the courses matching where, rosters included
+func (store *SQLiteStore) queryCourses(where string, args ...any) ([]canvas.Course, error) {
+	rows, err := store.db.Query("SELECT "+courseColumns+" FROM courses "+where+" ORDER BY rowid", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	courses := []canvas.Course{}
+	for rows.Next() {
+		course, err := scanCourse(rows)
+		if err != nil {
+			return nil, err
+		}
+		courses = append(courses, course)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range courses {
+		courses[i].Students, err = store.Students(courses[i].GuildId, courses[i].CourseId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return courses, nil
+}
+
+func (store *SQLiteStore) Courses() ([]canvas.Course, error) {
+	return store.queryCourses("")
+}
+
+func (store *SQLiteStore) GuildCourses(guildId string) ([]canvas.Course, error) {
+	return store.queryCourses("WHERE guild_id = ?", guildId)
+}
+
+func (store *SQLiteStore) Course(guildId string, courseId string) (*canvas.Course, error) {
+	courses, err := store.queryCourses("WHERE guild_id = ? AND course_id = ?", guildId, courseId)
+	if err != nil || len(courses) == 0 {
+		return nil, err
+	}
+	return &courses[0], nil
+}
+
+func (store *SQLiteStore) AddCourse(course canvas.Course) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if exists, err := courseExists(tx, course.GuildId, course.CourseId); err != nil {
+		return err
+	} else if exists {
+		return ErrCourseExists
+	}
+
+	if err := insertCourse(tx, course); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) UpdateCourse(course canvas.Course) error {
+	values, err := courseValues(course)
+	if err != nil {
+		return err
+	}
+	// guild_id and course_id lead courseColumns, they go last to match the WHERE clause
+	var columns []string
+	var settings []any
+	for i, column := range strings.Split(courseColumns, ", ")[2:] {
+		if !canvasTokenColumns[column] {
+			columns = append(columns, column)
+			settings = append(settings, values[i+2])
+		}
+	}
+	result, err := store.db.Exec("UPDATE courses SET "+strings.Join(columns, " = ?, ")+" = ?"+
+		" WHERE guild_id = ? AND course_id = ?", append(settings, values[0], values[1])...)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrCourseNotFound
+	}
+	return nil
+}
+
+func (store *SQLiteStore) SetCanvasToken(guildId string, courseId string, accessToken string, refreshToken string, expiresAt time.Time) error {
+	result, err := store.db.Exec("UPDATE courses SET canvas_secret = ?, canvas_refresh_token = ?, canvas_token_expires_at = ?"+
+		" WHERE guild_id = ? AND course_id = ?", accessToken, refreshToken, expiresAt.UTC(), guildId, courseId)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrCourseNotFound
+	}
+	return nil
+}
+
+func (store *SQLiteStore) RemoveCourse(guildId string, courseId string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the roster goes with the course through ON DELETE CASCADE
+	result, err := tx.Exec("DELETE FROM courses WHERE guild_id = ? AND course_id = ?", guildId, courseId)
+	if err != nil {
+		return err
+	}
+	if removed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if removed == 0 {
+		return ErrCourseNotFound
+	}
+	_, err = tx.Exec("DELETE FROM verified_members WHERE guild_id = ? AND course_id = ?", guildId, courseId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) MoveCourse(courseId string, course canvas.Course) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if exists, err := courseExists(tx, course.GuildId, courseId); err != nil {
+		return err
+	} else if !exists {
+		return ErrCourseNotFound
+	}
+	if course.CourseId != courseId {
+		if exists, err := courseExists(tx, course.GuildId, course.CourseId); err != nil {
+			return err
+		} else if exists {
+			return ErrCourseExists
+		}
+	}
+
+	// the old roster goes with the old row through ON DELETE CASCADE
+	if _, err := tx.Exec("DELETE FROM courses WHERE guild_id = ? AND course_id = ?", course.GuildId, courseId); err != nil {
+		return err
+	}
+	if err := insertCourse(tx, course); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE OR REPLACE verified_members SET course_id = ? WHERE guild_id = ? AND course_id = ?", course.CourseId, course.GuildId, courseId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE tokens SET course_id = ? WHERE guild_id = ? AND course_id = ?", course.CourseId, course.GuildId, courseId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) Students(guildId string, courseId string) ([]canvas.Student, error) {
+	if exists, err := courseExists(store.db, guildId, courseId); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, ErrCourseNotFound
+	}
+
+	rows, err := store.db.Query("SELECT net_id, name, sections, enrollment_type, enrollment_role, sortable_name, short_name, canvas_user_id, sis_user_id"+
+		" FROM students WHERE guild_id = ? AND course_id = ? ORDER BY position", guildId, courseId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	students := []canvas.Student{}
+	for rows.Next() {
+		var student canvas.Student
+		var sections string
+		if err := rows.Scan(&student.NetId, &student.Name, &sections, &student.EnrollmentType, &student.EnrollmentRole,
+			&student.SortableName, &student.ShortName, &student.CanvasUserId, &student.SisUserId); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(sections), &student.Sections); err != nil {
+			return nil, err
+		}
+		students = append(students, student)
+	}
+	return students, rows.Err()
+}
+
+func (store *SQLiteStore) SetStudents(guildId string, courseId string, students []canvas.Student) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if exists, err := courseExists(tx, guildId, courseId); err != nil {
+		return err
+	} else if !exists {
+		return ErrCourseNotFound
+	}
+
+	if _, err := tx.Exec("DELETE FROM students WHERE guild_id = ? AND course_id = ?", guildId, courseId); err != nil {
+		return err
+	}
+	if err := insertStudents(tx, guildId, courseId, students); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tokenColumns lists the tokens columns in the order scanToken expects them
+const tokenColumns = "token, guild_id, course_id, net_id, issued_at, expires_at"
+
+func scanToken(row scanner) (*TokenData, error) {
+	var tokenData TokenData
+	err := row.Scan(&tokenData.Token, &tokenData.GuildID, &tokenData.CourseID, &tokenData.NetID, &tokenData.IssuedAt, &tokenData.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenData, nil
+}
+
+func insertToken(tx *sql.Tx, userId string, tokenData TokenData) error {
+	_, err := tx.Exec("INSERT INTO tokens (user_id, "+tokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userId, tokenData.Token, tokenData.GuildID, tokenData.CourseID, tokenData.NetID, tokenData.IssuedAt.UTC(), tokenData.ExpiresAt.UTC())
+	return err
+}
+
+func (store *SQLiteStore) Token(userId string) (*TokenData, error) {
+	tokenData, err := scanToken(store.db.QueryRow("SELECT "+tokenColumns+" FROM tokens WHERE user_id = ?", userId))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return tokenData, nil
+}
+
+func (store *SQLiteStore) CreateToken(userId string, token TokenData) error {
+	result, err := store.db.Exec("INSERT INTO tokens (user_id, "+tokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (user_id) DO NOTHING",
+		userId, token.Token, token.GuildID, token.CourseID, token.NetID, token.IssuedAt.UTC(), token.ExpiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrTokenExists
+	}
+	return nil
+}
+
+func (store *SQLiteStore) TakeToken(userId string, token string) (*TokenData, error) {
+	tokenData, err := scanToken(store.db.QueryRow("DELETE FROM tokens WHERE user_id = ? AND token = ? RETURNING "+tokenColumns, userId, token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return tokenData, nil
+}
+
+func (store *SQLiteStore) DeleteToken(userId string) error {
+	_, err := store.db.Exec("DELETE FROM tokens WHERE user_id = ?", userId)
+	return err
+}
+
+func (store *SQLiteStore) DeleteExpiredTokens(now time.Time) (int, error) {
+	result, err := store.db.Exec("DELETE FROM tokens WHERE expires_at <= ?", now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+func (store *SQLiteStore) UseNonce(nonce string, expiresAt time.Time) error {
+	result, err := store.db.Exec("INSERT INTO used_nonces (nonce, expires_at) VALUES (?, ?) ON CONFLICT (nonce) DO NOTHING", nonce, expiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrNonceUsed
+	}
+	return nil
+}
+
+func (store *SQLiteStore) ReleaseNonce(nonce string) error {
+	_, err := store.db.Exec("DELETE FROM used_nonces WHERE nonce = ?", nonce)
+	return err
+}
+
+func (store *SQLiteStore) DeleteExpiredNonces(now time.Time) (int, error) {
+	result, err := store.db.Exec("DELETE FROM used_nonces WHERE expires_at <= ?", now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// connectRequestColumns lists the connect_requests columns after state
+const connectRequestColumns = "guild_id, course_id, auth_role_id, staff_channel_id, application_id, interaction_token, expires_at"
+
+func (store *SQLiteStore) PutConnectRequest(state string, request ConnectRequest) error {
+	_, err := store.db.Exec("INSERT OR REPLACE INTO connect_requests (state, "+connectRequestColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		state, request.GuildId, request.CourseId, request.AuthRoleId, request.StaffChannelId, request.ApplicationId, request.InteractionToken, request.ExpiresAt.UTC())
+	return err
+}
+
+func (store *SQLiteStore) TakeConnectRequest(state string, now time.Time) (*ConnectRequest, error) {
+	var request ConnectRequest
+	err := store.db.QueryRow("DELETE FROM connect_requests WHERE state = ? RETURNING "+connectRequestColumns, state).Scan(
+		&request.GuildId, &request.CourseId, &request.AuthRoleId, &request.StaffChannelId, &request.ApplicationId, &request.InteractionToken, &request.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !now.Before(request.ExpiresAt) {
+		return nil, nil
+	}
+	return &request, nil
+}
+
+func (store *SQLiteStore) DeleteExpiredConnectRequests(now time.Time) (int, error) {
+	result, err := store.db.Exec("DELETE FROM connect_requests WHERE expires_at <= ?", now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// verifiedMemberColumns lists the verified_members columns in the order queryVerifiedMembers expects them
+const verifiedMemberColumns = "guild_id, course_id, net_id, user_id, verified_at"
+
+func (store *SQLiteStore) PutVerifiedMembers(members ...VerifiedMember) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, member := range members {
+		if err := insertVerifiedMember(tx, member); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertVerifiedMember records member, replacing the time of an earlier record for the same account
+func insertVerifiedMember(tx *sql.Tx, member VerifiedMember) error {
+	_, err := tx.Exec("INSERT INTO verified_members ("+verifiedMemberColumns+") VALUES (?, ?, ?, ?, ?)"+
+		" ON CONFLICT (guild_id, course_id, net_id, user_id) DO UPDATE SET verified_at = excluded.verified_at",
+		member.GuildId, member.CourseId, member.NetId, member.UserId, member.VerifiedAt.UTC())
+	return err
+}
+
+func (store *SQLiteStore) BindVerifiedMembers(mode BindMode, members ...VerifiedMember) ([]VerifiedMember, error) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+	bound := members[0]
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the check and the insert share the transaction, so two verifications of
+	// the NetID can't both see it free
+	others, err := scanVerifiedMembers(tx.Query("SELECT "+verifiedMemberColumns+" FROM verified_members"+
+		" WHERE guild_id = ? AND net_id = ? AND user_id <> ? ORDER BY verified_at", bound.GuildId, bound.NetId, bound.UserId))
+	if err != nil {
+		return nil, err
+	}
+	if mode == BindExclusive && len(others) > 0 {
+		return others, ErrNetIdBound
+	}
+	for _, member := range members {
+		if mode == BindTransfer {
+			_, err := tx.Exec("DELETE FROM verified_members WHERE guild_id = ? AND course_id = ? AND net_id = ? AND user_id <> ?",
+				member.GuildId, member.CourseId, member.NetId, member.UserId)
+			if err != nil {
+				return others, err
+			}
+		}
+		if err := insertVerifiedMember(tx, member); err != nil {
+			return others, err
+		}
+	}
+	return others, tx.Commit()
+}
+
+func (store *SQLiteStore) DeleteVerifiedMember(guildId string, courseId string, netId string, userId string) error {
+	_, err := store.db.Exec("DELETE FROM verified_members WHERE guild_id = ? AND course_id = ? AND net_id = ? AND user_id = ?", guildId, courseId, netId, userId)
+	return err
+}
+
+func (store *SQLiteStore) queryVerifiedMembers(where string, args ...any) ([]VerifiedMember, error) {
+	return scanVerifiedMembers(store.db.Query("SELECT "+verifiedMemberColumns+" FROM verified_members "+where+" ORDER BY verified_at", args...))
+}
+
+func scanVerifiedMembers(rows *sql.Rows, err error) ([]VerifiedMember, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []VerifiedMember{}
+	for rows.Next() {
+		var member VerifiedMember
+		if err := rows.Scan(&member.GuildId, &member.CourseId, &member.NetId, &member.UserId, &member.VerifiedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (store *SQLiteStore) VerifiedMembersByNetId(guildId string, netId string) ([]VerifiedMember, error) {
+	return store.queryVerifiedMembers("WHERE guild_id = ? AND net_id = ?", guildId, netId)
+}
+
+func (store *SQLiteStore) VerifiedMembersByUser(guildId string, userId string) ([]VerifiedMember, error) {
+	return store.queryVerifiedMembers("WHERE guild_id = ? AND user_id = ?", guildId, userId)
+}
+
+func (store *SQLiteStore) VerifiedMembersByCourse(guildId string, courseId string) ([]VerifiedMember, error) {
+	return store.queryVerifiedMembers("WHERE guild_id = ? AND course_id = ?", guildId, courseId)
+}
+
+// emailColumns lists the outbox columns in the order scanEmail expects them
+const emailColumns = "id, sender, recipients, message, status, attempts, last_error, created_at, next_attempt_at, finished_at," +
+	" guild_id, user_id, net_id, application_id, interaction_token, note"
+
+func scanEmail(row scanner) (OutboxEmail, error) {
+	var email OutboxEmail
+	var recipients string
+	err := row.Scan(&email.Id, &email.From, &recipients, &email.Message, &email.Status, &email.Attempts, &email.LastError,
+		&email.CreatedAt, &email.NextAttemptAt, &email.FinishedAt,
+		&email.GuildId, &email.UserId, &email.NetId, &email.ApplicationId, &email.InteractionToken, &email.Note)
+	if err != nil {
+		return email, err
+	}
+	err = json.Unmarshal([]byte(recipients), &email.To)
+	return email, err
+}
+
+// emailValues returns the values of emailColumns for email
+func emailValues(email OutboxEmail) ([]any, error) {
+	recipients, err := jsonColumn(email.To)
+	if err != nil {
+		return nil, err
+	}
+	return []any{email.Id, email.From, recipients, email.Message, email.Status, email.Attempts, email.LastError,
+		email.CreatedAt.UTC(), email.NextAttemptAt.UTC(), email.FinishedAt.UTC(),
+		email.GuildId, email.UserId, email.NetId, email.ApplicationId, email.InteractionToken, email.Note}, nil
+}
+
+func insertEmail(tx *sql.Tx, email OutboxEmail) error {
+	values, err := emailValues(email)
+	if err != nil {
+		return err
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	_, err = tx.Exec("INSERT INTO outbox ("+emailColumns+") VALUES ("+placeholders+")", values...)
+	return err
+}
+
+func (store *SQLiteStore) queryEmails(where string, args ...any) ([]OutboxEmail, error) {
+	rows, err := store.db.Query("SELECT "+emailColumns+" FROM outbox "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []OutboxEmail{}
+	for rows.Next() {
+		email, err := scanEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+func (store *SQLiteStore) EnqueueEmail(email OutboxEmail) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertEmail(tx, email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) DueEmails(now time.Time, limit int) ([]OutboxEmail, error) {
+	return store.queryEmails("WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?", EmailPending, now.UTC(), limit)
+}
+
+func (store *SQLiteStore) UpdateEmail(email OutboxEmail) error {
+	values, err := emailValues(email)
+	if err != nil {
+		return err
+	}
+	// id leads emailColumns, it goes last to match the WHERE clause
+	columns := strings.Split(emailColumns, ", ")
+	result, err := store.db.Exec("UPDATE outbox SET "+strings.Join(columns[1:], " = ?, ")+" = ? WHERE id = ?", append(values[1:], values[0])...)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrEmailNotFound
+	}
+	return nil
+}
+
+func (store *SQLiteStore) Emails(status string) ([]OutboxEmail, error) {
+	return store.queryEmails("WHERE status = ? ORDER BY created_at", status)
+}
+
+func (store *SQLiteStore) DeleteEmails(status string, before time.Time) (int, error) {
+	result, err := store.db.Exec("DELETE FROM outbox WHERE status = ? AND finished_at < ?", status, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
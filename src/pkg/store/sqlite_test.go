@@ -0,0 +1,241 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+)
+
+// migrateTo creates a database at path with only the first version migrations
+// applied, as an older release of the bot would have left it
+func migrateTo(t *testing.T, path string, version int) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < version; i++ {
+		if _, err := db.Exec(migrations[i]); err != nil {
+			t.Fatalf("migration %d: %v", i+1, err)
+		}
+		if _, err := db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", i+1, time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestMigrations(t *testing.T) {
+	tests := []struct {
+		name string
+		// version is the schema the seed is written against
+		version int
+		seed    string
+		check   func(t *testing.T, sqliteStore *SQLiteStore)
+	}{
+		{
+			name:    "one course per guild",
+			version: 1,
+			seed: `INSERT INTO courses VALUES ('guild', '1001', 'secret', 'role');
+			INSERT INTO students VALUES ('guild', 0, 'abc123', 'Grace Hopper');
+			INSERT INTO tokens VALUES ('user', 'token', 'guild');
+			INSERT INTO verified_members VALUES ('guild', 'abc123', 'user', '1001', '2024-01-02 03:04:05+00:00');`,
+			check: func(t *testing.T, sqliteStore *SQLiteStore) {
+				course, err := sqliteStore.Course("guild", "1001")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if course == nil || course.CanvasSecret != "secret" || len(course.Students) != 1 || course.Students[0].NetId != "abc123" {
+					t.Fatalf("course %+v", course)
+				}
+				if len(course.SectionRoles) != 0 || course.DropPolicy != "" || course.DropDryRun || !course.CanvasTokenExpiresAt.IsZero() {
+					t.Errorf("later columns have unexpected defaults: %+v", course)
+				}
+				members, err := sqliteStore.VerifiedMembersByUser("guild", "user")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(members) != 1 || members[0].CourseId != "1001" {
+					t.Errorf("members %+v", members)
+				}
+				token, err := sqliteStore.Token("user")
+				if err != nil {
+					t.Fatal(err)
+				}
+				// tokens from before expiry was tracked count as expired
+				if token == nil || !token.Expired(time.Now()) || token.CourseID != "" {
+					t.Errorf("token %+v", token)
+				}
+			},
+		},
+		{
+			name:    "staff channel before several courses",
+			version: 4,
+			seed: `INSERT INTO courses VALUES ('guild', '1001', 'secret', 'role', 'channel');
+			INSERT INTO students VALUES ('guild', 0, 'abc123', 'Grace Hopper');
+			INSERT INTO students VALUES ('guild', 1, 'ta1', 'Alan Turing');`,
+			check: func(t *testing.T, sqliteStore *SQLiteStore) {
+				course, err := sqliteStore.Course("guild", "1001")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if course == nil || course.StaffChannelId != "channel" || len(course.Students) != 2 || course.Students[1].Name != "Alan Turing" {
+					t.Fatalf("course %+v", course)
+				}
+				if err := sqliteStore.RemoveCourse("guild", "1001"); err != nil {
+					t.Fatal(err)
+				}
+				// the rebuilt students table still cascades
+				if students, _ := sqliteStore.Students("guild", "1001"); len(students) != 0 {
+					t.Errorf("students left %+v", students)
+				}
+			},
+		},
+		{
+			name:    "sections and enrollments",
+			version: 12,
+			seed: `INSERT INTO courses (guild_id, course_id, canvas_secret, auth_role_id, section_roles, enrollment_roles, staff_role_ids, email_signature)
+				VALUES ('guild', '1001', 'secret', 'role', '{"11":"lab"}', '{"TaEnrollment":"ta"}', '["staff"]', 'COSC Staff');
+			INSERT INTO students (guild_id, course_id, position, net_id, name, sections, enrollment_type)
+				VALUES ('guild', '1001', 0, 'abc123', 'Grace Hopper', '[{"id":"11","name":"Lab 1"}]', 'StudentEnrollment');`,
+			check: func(t *testing.T, sqliteStore *SQLiteStore) {
+				course, err := sqliteStore.Course("guild", "1001")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if course == nil || course.SectionRoles["11"] != "lab" || course.EnrollmentRoles[canvas.TaEnrollment] != "ta" ||
+					!reflect.DeepEqual(course.StaffRoleIds, []string{"staff"}) || course.EmailSignature != "COSC Staff" {
+					t.Fatalf("course %+v", course)
+				}
+				if student := course.Students[0]; len(student.Sections) != 1 || student.Sections[0].Name != "Lab 1" || student.EnrollmentType != canvas.StudentEnrollment {
+					t.Errorf("student %+v", student)
+				}
+				if err := sqliteStore.EnqueueEmail(OutboxEmail{Id: "e", Status: EmailPending, CreatedAt: time.Now(), NextAttemptAt: time.Now()}); err != nil {
+					t.Errorf("outbox after migrating: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "utk-auth.db")
+			db := migrateTo(t, path, test.version)
+			if _, err := db.Exec(test.seed); err != nil {
+				t.Fatal("seeding:", err)
+			}
+			db.Close()
+
+			sqliteStore, err := NewSQLiteStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sqliteStore.Close()
+			test.check(t, sqliteStore)
+		})
+	}
+}
+
+// TestMigrationsFromEveryVersion opens a database left at each schema version
+// and checks the rest of the migrations apply on top of it
+func TestMigrationsFromEveryVersion(t *testing.T) {
+	for version := 0; version <= len(migrations); version++ {
+		path := filepath.Join(t.TempDir(), "utk-auth.db")
+		migrateTo(t, path, version).Close()
+
+		sqliteStore, err := NewSQLiteStore(path)
+		if err != nil {
+			t.Fatalf("from version %d: %v", version, err)
+		}
+		var latest int
+		err = sqliteStore.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&latest)
+		sqliteStore.Close()
+		if err != nil || latest != len(migrations) {
+			t.Errorf("from version %d ended at %d, %v", version, latest, err)
+		}
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	dir := t.TempDir()
+	jsonStore, err := NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	course := testCourse("1001")
+	member := VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user", VerifiedAt: now}
+	token := TokenData{Token: "t", GuildID: "guild", NetID: "abc123", IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+	email := OutboxEmail{Id: "e", To: []string{"abc123@vols.utk.edu"}, Status: EmailDead, LastError: "timeout", CreatedAt: now, NextAttemptAt: now, FinishedAt: now}
+	for _, err := range []error{
+		jsonStore.AddCourse(course),
+		jsonStore.PutVerifiedMembers(member),
+		jsonStore.CreateToken("user", token),
+		jsonStore.EnqueueEmail(email),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sqliteStore, err := NewSQLiteStore(filepath.Join(dir, "utk-auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+	// the second import finds the marker and leaves the imported rows alone
+	for i := 0; i < 2; i++ {
+		if err := sqliteStore.ImportJSON(dir); err != nil {
+			t.Fatalf("import %d: %v", i+1, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		got  func() (any, error)
+		want any
+	}{
+		{"courses", func() (any, error) { return sqliteStore.Courses() }, []canvas.Course{course}},
+		{"verified members", func() (any, error) { return sqliteStore.VerifiedMembersByUser("guild", "user") }, []VerifiedMember{member}},
+		{"tokens", func() (any, error) { return sqliteStore.Token("user") }, &token},
+		{"outbox", func() (any, error) { return sqliteStore.Emails(EmailDead) }, []OutboxEmail{email}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.got()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(normalizeTimes(got), normalizeTimes(test.want)) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// normalizeTimes puts the times in imported records in UTC so records read
+// back from SQLite compare equal to the ones written
+func normalizeTimes(value any) any {
+	switch v := value.(type) {
+	case []VerifiedMember:
+		for i := range v {
+			v[i].VerifiedAt = v[i].VerifiedAt.UTC()
+		}
+	case *TokenData:
+		if v != nil {
+			v.IssuedAt, v.ExpiresAt = v.IssuedAt.UTC(), v.ExpiresAt.UTC()
+		}
+	case []OutboxEmail:
+		for i := range v {
+			v[i].CreatedAt, v[i].NextAttemptAt, v[i].FinishedAt = v[i].CreatedAt.UTC(), v[i].NextAttemptAt.UTC(), v[i].FinishedAt.UTC()
+		}
+	}
+	return value
+}
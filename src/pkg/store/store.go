@@ -0,0 +1,249 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/secrets"
+)
+
+var (
+	ErrCourseExists   = errors.New("course already registered for this server")
+	ErrCourseNotFound = errors.New("course not registered for this server")
+	ErrTokenExists    = errors.New("user already has a token")
+	ErrEmailNotFound  = errors.New("email not in the outbox")
+	ErrNonceUsed      = errors.New("signed link was already used")
+	ErrNetIdBound     = errors.New("NetID is bound to another Discord account")
+)
+
+// ServerConfig holds every registered course
+type ServerConfig struct {
+	Courses []canvas.Course `json:"courses"`
+}
+
+// TokenData holds the token and guild ID, CourseID is empty when the student
+// is verifying for every course of the guild they are enrolled in
+type TokenData struct {
+	Token     string    `json:"token"`
+	GuildID   string    `json:"guild_id"`
+	CourseID  string    `json:"course_id,omitempty"`
+	NetID     string    `json:"net_id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the token is no longer valid at now. Tokens issued
+// before expiry was tracked have no ExpiresAt and count as expired.
+func (tokenData TokenData) Expired(now time.Time) bool {
+	return tokenData.ExpiresAt.IsZero() || !now.Before(tokenData.ExpiresAt)
+}
+
+// VerifiedMember records which Discord account verified with which NetID for a
+// course. Several accounts may hold the same NetID when conflicts are only flagged.
+type VerifiedMember struct {
+	GuildId    string    `json:"guildId"`
+	NetId      string    `json:"netId"`
+	UserId     string    `json:"userId"`
+	CourseId   string    `json:"courseId"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// BindMode decides what BindVerifiedMembers does about other accounts holding the NetID
+type BindMode int
+
+const (
+	// BindShared records the account alongside the others
+	BindShared BindMode = iota
+	// BindExclusive records nothing if another account holds the NetID anywhere in the guild
+	BindExclusive
+	// BindTransfer deletes the other accounts' records for the courses being recorded
+	BindTransfer
+)
+
+// delivery states of an OutboxEmail
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	// EmailDead ran out of attempts and is kept as a dead letter
+	EmailDead = "dead"
+)
+
+// OutboxEmail is a message waiting to be sent, or the record of one that was.
+// Message holds the verification link, so it is dropped once the email is sent.
+// A dead letter keeps it so it can be requeued.
+type OutboxEmail struct {
+	Id            string    `json:"id"`
+	From          string    `json:"from"`
+	To            []string  `json:"to"`
+	Message       []byte    `json:"message,omitempty"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	FinishedAt    time.Time `json:"finishedAt"`
+
+	// who the email is for, and the interaction to report its delivery to
+	GuildId          string `json:"guildId"`
+	UserId           string `json:"userId"`
+	NetId            string `json:"netId"`
+	ApplicationId    string `json:"applicationId,omitempty"`
+	InteractionToken string `json:"interactionToken,omitempty"`
+	// Note is shown to the member along with the delivery status
+	Note string `json:"note,omitempty"`
+}
+
+// ConnectRequest is a /registercourse waiting for staff to connect Canvas
+// through OAuth, kept under its OAuth state until ExpiresAt
+type ConnectRequest struct {
+	GuildId        string `json:"guildId"`
+	CourseId       string `json:"courseId"`
+	AuthRoleId     string `json:"authRoleId"`
+	StaffChannelId string `json:"staffChannelId,omitempty"`
+	// the /registercourse response to edit once Canvas is connected
+	ApplicationId    string    `json:"applicationId"`
+	InteractionToken string    `json:"interactionToken"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+}
+
+// Store persists registered courses, their rosters and pending verification tokens
+type Store interface {
+	// Courses returns every registered course
+	Courses() ([]canvas.Course, error)
+	// GuildCourses returns the courses registered for guildId
+	GuildCourses(guildId string) ([]canvas.Course, error)
+	// Course returns courseId as registered for guildId, or nil if it isn't
+	Course(guildId string, courseId string) (*canvas.Course, error)
+	// AddCourse registers a course, failing with ErrCourseExists if its guild already has it
+	AddCourse(course canvas.Course) error
+	// UpdateCourse saves a registered course's settings, leaving its roster and Canvas token alone so an edit
+	// can't undo a refresh that happened since the course was read, SetCanvasToken changes the token
+	UpdateCourse(course canvas.Course) error
+	// RemoveCourse unregisters a course along with its roster and verification records
+	RemoveCourse(guildId string, courseId string) error
+	// SetCanvasToken replaces the OAuth access token, refresh token and expiry of
+	// courseId in guildId, leaving the rest of the course alone
+	SetCanvasToken(guildId string, courseId string, accessToken string, refreshToken string, expiresAt time.Time) error
+	// MoveCourse replaces courseId in course's guild with course in one step, verification records and tokens following it
+	MoveCourse(courseId string, course canvas.Course) error
+
+	// Students returns the roster of courseId in guildId
+	Students(guildId string, courseId string) ([]canvas.Student, error)
+	// SetStudents replaces the roster of courseId in guildId
+	SetStudents(guildId string, courseId string, students []canvas.Student) error
+
+	// Token returns the pending token for userId, or nil if there is none
+	Token(userId string) (*TokenData, error)
+	// CreateToken stores a token for userId, failing with ErrTokenExists if one is already pending
+	CreateToken(userId string, token TokenData) error
+	// TakeToken removes and returns the pending token for userId if it is token, nil if
+	// there is no such token, so only one of several concurrent uses gets it
+	TakeToken(userId string, token string) (*TokenData, error)
+	// DeleteToken removes the pending token for userId
+	DeleteToken(userId string) error
+	// DeleteExpiredTokens removes every token expired at now and returns how many were removed
+	DeleteExpiredTokens(now time.Time) (int, error)
+
+	// UseNonce records the nonce of a signed link as used until expiresAt, failing with ErrNonceUsed if it already is
+	UseNonce(nonce string, expiresAt time.Time) error
+	// ReleaseNonce forgets a used nonce so its link works again, releasing one that isn't used does nothing
+	ReleaseNonce(nonce string) error
+	// DeleteExpiredNonces forgets every nonce whose link expired at now and returns how many were removed
+	DeleteExpiredNonces(now time.Time) (int, error)
+
+	// PutConnectRequest keeps request under its OAuth state until the callback takes it
+	PutConnectRequest(state string, request ConnectRequest) error
+	// TakeConnectRequest removes and returns the request kept under state, nil if
+	// there is none or it expired at now
+	TakeConnectRequest(state string, now time.Time) (*ConnectRequest, error)
+	// DeleteExpiredConnectRequests removes every request expired at now and returns how many were removed
+	DeleteExpiredConnectRequests(now time.Time) (int, error)
+
+	// PutVerifiedMembers records verifications in one step, each replacing any earlier record for the same guild, course, NetID and account
+	PutVerifiedMembers(members ...VerifiedMember) error
+	// BindVerifiedMembers checks the NetID against mode and records members, which share a guild, NetID and
+	// account, in one step. It returns the other accounts' records of the NetID in the guild as they were
+	// before, failing with ErrNetIdBound and recording nothing if mode is BindExclusive and there are any.
+	BindVerifiedMembers(mode BindMode, members ...VerifiedMember) ([]VerifiedMember, error)
+	// DeleteVerifiedMember forgets that userId verified with netId for a course, deleting nothing is not an error
+	DeleteVerifiedMember(guildId string, courseId string, netId string, userId string) error
+	// VerifiedMembersByNetId returns every record for netId in guildId
+	VerifiedMembersByNetId(guildId string, netId string) ([]VerifiedMember, error)
+	// VerifiedMembersByUser returns every record for userId in guildId
+	VerifiedMembersByUser(guildId string, userId string) ([]VerifiedMember, error)
+	// VerifiedMembersByCourse returns every record for courseId in guildId
+	VerifiedMembersByCourse(guildId string, courseId string) ([]VerifiedMember, error)
+
+	// EnqueueEmail adds an email to the outbox
+	EnqueueEmail(email OutboxEmail) error
+	// DueEmails returns up to limit pending emails due at now, the longest waiting first
+	DueEmails(now time.Time, limit int) ([]OutboxEmail, error)
+	// UpdateEmail saves an email's delivery state, failing with ErrEmailNotFound if it isn't in the outbox
+	UpdateEmail(email OutboxEmail) error
+	// Emails returns every email with status, oldest first
+	Emails(status string) ([]OutboxEmail, error)
+	// DeleteEmails removes the emails with status that finished before cutoff and returns how many were removed
+	DeleteEmails(status string, before time.Time) (int, error)
+}
+
+// FromEnv opens the store selected by STORE_BACKEND ("json", "sqlite" or "memory"),
+// keeping its files under DATA_DIR (default /data)
+func FromEnv() (Store, error) {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "/data"
+	}
+
+	backend, err := openBackend(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := secrets.KeyringFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("loading secrets keyring: %w", err)
+	}
+	if keyring == nil {
+		log.Println("SECRETS_KEYS and SECRETS_KEY_FILE are unset, Canvas secrets are stored in plaintext")
+		return backend, nil
+	}
+	encrypted := NewEncryptedStore(backend, keyring)
+	// encrypt any secrets saved before encryption was turned on
+	if _, err := encrypted.Reencrypt(false); err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+func openBackend(dataDir string) (Store, error) {
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "json":
+		log.Println("Using JSON store in", dataDir)
+		return NewJSONStore(dataDir)
+	case "sqlite":
+		dbPath := os.Getenv("SQLITE_PATH")
+		if dbPath == "" {
+			dbPath = filepath.Join(dataDir, "utk-auth.db")
+		}
+		log.Println("Using SQLite store at", dbPath)
+		sqliteStore, err := NewSQLiteStore(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		// carry over anything left in the JSON files from before the switch
+		if err := sqliteStore.ImportJSON(dataDir); err != nil {
+			sqliteStore.Close()
+			return nil, err
+		}
+		return sqliteStore, nil
+	case "memory":
+		log.Println("Using in-memory store, nothing will be persisted")
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown STORE_BACKEND %q", backend)
+	}
+}
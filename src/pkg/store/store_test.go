@@ -0,0 +1,534 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"utk-auth-go/src/pkg/canvas"
+)
+
+// testBackends opens an empty store of every backend
+func testBackends(t *testing.T) map[string]Store {
+	t.Helper()
+	dir := t.TempDir()
+	jsonStore, err := NewJSONStore(filepath.Join(dir, "json"))
+	if err != nil {
+		t.Fatal("opening JSON store:", err)
+	}
+	sqliteStore, err := NewSQLiteStore(filepath.Join(dir, "utk-auth.db"))
+	if err != nil {
+		t.Fatal("opening SQLite store:", err)
+	}
+	t.Cleanup(func() { sqliteStore.Close() })
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"json":   jsonStore,
+		"sqlite": sqliteStore,
+	}
+}
+
+func testCourse(courseId string) canvas.Course {
+	return canvas.Course{
+		GuildId:      "guild",
+		CanvasSecret: "secret-" + courseId,
+		CourseId:     courseId,
+		Students: []canvas.Student{
+			{NetId: "abc123", Name: "Grace Hopper", Sections: []canvas.Section{{Id: "11", Name: "Lab 1"}}, EnrollmentType: canvas.StudentEnrollment},
+			{NetId: "ta1", Name: "Alan Turing", EnrollmentType: canvas.TaEnrollment, EnrollmentRole: "Grader"},
+		},
+		AuthRoleId:      "role-" + courseId,
+		StaffChannelId:  "channel",
+		SectionRoles:    map[string]string{"11": "lab-role"},
+		EnrollmentRoles: map[string]string{canvas.TaEnrollment: "ta-role"},
+		DropPolicy:      canvas.DropAlumni,
+		AlumniRoleId:    "alumni",
+		StaffRoleIds:    []string{"staff"},
+		EmailSignature:  "COSC Staff",
+	}
+}
+
+func TestStore(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	tests := []struct {
+		name string
+		run  func(t *testing.T, dataStore Store)
+	}{
+		{"course round trip", func(t *testing.T, dataStore Store) {
+			want := testCourse("1001")
+			if err := dataStore.AddCourse(want); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.AddCourse(want); !errors.Is(err, ErrCourseExists) {
+				t.Errorf("second AddCourse got %v, want ErrCourseExists", err)
+			}
+			got, err := dataStore.Course("guild", "1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || !reflect.DeepEqual(*got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if missing, err := dataStore.Course("guild", "404"); err != nil || missing != nil {
+				t.Errorf("unknown course got %+v, %v", missing, err)
+			}
+		}},
+		{"courses by guild", func(t *testing.T, dataStore Store) {
+			other := testCourse("2002")
+			other.GuildId = "other"
+			for _, course := range []canvas.Course{testCourse("1001"), testCourse("1002"), other} {
+				if err := dataStore.AddCourse(course); err != nil {
+					t.Fatal(err)
+				}
+			}
+			all, err := dataStore.Courses()
+			if err != nil {
+				t.Fatal(err)
+			}
+			guild, err := dataStore.GuildCourses("guild")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 3 || len(guild) != 2 || guild[0].CourseId != "1001" || guild[1].CourseId != "1002" {
+				t.Errorf("got %d courses, %d in guild", len(all), len(guild))
+			}
+		}},
+		{"update leaves the roster", func(t *testing.T, dataStore Store) {
+			course := testCourse("1001")
+			if err := dataStore.AddCourse(course); err != nil {
+				t.Fatal(err)
+			}
+			course.AuthRoleId = "new-role"
+			course.Students = nil
+			if err := dataStore.UpdateCourse(course); err != nil {
+				t.Fatal(err)
+			}
+			got, err := dataStore.Course("guild", "1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.AuthRoleId != "new-role" || len(got.Students) != 2 {
+				t.Errorf("got %+v", got)
+			}
+			missing := testCourse("404")
+			if err := dataStore.UpdateCourse(missing); !errors.Is(err, ErrCourseNotFound) {
+				t.Errorf("updating an unknown course got %v", err)
+			}
+		}},
+		{"set students", func(t *testing.T, dataStore Store) {
+			if err := dataStore.AddCourse(testCourse("1001")); err != nil {
+				t.Fatal(err)
+			}
+			roster := []canvas.Student{{NetId: "new1", Name: "New Student", EnrollmentType: canvas.StudentEnrollment}}
+			if err := dataStore.SetStudents("guild", "1001", roster); err != nil {
+				t.Fatal(err)
+			}
+			got, err := dataStore.Students("guild", "1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, roster) {
+				t.Errorf("got %+v", got)
+			}
+		}},
+		{"remove takes the verification records", func(t *testing.T, dataStore Store) {
+			for _, courseId := range []string{"1001", "1002"} {
+				if err := dataStore.AddCourse(testCourse(courseId)); err != nil {
+					t.Fatal(err)
+				}
+				if err := dataStore.PutVerifiedMembers(VerifiedMember{GuildId: "guild", CourseId: courseId, NetId: "abc123", UserId: "user", VerifiedAt: now}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := dataStore.RemoveCourse("guild", "1001"); err != nil {
+				t.Fatal(err)
+			}
+			course, _ := dataStore.Course("guild", "1001")
+			members, err := dataStore.VerifiedMembersByUser("guild", "user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if course != nil || len(members) != 1 || members[0].CourseId != "1002" {
+				t.Errorf("course %+v, members %+v", course, members)
+			}
+		}},
+		{"move re-keys the course and its records", func(t *testing.T, dataStore Store) {
+			for _, courseId := range []string{"1001", "1002"} {
+				if err := dataStore.AddCourse(testCourse(courseId)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := dataStore.PutVerifiedMembers(VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user", VerifiedAt: now}); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.CreateToken("user", TokenData{Token: "t", GuildID: "guild", CourseID: "1001", NetID: "abc123", ExpiresAt: now.Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			moved := testCourse("3003")
+			moved.Students = moved.Students[:1]
+			if err := dataStore.MoveCourse("1001", moved); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.MoveCourse("3003", testCourse("1002")); !errors.Is(err, ErrCourseExists) {
+				t.Errorf("moving onto a registered course got %v", err)
+			}
+			if err := dataStore.MoveCourse("404", testCourse("4004")); !errors.Is(err, ErrCourseNotFound) {
+				t.Errorf("moving an unknown course got %v", err)
+			}
+
+			old, _ := dataStore.Course("guild", "1001")
+			got, err := dataStore.Course("guild", "3003")
+			if err != nil {
+				t.Fatal(err)
+			}
+			members, err := dataStore.VerifiedMembersByNetId("guild", "abc123")
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := dataStore.Token("user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if old != nil || got == nil || len(got.Students) != 1 {
+				t.Errorf("old %+v, moved %+v", old, got)
+			}
+			if len(members) != 1 || members[0].CourseId != "3003" {
+				t.Errorf("members %+v", members)
+			}
+			if token == nil || token.CourseID != "3003" {
+				t.Errorf("token %+v", token)
+			}
+		}},
+		{"tokens", func(t *testing.T, dataStore Store) {
+			live := TokenData{Token: "live", GuildID: "guild", NetID: "abc123", IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+			if err := dataStore.CreateToken("user1", live); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.CreateToken("user1", live); !errors.Is(err, ErrTokenExists) {
+				t.Errorf("second CreateToken got %v", err)
+			}
+			if err := dataStore.CreateToken("user2", TokenData{Token: "old", GuildID: "guild", ExpiresAt: now.Add(-time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			removed, err := dataStore.DeleteExpiredTokens(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := dataStore.Token("user1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 1 || got == nil || got.Token != "live" || !got.ExpiresAt.Equal(live.ExpiresAt) {
+				t.Errorf("removed %d, kept %+v", removed, got)
+			}
+			if got, err := dataStore.TakeToken("user1", "wrong"); err != nil || got != nil {
+				t.Errorf("taking the wrong token got %+v, %v", got, err)
+			}
+			if got, err := dataStore.TakeToken("user1", "live"); err != nil || got == nil || got.NetID != "abc123" {
+				t.Errorf("taking the token got %+v, %v", got, err)
+			}
+			if got, err := dataStore.TakeToken("user1", "live"); err != nil || got != nil {
+				t.Errorf("taking the token twice got %+v, %v", got, err)
+			}
+			if err := dataStore.CreateToken("user1", live); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.DeleteToken("user1"); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := dataStore.Token("user1"); err != nil || got != nil {
+				t.Errorf("deleted token got %+v, %v", got, err)
+			}
+		}},
+		{"canvas token refresh", func(t *testing.T, dataStore Store) {
+			course := testCourse("1001")
+			course.CanvasRefreshToken = "refresh"
+			if err := dataStore.AddCourse(course); err != nil {
+				t.Fatal(err)
+			}
+			// an edit made while the token was being refreshed
+			edited := course
+			edited.AuthRoleId = "edited-role"
+			if err := dataStore.UpdateCourse(edited); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.SetCanvasToken("guild", "1001", "access2", "refresh2", now.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.SetCanvasToken("guild", "404", "access2", "refresh2", now); !errors.Is(err, ErrCourseNotFound) {
+				t.Errorf("unknown course got %v", err)
+			}
+			got, err := dataStore.Course("guild", "1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.AuthRoleId != "edited-role" || got.CanvasSecret != "access2" || got.CanvasRefreshToken != "refresh2" ||
+				!got.CanvasTokenExpiresAt.Equal(now.Add(time.Hour)) || len(got.Students) != len(course.Students) {
+				t.Errorf("got %+v", got)
+			}
+			// an edit of the course as it was read before the refresh keeps the new token
+			edited.StaffChannelId = "edited-channel"
+			if err := dataStore.UpdateCourse(edited); err != nil {
+				t.Fatal(err)
+			}
+			got, _ = dataStore.Course("guild", "1001")
+			if got.StaffChannelId != "edited-channel" || got.CanvasSecret != "access2" || got.CanvasRefreshToken != "refresh2" ||
+				!got.CanvasTokenExpiresAt.Equal(now.Add(time.Hour)) {
+				t.Errorf("stale edit left %+v", got)
+			}
+		}},
+		{"connect requests", func(t *testing.T, dataStore Store) {
+			want := ConnectRequest{GuildId: "guild", CourseId: "1001", AuthRoleId: "role", StaffChannelId: "channel",
+				ApplicationId: "app", InteractionToken: "interaction", ExpiresAt: now.Add(time.Hour)}
+			for state, request := range map[string]ConnectRequest{"live": want, "expired": {GuildId: "guild", ExpiresAt: now.Add(-time.Hour)}, "swept": {ExpiresAt: now}} {
+				if err := dataStore.PutConnectRequest(state, request); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, err := dataStore.TakeConnectRequest("expired", now); err != nil || got != nil {
+				t.Errorf("expired request got %+v, %v", got, err)
+			}
+			removed, err := dataStore.DeleteExpiredConnectRequests(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 1 {
+				t.Errorf("removed %d requests, want 1", removed)
+			}
+			got, err := dataStore.TakeConnectRequest("live", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || *got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if got, err := dataStore.TakeConnectRequest("live", now); err != nil || got != nil {
+				t.Errorf("taking twice got %+v, %v", got, err)
+			}
+		}},
+		{"nonces", func(t *testing.T, dataStore Store) {
+			if err := dataStore.UseNonce("n1", now.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.UseNonce("n1", now.Add(time.Hour)); !errors.Is(err, ErrNonceUsed) {
+				t.Errorf("second use got %v", err)
+			}
+			if err := dataStore.UseNonce("n2", now.Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			removed, err := dataStore.DeleteExpiredNonces(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 1 {
+				t.Errorf("removed %d nonces, want 1", removed)
+			}
+			if err := dataStore.UseNonce("n1", now.Add(time.Hour)); !errors.Is(err, ErrNonceUsed) {
+				t.Errorf("use after sweeping got %v", err)
+			}
+			if err := dataStore.ReleaseNonce("n1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.ReleaseNonce("n1"); err != nil {
+				t.Errorf("releasing an unused nonce got %v", err)
+			}
+			if err := dataStore.UseNonce("n1", now.Add(time.Hour)); err != nil {
+				t.Errorf("use after releasing got %v", err)
+			}
+		}},
+		{"verified members", func(t *testing.T, dataStore Store) {
+			err := dataStore.PutVerifiedMembers(
+				VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+				VerifiedMember{GuildId: "guild", CourseId: "1002", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+				VerifiedMember{GuildId: "other", CourseId: "1001", NetId: "abc123", UserId: "user1", VerifiedAt: now},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a second account with the same NetID gets its own record
+			if err := dataStore.PutVerifiedMembers(VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user2", VerifiedAt: now}); err != nil {
+				t.Fatal(err)
+			}
+			// verifying again only updates the time
+			if err := dataStore.PutVerifiedMembers(VerifiedMember{GuildId: "guild", CourseId: "1002", NetId: "abc123", UserId: "user1", VerifiedAt: now.Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			byNetId, err := dataStore.VerifiedMembersByNetId("guild", "abc123")
+			if err != nil {
+				t.Fatal(err)
+			}
+			byUser, err := dataStore.VerifiedMembersByUser("guild", "user1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			byCourse, err := dataStore.VerifiedMembersByCourse("guild", "1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(byNetId) != 3 || len(byUser) != 2 || byUser[1].CourseId != "1002" || !byUser[1].VerifiedAt.Equal(now.Add(time.Hour)) {
+				t.Errorf("by NetID %+v, by user %+v", byNetId, byUser)
+			}
+			if len(byCourse) != 2 || byCourse[0].NetId != "abc123" || byCourse[0].UserId == byCourse[1].UserId {
+				t.Errorf("by course %+v", byCourse)
+			}
+			if err := dataStore.DeleteVerifiedMember("guild", "1001", "abc123", "user1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.DeleteVerifiedMember("guild", "1001", "abc123", "user1"); err != nil {
+				t.Errorf("deleting nothing got %v", err)
+			}
+			byUser, _ = dataStore.VerifiedMembersByUser("guild", "user1")
+			second, _ := dataStore.VerifiedMembersByUser("guild", "user2")
+			if len(byUser) != 1 || byUser[0].CourseId != "1002" || len(second) != 1 {
+				t.Errorf("left %+v and %+v", byUser, second)
+			}
+		}},
+		{"binding a NetID", func(t *testing.T, dataStore Store) {
+			member := func(courseId string, userId string) VerifiedMember {
+				return VerifiedMember{GuildId: "guild", CourseId: courseId, NetId: "abc123", UserId: userId, VerifiedAt: now}
+			}
+			if others, err := dataStore.BindVerifiedMembers(BindExclusive, member("1001", "user1"), member("1002", "user1")); err != nil || len(others) != 0 {
+				t.Fatalf("first bind got %+v, %v", others, err)
+			}
+			if others, err := dataStore.BindVerifiedMembers(BindExclusive, member("1001", "user1")); err != nil || len(others) != 0 {
+				t.Errorf("binding again got %+v, %v", others, err)
+			}
+			others, err := dataStore.BindVerifiedMembers(BindExclusive, member("1003", "user2"))
+			if !errors.Is(err, ErrNetIdBound) || len(others) != 2 || others[0].UserId != "user1" {
+				t.Errorf("exclusive bind of a held NetID got %+v, %v", others, err)
+			}
+			if held, _ := dataStore.VerifiedMembersByUser("guild", "user2"); len(held) != 0 {
+				t.Errorf("refused bind recorded %+v", held)
+			}
+
+			if others, err := dataStore.BindVerifiedMembers(BindShared, member("1001", "user2")); err != nil || len(others) != 2 {
+				t.Errorf("shared bind got %+v, %v", others, err)
+			}
+			if first, _ := dataStore.VerifiedMembersByUser("guild", "user1"); len(first) != 2 {
+				t.Errorf("shared bind left the first account %+v", first)
+			}
+
+			if others, err := dataStore.BindVerifiedMembers(BindTransfer, member("1001", "user3")); err != nil || len(others) != 3 {
+				t.Errorf("transfer got %+v, %v", others, err)
+			}
+			byNetId, err := dataStore.VerifiedMembersByNetId("guild", "abc123")
+			if err != nil {
+				t.Fatal(err)
+			}
+			holders := make(map[string]string)
+			for _, record := range byNetId {
+				holders[record.CourseId] += record.UserId + " "
+			}
+			if holders["1001"] != "user3 " || holders["1002"] != "user1 " {
+				t.Errorf("after the transfer %v", holders)
+			}
+		}},
+		{"binding a NetID twice at once", func(t *testing.T, dataStore Store) {
+			var wg sync.WaitGroup
+			errs := make([]error, 8)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = dataStore.BindVerifiedMembers(BindExclusive,
+						VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: fmt.Sprint("user", i), VerifiedAt: now})
+				}(i)
+			}
+			wg.Wait()
+			bound := 0
+			for _, err := range errs {
+				if err == nil {
+					bound++
+				} else if !errors.Is(err, ErrNetIdBound) {
+					t.Error(err)
+				}
+			}
+			held, err := dataStore.VerifiedMembersByNetId("guild", "abc123")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bound != 1 || len(held) != 1 {
+				t.Errorf("%d binds went through, %d records", bound, len(held))
+			}
+		}},
+		{"outbox", func(t *testing.T, dataStore Store) {
+			for i, id := range []string{"a", "b", "c"} {
+				email := OutboxEmail{Id: id, To: []string{id}, Message: []byte(id), Status: EmailPending,
+					CreatedAt: now.Add(time.Duration(i) * time.Second), NextAttemptAt: now.Add(time.Duration(i-1) * time.Minute)}
+				if err := dataStore.EnqueueEmail(email); err != nil {
+					t.Fatal(err)
+				}
+			}
+			due, err := dataStore.DueEmails(now, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(due) != 2 || due[0].Id != "a" || due[1].Id != "b" || string(due[0].Message) != "a" {
+				t.Fatalf("due %+v", due)
+			}
+			due[0].Status = EmailSent
+			due[0].FinishedAt = now
+			if err := dataStore.UpdateEmail(due[0]); err != nil {
+				t.Fatal(err)
+			}
+			if err := dataStore.UpdateEmail(OutboxEmail{Id: "missing", Status: EmailSent}); !errors.Is(err, ErrEmailNotFound) {
+				t.Errorf("updating an unknown email got %v", err)
+			}
+			sent, err := dataStore.Emails(EmailSent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			removed, err := dataStore.DeleteEmails(EmailSent, now.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending, err := dataStore.Emails(EmailPending)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sent) != 1 || removed != 1 || len(pending) != 2 {
+				t.Errorf("%d sent, %d removed, %d pending", len(sent), removed, len(pending))
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		for backend, dataStore := range testBackends(t) {
+			t.Run(backend+"/"+test.name, func(t *testing.T) {
+				test.run(t, dataStore)
+			})
+		}
+	}
+}
+
+func TestJSONMoveCoursePutsBack(t *testing.T) {
+	dir := t.TempDir()
+	jsonStore, err := NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jsonStore.AddCourse(testCourse("1001")); err != nil {
+		t.Fatal(err)
+	}
+	member := VerifiedMember{GuildId: "guild", CourseId: "1001", NetId: "abc123", UserId: "user1", VerifiedAt: time.Now()}
+	if err := jsonStore.PutVerifiedMembers(member); err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens.json is written last, so failing it has to put the course and members back
+	jsonStore.tokensPath = filepath.Join(dir, "missing", "tokens.json")
+	moved := testCourse("2001")
+	if err := jsonStore.MoveCourse("1001", moved); err == nil {
+		t.Fatal("move with an unwritable tokens.json worked")
+	}
+	if course, _ := jsonStore.Course("guild", "1001"); course == nil {
+		t.Error("course wasn't put back")
+	}
+	if members, _ := jsonStore.VerifiedMembersByUser("guild", "user1"); len(members) != 1 || members[0].CourseId != "1001" {
+		t.Errorf("members are %+v", members)
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// heldValues keeps values for a while under random IDs, for state that has to
+// survive between a command and the button or link that finishes it
+type heldValues[T any] struct {
+	mutex  sync.Mutex
+	values map[string]heldValue[T]
+}
+
+type heldValue[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+func newHeldValues[T any]() *heldValues[T] {
+	return &heldValues[T]{values: make(map[string]heldValue[T])}
+}
+
+// randomId returns a random 32 character hex ID
+func randomId() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// hold keeps value for ttl and returns its ID
+func (held *heldValues[T]) hold(value T, ttl time.Duration) (string, error) {
+	id, err := randomId()
+	if err != nil {
+		return "", err
+	}
+
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+	now := time.Now()
+	for heldId, heldValue := range held.values {
+		if now.After(heldValue.expiresAt) {
+			delete(held.values, heldId)
+		}
+	}
+	held.values[id] = heldValue[T]{value: value, expiresAt: now.Add(ttl)}
+	return id, nil
+}
+
+// take removes and returns a value, false if it expired or was already taken
+func (held *heldValues[T]) take(id string) (T, bool) {
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+
+	heldValue, ok := held.values[id]
+	delete(held.values, id)
+	if !ok || time.Now().After(heldValue.expiresAt) {
+		var zero T
+		return zero, false
+	}
+	return heldValue.value, true
+}
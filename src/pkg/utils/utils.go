@@ -1,18 +1,24 @@
 package utils
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"log"
 	"os"
-	"sync"
+	"strings"
+	"time"
 	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvasoauth"
+	"utk-auth-go/src/pkg/store"
 )
 
-var mutex sync.Mutex
+// store backing every course and roster lookup
+var dataStore store.Store
 
-type ServerConfig struct {
-	Courses []canvas.Course `json:"courses"`
+// SetStore sets the store used by the course and roster helpers
+func SetStore(s store.Store) {
+	dataStore = s
 }
 
 // helper functions
@@ -41,82 +47,62 @@ func NewEmbeds(embeds ...*discordgo.MessageEmbed) *[]*discordgo.MessageEmbed {
 	return &embeds
 }
 
-func StudentExists(guildId string, netId string) (bool, error) {
-	// open /data/server_config.json and check if student exists in any courses
-	file, err := os.ReadFile("/data/server_config.json")
+// StudentCourses returns the courses registered for guildId that netId is enrolled in
+func StudentCourses(guildId string, netId string) ([]canvas.Course, error) {
+	courses, err := dataStore.GuildCourses(guildId)
 	if err != nil {
-		log.Println("Error reading server_config.json while checking for student:", err)
-		return false, err
+		log.Println("Error reading courses while checking for student:", err)
+		return nil, err
 	}
-
-	if len(file) == 0 {
-		log.Println("server_config.json is empty")
-		return false, nil
+	if len(courses) == 0 {
+		log.Println("No courses found for guildId:", guildId)
 	}
 
-	var serverConfig ServerConfig
-	err = json.Unmarshal(file, &serverConfig)
-	if err != nil {
-		log.Println("Error unmarshalling server_config.json while checking for student:", err)
-		return false, err
-	}
-
-	for _, course := range serverConfig.Courses {
-		if course.GuildId == guildId {
-			for _, student := range course.Students {
-				if student.NetId == netId {
-					return true, nil
-				}
+	enrolled := []canvas.Course{}
+	for _, course := range courses {
+		for _, student := range course.Students {
+			if student.NetId == netId {
+				enrolled = append(enrolled, course)
+				break
 			}
-			log.Println("No Student found for guildId:", guildId)
-		} else {
-			log.Println("No courses found for guildId:", guildId)
 		}
 	}
-
-	return false, nil
+	if len(enrolled) == 0 {
+		log.Println("No Student found for guildId:", guildId)
+	}
+	return enrolled, nil
 }
 
 func GuildIdExists(guildId string) (bool, error) {
-	file, err := os.ReadFile("/data/server_config.json")
+	courses, err := dataStore.GuildCourses(guildId)
 	if err != nil {
-		log.Println("Error reading server_config.json while checking for guildId:", err)
+		log.Println("Error reading courses while checking for guildId:", err)
 		return false, err
 	}
-	if len(file) == 0 {
-		return false, nil
-	}
-	var serverConfig ServerConfig
-	err = json.Unmarshal(file, &serverConfig)
+	return len(courses) != 0, nil
+}
+
+func CourseExists(guildId string, courseId string) (bool, error) {
+	course, err := dataStore.Course(guildId, courseId)
 	if err != nil {
-		log.Println("Error unmarshalling server_config.json while checking for guildId:", err)
+		log.Println("Error reading course while checking for courseId:", err)
 		return false, err
 	}
-	for _, course := range serverConfig.Courses {
-		if course.GuildId == guildId {
-			return true, nil
-		}
-	}
-	return false, nil
+	return course != nil, nil
 }
 
 var (
 	// name that the command is invoked by
 	RegisterCourseName = "registercourse"
 
-	// invoked by "/registercourse [canvas_secret]"
+	// invoked by "/registercourse [course_id] [auth_role_id] [canvas_secret] [staff_channel]"
 	RegisterCourseCommand = discordgo.ApplicationCommand{
 		Name:        "registercourse",
-		Description: "Register your course to the current Discord server using your Canvas API secret",
+		Description: "Register your course to the current Discord server by connecting Canvas",
 
-		Type: discordgo.ChatApplicationCommand,
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
 		Options: []*discordgo.ApplicationCommandOption{
-			{
-				Type:        discordgo.ApplicationCommandOptionString,
-				Name:        "canvas_secret",
-				Description: "Your Canvas API Secret",
-				Required:    true,
-			},
 			{
 				Type:        discordgo.ApplicationCommandOptionString,
 				Name:        "course_id",
@@ -129,81 +115,939 @@ var (
 				Description: "Your student authenticated role ID",
 				Required:    true,
 			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "canvas_secret",
+				Description: "Your Canvas API Secret, leave it out to connect Canvas through a link instead",
+				Required:    false,
+			},
+			{
+				Type:         discordgo.ApplicationCommandOptionChannel,
+				Name:         "staff_channel",
+				Description:  "Channel where the bot reports verification problems to staff",
+				ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+				Required:     false,
+			},
+		},
+	}
+)
+
+var (
+	// name that the command is invoked by
+	ResyncName = "resync"
+
+	// invoked by "/resync [course]"
+	ResyncCommand = discordgo.ApplicationCommand{
+		Name:        "resync",
+		Description: "Refresh a course's roster from Canvas now",
+
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
+		Options:                  []*discordgo.ApplicationCommandOption{courseOption},
+	}
+)
+
+var (
+	// name that the command is invoked by
+	UpdateCourseName = "updatecourse"
+
+	// invoked by "/updatecourse [course] [canvas_secret] [course_id] [auth_role] [staff_channel]"
+	UpdateCourseCommand = discordgo.ApplicationCommand{
+		Name:        "updatecourse",
+		Description: "Change a registered course's Canvas secret, course ID, auth role or staff channel",
+
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			courseOption,
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "canvas_secret",
+				Description: "New Canvas API secret",
+				Required:    false,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "course_id",
+				Description: "New Canvas course ID",
+				Required:    false,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionRole,
+				Name:        "auth_role",
+				Description: "New role for verified students",
+				Required:    false,
+			},
+			{
+				Type:         discordgo.ApplicationCommandOptionChannel,
+				Name:         "staff_channel",
+				Description:  "New channel for staff notices",
+				ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+				Required:     false,
+			},
 		},
 	}
+
+	// name that the command is invoked by
+	UnregisterCourseName = "unregistercourse"
+
+	// invoked by "/unregistercourse [course]"
+	UnregisterCourseCommand = discordgo.ApplicationCommand{
+		Name:        "unregistercourse",
+		Description: "Remove a course from this server along with its roster",
+
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
+		Options:                  []*discordgo.ApplicationCommandOption{courseOption},
+	}
+)
+
+var (
+	ErrCanvasRejected    = errors.New("Canvas did not return a roster for the course")
+	ErrEmptyCanvasCourse = errors.New("Canvas returned no enrollments for the course")
+	ErrRoleNotFound      = errors.New("role does not exist in this server")
+	ErrRoleNotAssignable = errors.New("role cannot be given out by the bot")
 )
 
-func RegisterCourse(guildId string, canvasSecret string, courseId string, authRoleId string) error {
-	log.Println("Registering course for guildId:", guildId)
+// CourseUpdate holds the course fields to change, empty fields stay as they are
+type CourseUpdate struct {
+	CanvasSecret   string
+	CourseId       string
+	AuthRoleId     string
+	StaffChannelId string
+}
 
-	// open /data/server_config.json and add a new course to the list
-	file, err := os.ReadFile("/data/server_config.json")
+// UpdateCourse checks and applies update to a registered course. A new Canvas
+// secret or course ID must pass the /registercourse checks before it's saved,
+// and a new course ID moves the course, verification records included.
+func UpdateCourse(s *discordgo.Session, guildId string, courseId string, update CourseUpdate) (*canvas.Course, error) {
+	course, err := dataStore.Course(guildId, courseId)
 	if err != nil {
-		log.Println("Error reading server_config.json while registering course:", err)
-		return err
+		log.Println("Error reading course while updating course:", err)
+		return nil, err
+	}
+	if course == nil {
+		return nil, store.ErrCourseNotFound
 	}
-	var serverConfig ServerConfig
 
-	if len(file) != 0 {
-		err = json.Unmarshal(file, &serverConfig)
+	if update.AuthRoleId != "" {
+		if err := ValidateRole(s, guildId, update.AuthRoleId); err != nil {
+			return nil, err
+		}
+		course.AuthRoleId = update.AuthRoleId
+	}
+	if update.StaffChannelId != "" {
+		course.StaffChannelId = update.StaffChannelId
+	}
+
+	canvasChanged := false
+	if update.CanvasSecret != "" && update.CanvasSecret != course.CanvasSecret {
+		// a pasted secret replaces any OAuth connection
+		course.CanvasSecret = update.CanvasSecret
+		course.CanvasRefreshToken = ""
+		course.CanvasTokenExpiresAt = time.Time{}
+		canvasChanged = true
+	} else if err := canvasoauth.EnsureFresh(dataStore, course); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCanvasRejected, err)
+	}
+	if update.CourseId != "" && update.CourseId != courseId {
+		if exists, err := CourseExists(guildId, update.CourseId); err != nil {
+			return nil, err
+		} else if exists {
+			return nil, store.ErrCourseExists
+		}
+		course.CourseId = update.CourseId
+		canvasChanged = true
+	}
+	if canvasChanged {
+		// the same checks as /registercourse, the secret must belong to staff of the course
+		preview, err := PreviewCourse(guildId, course.CanvasSecret, course.CourseId, course.AuthRoleId, course.StaffChannelId)
 		if err != nil {
-			log.Println("Error unmarshalling server_config.json while registering course:", err)
-			return err
+			log.Println("Error checking course with Canvas while updating course:", err)
+			return nil, err
 		}
-	} else {
-		// populate server config with empty courses
-		serverConfig = ServerConfig{
-			Courses: []canvas.Course{},
+		course.Students = preview.Course.Students
+	}
+
+	if course.CourseId != courseId {
+		if err := dataStore.MoveCourse(courseId, *course); err != nil {
+			log.Println("Error moving course while updating course:", err)
+			return nil, err
+		}
+		return course, nil
+	}
+
+	if err := dataStore.UpdateCourse(*course); err != nil {
+		log.Println("Error saving course while updating course:", err)
+		return nil, err
+	}
+	if canvasChanged {
+		// UpdateCourse leaves the token alone so it can't undo a refresh
+		if err := dataStore.SetCanvasToken(guildId, courseId, course.CanvasSecret, course.CanvasRefreshToken, course.CanvasTokenExpiresAt); err != nil {
+			log.Println("Error saving Canvas secret while updating course:", err)
+			return nil, err
+		}
+		if err := dataStore.SetStudents(guildId, courseId, course.Students); err != nil {
+			log.Println("Error saving roster while updating course:", err)
+			return nil, err
 		}
 	}
+	return course, nil
+}
 
-	students, err := canvas.GetCourseStudents(courseId, canvasSecret)
+// ValidateRole checks that roleId exists in the guild and that the bot is able
+// to give it out
+func ValidateRole(s *discordgo.Session, guildId string, roleId string) error {
+	roles, err := s.GuildRoles(guildId)
 	if err != nil {
 		return err
 	}
-	newCourse := canvas.Course{
-		GuildId:      guildId,
-		CanvasSecret: canvasSecret,
-		CourseId:     courseId,
-		Students:     students,
-		AuthRoleId:   authRoleId,
+	var role *discordgo.Role
+	for _, guildRole := range roles {
+		if guildRole.ID == roleId {
+			role = guildRole
+		}
+	}
+	if role == nil {
+		return ErrRoleNotFound
+	}
+	// @everyone shares the guild's ID, managed roles belong to integrations
+	if role.ID == guildId || role.Managed {
+		return ErrRoleNotAssignable
 	}
-	serverConfig.Courses = append(serverConfig.Courses, newCourse)
-	serverConfigBytes, err := json.Marshal(serverConfig)
+
+	bot, err := s.GuildMember(guildId, s.State.User.ID)
 	if err != nil {
-		log.Println("Error marshalling server_config.json while registering course")
 		return err
 	}
-	err = os.WriteFile("/data/server_config.json", serverConfigBytes, 0644)
+	highest := 0
+	for _, botRoleId := range bot.Roles {
+		for _, guildRole := range roles {
+			if guildRole.ID == botRoleId && guildRole.Position > highest {
+				highest = guildRole.Position
+			}
+		}
+	}
+	if role.Position >= highest {
+		return ErrRoleNotAssignable
+	}
+	return nil
+}
+
+// UnregisterCourse removes a course from its guild, roster and verification records included
+func UnregisterCourse(guildId string, courseId string) error {
+	err := dataStore.RemoveCourse(guildId, courseId)
 	if err != nil {
-		log.Println("Error writing server_config.json while registering course")
+		log.Println("Error removing course while unregistering course:", err)
 		return err
 	}
+	log.Println("Unregistered course", courseId, "for guildId:", guildId)
 	return nil
 }
 
-func GetCourseObject(guildID string) (*canvas.Course, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+var ErrNotCourseStaff = errors.New("the Canvas secret's user is not a teacher or TA in the course")
 
-	file, err := os.ReadFile("/data/server_config.json")
+// CoursePreview is a course checked against Canvas and waiting for staff to
+// confirm its registration
+type CoursePreview struct {
+	Course       canvas.Course
+	Info         canvas.CourseInfo
+	StudentCount int
+	// Skipped are the enrollments left off the roster
+	Skipped []canvas.SkippedEnrollment
+}
+
+// previews awaiting confirmation, keyed by the ID carried on their buttons
+var previews = newHeldValues[*CoursePreview]()
+
+// previewTTL matches how long discord lets the bot edit its interaction response
+const previewTTL = 15 * time.Minute
+
+// PreviewCourse checks that the course exists on Canvas, that the secret
+// belongs to one of its teachers or TAs and that it has students, without
+// saving anything
+func PreviewCourse(guildId string, canvasSecret string, courseId string, authRoleId string, staffChannelId string) (*CoursePreview, error) {
+	log.Println("Previewing course for guildId:", guildId)
+
+	info, err := canvas.GetCourse(courseId, canvasSecret)
 	if err != nil {
-		log.Println("Error reading server_config.json while getting course object:", err)
 		return nil, err
 	}
-	if len(file) == 0 {
-		return nil, nil
+	if !info.TeachesCourse() {
+		return nil, ErrNotCourseStaff
 	}
-	var serverConfig ServerConfig
-	err = json.Unmarshal(file, &serverConfig)
+	students, skipped, err := canvas.GetCourseStudents(courseId, canvasSecret)
 	if err != nil {
-		log.Println("Error unmarshalling server_config.json while getting course object:", err)
+		return nil, fmt.Errorf("%w: %w", ErrCanvasRejected, err)
+	}
+
+	studentCount := 0
+	for _, student := range students {
+		if student.EnrollmentType == canvas.StudentEnrollment {
+			studentCount++
+		}
+	}
+	if studentCount == 0 {
+		return nil, ErrEmptyCanvasCourse
+	}
+
+	return &CoursePreview{
+		Course: canvas.Course{
+			GuildId:        guildId,
+			CanvasSecret:   canvasSecret,
+			CourseId:       courseId,
+			Students:       students,
+			AuthRoleId:     authRoleId,
+			StaffChannelId: staffChannelId,
+		},
+		Info:         *info,
+		StudentCount: studentCount,
+		Skipped:      skipped,
+	}, nil
+}
+
+// custom IDs of the /registercourse buttons, both carry the preview ID after a colon
+const (
+	RegisterConfirmId = "registercourse_confirm"
+	RegisterCancelId  = "registercourse_cancel"
+)
+
+// PreviewEdit shows a held preview with its Confirm and Cancel buttons
+func PreviewEdit(preview *CoursePreview, previewId string) *discordgo.WebhookEdit {
+	term := preview.Info.Term.Name
+	if term == "" {
+		term = "None"
+	}
+	fields := []*discordgo.MessageEmbedField{
+		{Name: "Course", Value: preview.Info.Name, Inline: true},
+		{Name: "Term", Value: term, Inline: true},
+		{Name: "Students", Value: fmt.Sprint(preview.StudentCount), Inline: true},
+		{Name: "Course ID", Value: preview.Course.CourseId, Inline: true},
+		{Name: "Auth role", Value: fmt.Sprintf("<@&%s>", preview.Course.AuthRoleId), Inline: true},
+	}
+	if len(preview.Skipped) > 0 {
+		fields = append(fields, SkippedField(preview.Skipped))
+	}
+	return &discordgo.WebhookEdit{
+		Content: StrPtr(""),
+		Embeds: NewEmbeds(NewEmbed(
+			"Register "+preview.Info.Name+"?",
+			"Check that this is the right course before registering it.",
+			0xff4400,
+			fields,
+		)),
+		Components: &[]discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Confirm",
+						Style:    discordgo.SuccessButton,
+						CustomID: RegisterConfirmId + ":" + previewId,
+					},
+					discordgo.Button{
+						Label:    "Cancel",
+						Style:    discordgo.SecondaryButton,
+						CustomID: RegisterCancelId + ":" + previewId,
+					},
+				},
+			},
+		},
+	}
+}
+
+// SkippedField lists the enrollments left off a roster, as many as fit in an
+// embed field
+func SkippedField(skipped []canvas.SkippedEnrollment) *discordgo.MessageEmbedField {
+	const maxLines = 5
+	var lines []string
+	for i, enrollment := range skipped {
+		if i == maxLines {
+			lines = append(lines, fmt.Sprintf("...and %d more", len(skipped)-maxLines))
+			break
+		}
+		line := enrollment.String()
+		if runes := []rune(line); len(runes) > 180 {
+			line = string(runes[:177]) + "..."
+		}
+		lines = append(lines, line)
+	}
+	return &discordgo.MessageEmbedField{
+		Name:  fmt.Sprintf("Skipped %d enrollments", len(skipped)),
+		Value: strings.Join(lines, "\n"),
+	}
+}
+
+// DescribeCanvasError explains to staff what a Canvas API error means for them,
+// returning "" if err didn't come from Canvas
+func DescribeCanvasError(err error) string {
+	switch {
+	case errors.Is(err, canvas.ErrUnauthorized):
+		return "Canvas rejected the API secret. Check that it's copied correctly and hasn't expired, or give a new one with /updatecourse."
+	case errors.Is(err, canvas.ErrForbidden):
+		return "The Canvas account isn't allowed to see that course's enrollments. Use a secret from a teacher or TA of the course."
+	case errors.Is(err, canvas.ErrNotFound):
+		return "Canvas has no course with that ID, or the Canvas account can't see it."
+	case errors.Is(err, canvas.ErrThrottled):
+		return "Canvas is rate limiting the bot right now. Try again in a few minutes."
+	case errors.Is(err, canvas.ErrUnavailable):
+		return "Canvas isn't responding right now. Try again later."
+	default:
+		return ""
+	}
+}
+
+// DescribePreviewError explains to staff why PreviewCourse failed
+func DescribePreviewError(err error) string {
+	if description := DescribeCanvasError(err); description != "" {
+		return description
+	}
+	switch {
+	case errors.Is(err, ErrNotCourseStaff):
+		return "The Canvas account doesn't belong to a teacher or TA of that course."
+	case errors.Is(err, ErrCanvasRejected):
+		return "Canvas wouldn't list the course's enrollments with that Canvas account."
+	case errors.Is(err, ErrEmptyCanvasCourse):
+		return "Canvas lists no students in that course yet."
+	default:
+		return "Failed to register course, something went wrong."
+	}
+}
+
+// HoldConnectRequest saves a /registercourse waiting on Canvas OAuth in the
+// store, so it survives a restart before the callback, and returns the state to
+// send to Canvas
+func HoldConnectRequest(request store.ConnectRequest) (string, error) {
+	state, err := randomId()
+	if err != nil {
+		return "", err
+	}
+	request.ExpiresAt = time.Now().Add(previewTTL)
+	if err := dataStore.PutConnectRequest(state, request); err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// TakeConnectRequest removes and returns a held request, nil if it expired or was already taken
+func TakeConnectRequest(state string) (*store.ConnectRequest, error) {
+	return dataStore.TakeConnectRequest(state, time.Now())
+}
+
+// HoldPreview keeps a preview until it's confirmed or expires and returns its ID
+func HoldPreview(preview *CoursePreview) (string, error) {
+	return previews.hold(preview, previewTTL)
+}
+
+// TakePreview removes and returns a held preview, nil if it expired or was already taken
+func TakePreview(id string) *CoursePreview {
+	preview, _ := previews.take(id)
+	return preview
+}
+
+func RegisterCourse(course canvas.Course) error {
+	log.Println("Registering course for guildId:", course.GuildId)
+
+	err := dataStore.AddCourse(course)
+	if err != nil {
+		log.Println("Error saving course while registering course:", err)
+		return err
+	}
+	return nil
+}
+
+func GetCourseObject(guildId string, courseId string) (*canvas.Course, error) {
+	course, err := dataStore.Course(guildId, courseId)
+	if err != nil {
+		log.Println("Error reading course while getting course object:", err)
+		return nil, err
+	}
+	return course, nil
+}
+
+func GetGuildCourses(guildId string) ([]canvas.Course, error) {
+	courses, err := dataStore.GuildCourses(guildId)
+	if err != nil {
+		log.Println("Error reading courses for guildId:", guildId, err)
 		return nil, err
 	}
-	for _, course := range serverConfig.Courses {
-		if course.GuildId == guildID {
-			return &course, nil
+	return courses, nil
+}
+
+// NotifyStaff logs a message and posts it to the staff channel of the guild's
+// courses, or to STAFF_CHANNEL_ID if none of them has one
+func NotifyStaff(s *discordgo.Session, guildId string, title string, message string) {
+	log.Printf("Staff notice for guildId %s - %s: %s\n", guildId, title, message)
+
+	channelId := os.Getenv("STAFF_CHANNEL_ID")
+	if courses, err := dataStore.GuildCourses(guildId); err == nil {
+		for _, course := range courses {
+			if course.StaffChannelId != "" {
+				channelId = course.StaffChannelId
+				break
+			}
 		}
 	}
-	return nil, nil
+	postStaffNotice(s, channelId, title, message)
+}
+
+// NotifyCourseStaff is NotifyStaff for a message about one course, preferring
+// that course's staff channel
+func NotifyCourseStaff(s *discordgo.Session, course canvas.Course, title string, message string) {
+	if course.StaffChannelId == "" {
+		NotifyStaff(s, course.GuildId, title, message)
+		return
+	}
+	log.Printf("Staff notice for %s in guildId %s - %s: %s\n", course.CourseId, course.GuildId, title, message)
+	postStaffNotice(s, course.StaffChannelId, title, message)
+}
+
+func postStaffNotice(s *discordgo.Session, channelId string, title string, message string) {
+	if channelId == "" {
+		return
+	}
+
+	_, err := s.ChannelMessageSendEmbed(channelId, NewEmbed(title, message, 0xff4400, nil))
+	if err != nil {
+		log.Println("Error posting staff notice:", err)
+	}
+}
+
+var manageServerPermission int64 = discordgo.PermissionManageServer
+
+// IsManager reports whether a member has Manage Server, which allows every
+// admin command for every course
+func IsManager(member *discordgo.Member) bool {
+	return member != nil && member.Permissions&(discordgo.PermissionManageServer|discordgo.PermissionAdministrator) != 0
+}
+
+// IsStaff reports whether a member may use the admin commands for courseId:
+// they need Manage Server, or one of that course's staff roles
+func IsStaff(guildId string, courseId string, member *discordgo.Member) bool {
+	if IsManager(member) {
+		return true
+	}
+	return StaffCourseIds(guildId, member)[courseId]
+}
+
+// StaffCourseIds returns the IDs of the guild's courses that list one of the
+// member's roles as a staff role
+func StaffCourseIds(guildId string, member *discordgo.Member) map[string]bool {
+	courseIds := make(map[string]bool)
+	if member == nil {
+		return courseIds
+	}
+
+	courses, err := dataStore.GuildCourses(guildId)
+	if err != nil {
+		log.Println("Error reading courses while checking staff roles:", err)
+		return courseIds
+	}
+	for _, course := range courses {
+		for _, staffRoleId := range course.StaffRoleIds {
+			for _, roleId := range member.Roles {
+				if roleId == staffRoleId {
+					courseIds[course.CourseId] = true
+				}
+			}
+		}
+	}
+	return courseIds
+}
+
+var (
+	// name that the command is invoked by
+	StaffRoleName = "staffrole"
+
+	// invoked by "/staffrole add|remove|list"
+	StaffRoleCommand = discordgo.ApplicationCommand{
+		Name:        "staffrole",
+		Description: "Let a role use the course admin commands without Manage Server",
+
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "add",
+				Description: "Allow a role to use the admin commands for a course",
+				Options: []*discordgo.ApplicationCommandOption{
+					courseOption,
+					{
+						Type:        discordgo.ApplicationCommandOptionRole,
+						Name:        "role",
+						Description: "Staff role",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "remove",
+				Description: "Stop a role from using the admin commands for a course",
+				Options: []*discordgo.ApplicationCommandOption{
+					courseOption,
+					{
+						Type:        discordgo.ApplicationCommandOptionRole,
+						Name:        "role",
+						Description: "Staff role",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "Show the staff roles of a course",
+				Options:     []*discordgo.ApplicationCommandOption{courseOption},
+			},
+		},
+	}
+)
+
+// SetStaffRole adds roleId to or removes it from a registered course's staff roles
+func SetStaffRole(guildId string, courseId string, roleId string, allowed bool) error {
+	return editCourse(guildId, courseId, func(course *canvas.Course) {
+		var staffRoleIds []string
+		for _, staffRoleId := range course.StaffRoleIds {
+			if staffRoleId != roleId {
+				staffRoleIds = append(staffRoleIds, staffRoleId)
+			}
+		}
+		if allowed {
+			staffRoleIds = append(staffRoleIds, roleId)
+		}
+		course.StaffRoleIds = staffRoleIds
+	})
+}
+
+var (
+	// name that the command is invoked by
+	WhoisName = "whois"
+
+	// invoked by "/whois [netid] [user]"
+	WhoisCommand = discordgo.ApplicationCommand{
+		Name:        "whois",
+		Description: "Look up which Discord account verified with a NetID, or the reverse",
+
+		Type: discordgo.ChatApplicationCommand,
+		// staff only, members shouldn't be able to browse each other's NetIDs
+		DefaultMemberPermissions: &manageServerPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "netid",
+				Description: "NetID to look up",
+				Required:    false,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "user",
+				Description: "Discord user to look up",
+				Required:    false,
+			},
+		},
+	}
+)
+
+func GetVerifiedMembers(guildId string, netId string) ([]store.VerifiedMember, error) {
+	members, err := dataStore.VerifiedMembersByNetId(guildId, netId)
+	if err != nil {
+		log.Println("Error reading verified members for NetID:", netId, err)
+		return nil, err
+	}
+	return members, nil
+}
+
+func GetVerifiedMembersForUser(guildId string, userId string) ([]store.VerifiedMember, error) {
+	members, err := dataStore.VerifiedMembersByUser(guildId, userId)
+	if err != nil {
+		log.Println("Error reading verified members for user:", userId, err)
+		return nil, err
+	}
+	return members, nil
+}
+
+var (
+	// name that the command is invoked by
+	SectionRoleName = "sectionrole"
+
+	courseOption = &discordgo.ApplicationCommandOption{
+		Type:         discordgo.ApplicationCommandOptionString,
+		Name:         "course",
+		Description:  "Registered course ID",
+		Required:     true,
+		Autocomplete: true,
+	}
+	sectionOption = &discordgo.ApplicationCommandOption{
+		Type:         discordgo.ApplicationCommandOptionString,
+		Name:         "section",
+		Description:  "Canvas section",
+		Required:     true,
+		Autocomplete: true,
+	}
+
+	// invoked by "/sectionrole set|clear|list"
+	SectionRoleCommand = discordgo.ApplicationCommand{
+		Name:        "sectionrole",
+		Description: "Map Canvas sections to Discord roles",
+
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "set",
+				Description: "Give a section's students a role when they verify",
+				Options: []*discordgo.ApplicationCommandOption{
+					courseOption,
+					sectionOption,
+					{
+						Type:        discordgo.ApplicationCommandOptionRole,
+						Name:        "role",
+						Description: "Role for the section's students",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "clear",
+				Description: "Stop giving a section's students a role",
+				Options:     []*discordgo.ApplicationCommandOption{courseOption, sectionOption},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "Show a course's sections and their roles",
+				Options:     []*discordgo.ApplicationCommandOption{courseOption},
+			},
+		},
+	}
+)
+
+var (
+	// name that the command is invoked by
+	EnrollmentRoleName = "enrollmentrole"
+
+	enrollmentTypeOption = &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "type",
+		Description: "Canvas enrollment type",
+		Required:    true,
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{Name: "Student", Value: canvas.StudentEnrollment},
+			{Name: "TA", Value: canvas.TaEnrollment},
+			{Name: "Teacher", Value: canvas.TeacherEnrollment},
+			{Name: "Designer", Value: canvas.DesignerEnrollment},
+			{Name: "Observer", Value: canvas.ObserverEnrollment},
+		},
+	}
+
+	// invoked by "/enrollmentrole set|clear|list"
+	EnrollmentRoleCommand = discordgo.ApplicationCommand{
+		Name:        "enrollmentrole",
+		Description: "Give TAs, teachers and observers their own role instead of the student role",
+
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "set",
+				Description: "Give an enrollment type a role when they verify",
+				Options: []*discordgo.ApplicationCommandOption{
+					courseOption,
+					enrollmentTypeOption,
+					{
+						Type:        discordgo.ApplicationCommandOptionRole,
+						Name:        "role",
+						Description: "Role for the enrollment type",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "clear",
+				Description: "Give an enrollment type its default role again, none for designers and observers",
+				Options:     []*discordgo.ApplicationCommandOption{courseOption, enrollmentTypeOption},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "Show the role each enrollment type gets",
+				Options:     []*discordgo.ApplicationCommandOption{courseOption},
+			},
+		},
+	}
+)
+
+var (
+	// name that the command is invoked by
+	DropPolicyName = "droppolicy"
+
+	// invoked by "/droppolicy [course] [policy] [alumni_role] [dry_run]"
+	DropPolicyCommand = discordgo.ApplicationCommand{
+		Name:        "droppolicy",
+		Description: "Choose what happens to verified members who drop the course on Canvas",
+
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			courseOption,
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "policy",
+				Description: "What to do when a verified member drops",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "Report to staff", Value: canvas.DropReport},
+					{Name: "Remove course roles", Value: canvas.DropRemove},
+					{Name: "Move to alumni role", Value: canvas.DropAlumni},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionRole,
+				Name:        "alumni_role",
+				Description: "Role for members who dropped, needed by the alumni policy",
+				Required:    false,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "dry_run",
+				Description: "Only post what the policy would do to the staff channel",
+				Required:    false,
+			},
+		},
+	}
+)
+
+// SetDropPolicy saves a registered course's drop policy
+func SetDropPolicy(guildId string, courseId string, dropPolicy string, alumniRoleId string, dryRun bool) error {
+	return editCourse(guildId, courseId, func(course *canvas.Course) {
+		course.DropPolicy = dropPolicy
+		course.AlumniRoleId = alumniRoleId
+		course.DropDryRun = dryRun
+	})
+}
+
+var (
+	// name that the command is invoked by
+	EmailSettingsName = "emailsettings"
+
+	// invoked by "/emailsettings [course] [subject] [course_name] [signature] [reset]"
+	EmailSettingsCommand = discordgo.ApplicationCommand{
+		Name:        "emailsettings",
+		Description: "Change the verification email sent for a course, or show the current settings",
+
+		Type:                     discordgo.ChatApplicationCommand,
+		DefaultMemberPermissions: &manageServerPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			courseOption,
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "subject",
+				Description: "Subject line of the email",
+				Required:    false,
+				MaxLength:   150,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "course_name",
+				Description: "Course name shown in the email, e.g. COSC 202",
+				Required:    false,
+				MaxLength:   100,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "signature",
+				Description: "Who the email is signed by, use \\n for a new line",
+				Required:    false,
+				MaxLength:   300,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "reset",
+				Description: "Go back to the default email before applying the other options",
+				Required:    false,
+			},
+		},
+	}
+)
+
+// EmailSettings are changes to a course's verification email, nil fields are
+// left as they are and empty ones go back to the default
+type EmailSettings struct {
+	Subject    *string
+	CourseName *string
+	Signature  *string
+}
+
+// SetEmailSettings saves a registered course's verification email overrides
+func SetEmailSettings(guildId string, courseId string, settings EmailSettings, reset bool) error {
+	return editCourse(guildId, courseId, func(course *canvas.Course) {
+		if reset {
+			course.EmailSubject = ""
+			course.EmailCourseName = ""
+			course.EmailSignature = ""
+		}
+		if settings.Subject != nil {
+			course.EmailSubject = strings.TrimSpace(*settings.Subject)
+		}
+		if settings.CourseName != nil {
+			course.EmailCourseName = strings.TrimSpace(*settings.CourseName)
+		}
+		if settings.Signature != nil {
+			// slash command options can't hold new lines
+			course.EmailSignature = strings.TrimSpace(strings.ReplaceAll(*settings.Signature, `\n`, "\n"))
+		}
+	})
+}
+
+// SetSectionRole maps sectionId to roleId in a registered course, an empty
+// roleId removes the mapping
+func SetSectionRole(guildId string, courseId string, sectionId string, roleId string) error {
+	return editCourse(guildId, courseId, func(course *canvas.Course) {
+		course.SectionRoles = setRole(course.SectionRoles, sectionId, roleId)
+	})
+}
+
+// SetEnrollmentRole maps a Canvas enrollment type to roleId in a registered
+// course, an empty roleId removes the mapping
+func SetEnrollmentRole(guildId string, courseId string, enrollmentType string, roleId string) error {
+	return editCourse(guildId, courseId, func(course *canvas.Course) {
+		course.EnrollmentRoles = setRole(course.EnrollmentRoles, enrollmentType, roleId)
+	})
+}
+
+func setRole(roles map[string]string, key string, roleId string) map[string]string {
+	if roles == nil {
+		roles = make(map[string]string)
+	}
+	if roleId == "" {
+		delete(roles, key)
+	} else {
+		roles[key] = roleId
+	}
+	return roles
+}
+
+// editCourse applies edit to a registered course's settings and saves it
+func editCourse(guildId string, courseId string, edit func(course *canvas.Course)) error {
+	course, err := dataStore.Course(guildId, courseId)
+	if err != nil {
+		log.Println("Error reading course while editing course:", err)
+		return err
+	}
+	if course == nil {
+		return store.ErrCourseNotFound
+	}
+
+	edit(course)
+	err = dataStore.UpdateCourse(*course)
+	if err != nil {
+		log.Println("Error saving course while editing course:", err)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"utk-auth-go/src/pkg/canvas"
+	"utk-auth-go/src/pkg/canvas/canvastest"
+	"utk-auth-go/src/pkg/store"
+)
+
+func TestPreviewCourse(t *testing.T) {
+	fake, err := canvastest.New(canvastest.Fixtures)
+	if err != nil {
+		t.Fatal("loading fixtures:", err)
+	}
+	server := fake.Start()
+	defer server.Close()
+	t.Setenv("CANVAS_BASE_URL", server.URL)
+
+	tests := []struct {
+		name     string
+		courseId string
+		secret   string
+		// throttled is how many requests Canvas rate limits first
+		throttled int
+		students  int
+		err       error
+	}{
+		{name: "teacher", courseId: "1001", secret: canvastest.Token, students: 25},
+		{name: "empty course", courseId: "1002", secret: canvastest.Token, err: ErrEmptyCanvasCourse},
+		{name: "taken as a student", courseId: "1003", secret: canvastest.Token, err: ErrNotCourseStaff},
+		{name: "bad secret", courseId: "1001", secret: "wrong", err: canvas.ErrUnauthorized},
+		{name: "brief throttling", courseId: "1001", secret: canvastest.Token, throttled: 1, students: 25},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.throttled > 0 {
+				fake.SetMode(canvastest.Throttled, test.throttled)
+				defer fake.SetMode(canvastest.Normal, 0)
+			}
+			preview, err := PreviewCourse("guild", test.secret, test.courseId, "role", "")
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+				if DescribePreviewError(err) == DescribePreviewError(errors.New("other")) {
+					t.Errorf("%v isn't described", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preview.StudentCount != test.students {
+				t.Errorf("counted %d students, want %d", preview.StudentCount, test.students)
+			}
+		})
+	}
+
+	t.Run("register", func(t *testing.T) {
+		SetStore(store.NewMemoryStore())
+		preview, err := PreviewCourse("guild", canvastest.Token, "1001", "role", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterCourse(preview.Course); err != nil {
+			t.Fatal(err)
+		}
+		course, err := GetCourseObject("guild", "1001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if course == nil || len(course.Students) != 28 {
+			t.Errorf("registered course is %+v", course)
+		}
+	})
+}
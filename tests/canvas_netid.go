@@ -1,56 +1,25 @@
 package main
 
+// lists a course's students, reading CANVAS_API_TOKEN and COURSE_ID, and
+// CANVAS_BASE_URL for an instance other than canvas.instructure.com
+
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
-	"strings"
+	"utk-auth-go/src/pkg/canvas"
 )
 
-// Enrollment represents the structure of the enrollment data in the JSON response
-type Enrollment struct {
-	User struct {
-		LoginID string `json:"login_id"`
-		Name    string `json:"name"`
-	} `json:"user"`
-}
-
-func getNetIds() (map[string]string, []Enrollment, error) {
-	canvasApiToken := os.Getenv("CANVAS_API_TOKEN")
-	courseId := os.Getenv("COURSE_ID")
-
-	url := fmt.Sprintf("https://canvas.instructure.com/api/v1/courses/%s/enrollments?type=StudentEnrollment&per_page=230", courseId)
-	request, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	request.Header.Add("Authorization", "Bearer "+canvasApiToken)
-
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer response.Body.Close()
-
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var enrollments []Enrollment
-	err = json.Unmarshal(body, &enrollments)
+func getNetIds() (map[string]string, []canvas.Enrollment, error) {
+	client := canvas.NewClient(os.Getenv("CANVAS_API_TOKEN"))
+	enrollments, err := client.Enrollments(os.Getenv("COURSE_ID"), canvas.StudentEnrollment)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	var netIds map[string]string = make(map[string]string)
 	for _, enrollment := range enrollments {
-		words := strings.Fields(enrollment.User.Name)
-		netIds[enrollment.User.LoginID] = words[0] + " " + words[len(words)-1]
+		netIds[enrollment.User.LoginId] = enrollment.User.Name
 	}
 
 	return netIds, enrollments, nil
@@ -77,7 +46,7 @@ func main() {
 	}
 
 	// write to file
-	err = ioutil.WriteFile("enrollments.json", enrollmentData, 0644)
+	err = os.WriteFile("enrollments.json", enrollmentData, 0644)
 
 	// marshal net id map to json
 	netIdData, err := json.MarshalIndent(netIds, "", "  ")
@@ -86,5 +55,5 @@ func main() {
 		return
 	}
 
-	err = ioutil.WriteFile("netids.json", netIdData, 0644)
+	err = os.WriteFile("netids.json", netIdData, 0644)
 }
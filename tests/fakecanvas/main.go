@@ -0,0 +1,49 @@
+package main
+
+// fake Canvas API for running the bot or tests/canvas_netid.go offline. Run
+// it, then start the bot with
+//
+//	CANVAS_BASE_URL=http://localhost:8090
+//
+// and register course 1001 with the secret fake-canvas-token. The courses come
+// from the bundled fixtures, or from the *.json files in FAKE_CANVAS_FIXTURES.
+// FAKE_CANVAS_MODE=unauthorized|not_found|throttled|malformed|unavailable
+// makes every request fail that way.
+
+import (
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"utk-auth-go/src/pkg/canvas/canvastest"
+)
+
+var modes = map[string]canvastest.Mode{
+	"":             canvastest.Normal,
+	"unauthorized": canvastest.Unauthorized,
+	"not_found":    canvastest.NotFound,
+	"throttled":    canvastest.Throttled,
+	"malformed":    canvastest.Malformed,
+	"unavailable":  canvastest.Unavailable,
+}
+
+func main() {
+	fixtures := canvastest.Fixtures
+	if dir := os.Getenv("FAKE_CANVAS_FIXTURES"); dir != "" {
+		fixtures = os.DirFS(dir)
+	}
+	fake, err := canvastest.New(fixtures)
+	if err != nil {
+		log.Fatal("Error loading fixtures: ", err)
+	}
+
+	mode, ok := modes[os.Getenv("FAKE_CANVAS_MODE")]
+	if !ok {
+		log.Fatal("Unknown FAKE_CANVAS_MODE ", os.Getenv("FAKE_CANVAS_MODE"))
+	}
+	fake.SetMode(mode, 0)
+
+	courses, _ := fs.Glob(fixtures, "*.json")
+	log.Println("Fake Canvas API listening on :8090 with", courses)
+	log.Fatal(http.ListenAndServe(":8090", fake))
+}
@@ -0,0 +1,33 @@
+package main
+
+// fake Canvas OAuth provider for trying the /registercourse Connect Canvas flow
+// locally. Run it, then start the bot with
+//
+//	CANVAS_OAUTH_BASE_URL=http://localhost:8089
+//	CANVAS_OAUTH_CLIENT_ID=fake-client
+//	CANVAS_OAUTH_CLIENT_SECRET=fake-secret
+//
+// The authorize page approves straight away, set FAKE_OAUTH_DENY=1 to deny
+// instead. Access tokens last FAKE_OAUTH_EXPIRES_IN seconds (default 60) so
+// refreshes are easy to watch.
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"utk-auth-go/src/pkg/canvasoauth/oauthtest"
+)
+
+func main() {
+	fake := oauthtest.New()
+	fake.Deny = os.Getenv("FAKE_OAUTH_DENY") == "1"
+	expiresIn, err := strconv.Atoi(os.Getenv("FAKE_OAUTH_EXPIRES_IN"))
+	if err != nil {
+		expiresIn = 60
+	}
+	fake.ExpiresIn = expiresIn
+
+	log.Println("Fake Canvas OAuth provider listening on :8089")
+	log.Fatal(http.ListenAndServe(":8089", fake))
+}